@@ -0,0 +1,298 @@
+// Package admin provides an http.Handler to probe and operate a lazyhttp.Client.
+//
+// The handler serves its endpoints at the root, mount it under a prefix with StripPrefix:
+//
+//	mux.Handle("/admin/", http.StripPrefix("/admin", admin.New(client, admin.Options{})))
+//
+// Endpoints:
+//
+//	GET  /healthz           storage and pubsub reachability, consumer state
+//	GET  /stats             hit ratio, compression ratio, refresh queue and dead-letter depths
+//	POST /cache/invalidate  removes the entries given as {"keys": [...], "tags": [...], "prefix": "..."} or ?key=&tag=&prefix=
+//	POST /cache/refresh     publishes a refresh job, given as {"url", "method", "header", "key", "payload"}
+//
+// The cache endpoints change state, only expose the handler on an internal listener.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dendhi31/lazyhttp"
+	"github.com/dendhi31/lazyhttp/cache"
+	"github.com/dendhi31/lazyhttp/logger"
+)
+
+// Options configures the admin handler
+type Options struct {
+	// RequireConsumer makes /healthz fail when the consumer does not run in this process
+	RequireConsumer bool
+	// PingTimeout bounds each reachability check of /healthz, default is 1s
+	PingTimeout time.Duration
+}
+
+// Handler serves the admin endpoints of a client
+type Handler struct {
+	client  *lazyhttp.Client
+	options Options
+	mux     *http.ServeMux
+	log     logger.Logger
+}
+
+// New creates the admin handler of client
+func New(client *lazyhttp.Client, options Options) *Handler {
+	if options.PingTimeout <= 0 {
+		options.PingTimeout = time.Second
+	}
+	h := &Handler{
+		client:  client,
+		options: options,
+		mux:     http.NewServeMux(),
+		log:     client.Logger,
+	}
+	if h.log == nil {
+		h.log = logger.Nop()
+	}
+	h.mux.HandleFunc("/healthz", h.healthz)
+	h.mux.HandleFunc("/stats", h.stats)
+	h.mux.HandleFunc("/cache/invalidate", h.invalidate)
+	h.mux.HandleFunc("/cache/refresh", h.refresh)
+	return h
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Check is the result of one health check
+type Check struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	// Unchecked is set for a cache which cannot ping, it is reported OK
+	Unchecked bool `json:"unchecked,omitempty"`
+}
+
+// Health is the /healthz response
+type Health struct {
+	OK              bool  `json:"ok"`
+	Storage         Check `json:"storage"`
+	PubSub          Check `json:"pubsub"`
+	ConsumerRunning bool  `json:"consumer_running"`
+}
+
+// Stats is the /stats response. The client has no circuit breaker, so there are no circuit states:
+// a failing upstream is asked again on every request and the cache answers in its place.
+type Stats struct {
+	// HitRatio is hits / (hits + misses), it is only set when the client has Metrics
+	HitRatio *float64 `json:"hit_ratio,omitempty"`
+	// CompressionRatio is raw / stored body bytes, it is only set when the client has Metrics
+	// and stored a body with compression enabled
+	CompressionRatio *float64 `json:"compression_ratio,omitempty"`
+	// QueueDepth is the number of refresh jobs the consumer of this process received and did not
+	// process yet, only set when it runs here. Pub/sub keeps no backlog on the server.
+	QueueDepth *int `json:"queue_depth,omitempty"`
+	// DeadLetters is the depth of the dead-letter list, only set when DeadLetterKey is configured
+	DeadLetters     *int64 `json:"dead_letters,omitempty"`
+	ConsumerRunning bool   `json:"consumer_running"`
+	Channel         string `json:"channel"`
+	Error           string `json:"error,omitempty"`
+}
+
+func (h *Handler) healthz(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	var health Health
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		health.Storage = h.ping(r.Context(), h.client.CacheClient)
+	}()
+	go func() {
+		defer wg.Done()
+		health.PubSub = h.ping(r.Context(), h.client.PubsubClient)
+	}()
+	wg.Wait()
+	health.ConsumerRunning = h.client.ConsumerRunning()
+	health.OK = health.Storage.OK && health.PubSub.OK && (health.ConsumerRunning || !h.options.RequireConsumer)
+
+	status := http.StatusOK
+	if !health.OK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, health)
+}
+
+// ping pings c within PingTimeout, a ping still running after it is reported as failed
+func (h *Handler) ping(ctx context.Context, c cache.ContextCacher) Check {
+	pinger, ok := c.(cache.Pinger)
+	if !ok {
+		return Check{OK: true, Unchecked: true}
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.options.PingTimeout)
+	defer cancel()
+	if err := pinger.Ping(ctx); err != nil {
+		return Check{Error: err.Error()}
+	}
+	return Check{OK: true}
+}
+
+func (h *Handler) stats(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	stats := Stats{
+		ConsumerRunning: h.client.ConsumerRunning(),
+		Channel:         h.channel(),
+	}
+	if h.client.Metrics != nil {
+		ratio := h.client.Metrics.HitRatio()
+		stats.HitRatio = &ratio
+		if compression := h.client.Metrics.CompressionRatio(); compression > 0 {
+			stats.CompressionRatio = &compression
+		}
+	}
+	if n, ok := h.client.PendingRefreshes(); ok {
+		stats.QueueDepth = &n
+	}
+	if h.client.DeadLetterKey != "" {
+		n, err := h.client.DeadLetters()
+		if err != nil {
+			stats.Error = fmt.Sprintf("error read dead letters: %v", err)
+		} else {
+			stats.DeadLetters = &n
+		}
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+type invalidateRequest struct {
+	Keys   []string `json:"keys"`
+	Tags   []string `json:"tags"`
+	Prefix string   `json:"prefix"`
+}
+
+func (h *Handler) invalidate(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+	var req invalidateRequest
+	if r.ContentLength != 0 && isJSON(r) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("error decode body: %v", err))
+			return
+		}
+	}
+	query := r.URL.Query()
+	req.Keys = append(req.Keys, query["key"]...)
+	req.Tags = append(req.Tags, query["tag"]...)
+	if req.Prefix == "" {
+		req.Prefix = query.Get("prefix")
+	}
+	if len(req.Keys) == 0 && len(req.Tags) == 0 && req.Prefix == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("no key, tag or prefix given"))
+		return
+	}
+
+	invalidated, err := h.client.InvalidateKeys(r.Context(), req.Keys...)
+	if err == nil && len(req.Tags) > 0 {
+		var n int
+		n, err = h.client.InvalidateTags(r.Context(), req.Tags...)
+		invalidated += n
+	}
+	if err == nil && req.Prefix != "" {
+		var n int
+		n, err = h.client.InvalidatePrefix(r.Context(), req.Prefix)
+		invalidated += n
+	}
+	if err != nil {
+		h.log.Error("admin invalidate failed", logger.KeyError, err)
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	h.log.Info("cache invalidated from admin", "keys", invalidated)
+	writeJSON(w, http.StatusOK, map[string]int{"invalidated": invalidated})
+}
+
+type refreshRequest struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Header  map[string]string `json:"header"`
+	Key     string            `json:"key"`
+	Payload []byte            `json:"payload"`
+	Tags    []string          `json:"tags"`
+}
+
+func (h *Handler) refresh(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("error decode body: %v", err))
+		return
+	}
+	if req.URL == "" || req.Key == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("url and key are required"))
+		return
+	}
+	if req.Method == "" {
+		req.Method = http.MethodGet
+	}
+	err := h.client.Refresh(r.Context(), &lazyhttp.Request{
+		URL:      req.URL,
+		Method:   strings.ToUpper(req.Method),
+		Body:     req.Payload,
+		Header:   req.Header,
+		Key:      req.Key,
+		UseCache: true,
+		Tags:     req.Tags,
+	})
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"key": req.Key, "channel": h.channel()})
+}
+
+func (h *Handler) channel() string {
+	if h.client.Channel == "" {
+		return lazyhttp.DefaultChannel
+	}
+	return h.client.Channel
+}
+
+// allow answers 405 and returns false when the request method is not one of methods
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+func isJSON(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	return ct == "" || strings.HasPrefix(ct, "application/json")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
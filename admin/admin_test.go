@@ -0,0 +1,53 @@
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dendhi31/lazyhttp"
+	"github.com/dendhi31/lazyhttp/admin"
+	"github.com/dendhi31/lazyhttp/lazyhttptest"
+)
+
+func TestInvalidateCountsCachedKeys(t *testing.T) {
+	h := lazyhttptest.New(t, lazyhttp.Config{})
+	if _, err := h.Client.Do(context.Background(), h.Request("/a", false)); err != nil {
+		t.Fatal(err)
+	}
+	h.WaitStored("/a")
+
+	req := httptest.NewRequest(http.MethodPost, "/cache/invalidate", strings.NewReader(`{"keys":["/a","/missing"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	admin.New(h.Client, admin.Options{}).ServeHTTP(rec, req)
+
+	var got map[string]int
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	if got["invalidated"] != 1 {
+		t.Errorf("invalidated %d, want only the cached key", got["invalidated"])
+	}
+	if ok, _ := h.Cacher.Exists(context.Background(), "/a"); ok {
+		t.Error("/a is still cached")
+	}
+}
+
+func TestStatsWithoutConsumer(t *testing.T) {
+	h := lazyhttptest.New(t, lazyhttp.Config{})
+
+	rec := httptest.NewRecorder()
+	admin.New(h.Client, admin.Options{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+
+	var stats admin.Stats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	if stats.QueueDepth != nil {
+		t.Errorf("queue depth %d, want none without a consumer in this process", *stats.QueueDepth)
+	}
+}
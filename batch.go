@@ -0,0 +1,138 @@
+package lazyhttp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dendhi31/lazyhttp/cache"
+	"github.com/dendhi31/lazyhttp/logger"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// BatchResult is the result of one request of DoBatch
+type BatchResult struct {
+	Response *Response
+	Err      error
+}
+
+// batch is the state the requests of a DoBatch call share, it travels in their context
+type batch struct {
+	deadline time.Time
+	sem      chan struct{}
+	values   map[string]string
+	err      error
+}
+
+type batchKey struct{}
+
+func batchFrom(ctx context.Context) *batch {
+	b, _ := ctx.Value(batchKey{}).(*batch)
+	return b
+}
+
+// lookup returns the value DoBatch read for key, empty when it is missing
+func (b *batch) lookup(key string) (string, error) {
+	if b.err != nil {
+		return "", b.err
+	}
+	return b.values[key], nil
+}
+
+// acquire waits for an upstream slot until ctx is done
+func (b *batch) acquire(ctx context.Context) error {
+	select {
+	case b.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return errors.New("context timeout HTTP")
+	}
+}
+
+func (b *batch) release() {
+	<-b.sem
+}
+
+// DoBatch sends reqs like Do and returns their results in the same order.
+// The cache keys are read in a single round trip, so UseCache requests found in the cache
+// are served without asking the upstream. At most BatchConcurrency upstream requests are in flight,
+// and the batch waits for the upstream until ctx deadline or WaitHttp, whichever comes first.
+func (httprequest *Client) DoBatch(ctx context.Context, reqs []*Request) []BatchResult {
+	ctx, span := httprequest.tracer().Start(ctx, "lazyhttp.DoBatch", trace.WithAttributes(
+		attrBatchSize.Int(len(reqs)),
+	))
+	defer span.End()
+
+	b := &batch{
+		deadline: time.Now().Add(httprequest.WaitHttp * time.Millisecond),
+		sem:      make(chan struct{}, httprequest.BatchConcurrency),
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(b.deadline) {
+		b.deadline = deadline
+	}
+	b.values, b.err = httprequest.lookupBatch(ctx, b.deadline, reqs)
+	if b.err != nil {
+		httprequest.Logger.Warn("batch request via redis failed", "requests", len(reqs), logger.KeyError, b.err)
+	}
+	ctx = context.WithValue(ctx, batchKey{}, b)
+
+	results := make([]BatchResult, len(reqs))
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		wg.Add(1)
+		go func(i int, req *Request) {
+			defer wg.Done()
+			results[i].Response, results[i].Err = httprequest.Do(ctx, req)
+		}(i, req)
+	}
+	wg.Wait()
+	return results
+}
+
+// lookupBatch reads the cache keys of reqs, from the local cache first and then with one MGET.
+// The read is bounded by WaitRedis and deadline.
+func (httprequest *Client) lookupBatch(ctx context.Context, deadline time.Time, reqs []*Request) (map[string]string, error) {
+	values := make(map[string]string, len(reqs))
+	seen := make(map[string]bool, len(reqs))
+	var keys []string
+	for _, req := range reqs {
+		if seen[req.Key] {
+			continue
+		}
+		seen[req.Key] = true
+		if httprequest.local != nil {
+			if value, ok := httprequest.local.get(req.Key); ok {
+				values[req.Key] = value
+				continue
+			}
+		}
+		keys = append(keys, req.Key)
+	}
+	if len(keys) == 0 {
+		return values, nil
+	}
+
+	if redisDeadline := time.Now().Add(httprequest.WaitRedis * time.Millisecond); redisDeadline.Before(deadline) {
+		deadline = redisDeadline
+	}
+	rctx, cancel := context.WithDeadline(context.WithoutCancel(ctx), deadline)
+	defer cancel()
+	_, span := httprequest.tracer().Start(rctx, "lazyhttp.redis.mget", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrDBSystem.String("redis"), attrBatchKeys.Int(len(keys))))
+	start := time.Now()
+	found, err := httprequest.CacheClient.MGet(rctx, keys...)
+	httprequest.Metrics.ObserveRedis("mget", time.Since(start))
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range found {
+		values[key] = value
+		// chunked entries are too large to keep a local copy of
+		if httprequest.local != nil && value != "" && !cache.IsManifest(value) {
+			httprequest.local.set(key, value)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,159 @@
+package lazyhttp_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dendhi31/lazyhttp"
+	"github.com/dendhi31/lazyhttp/cache"
+	"github.com/dendhi31/lazyhttp/lazyhttptest"
+)
+
+func TestDoBatchChunkedThenDo(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 300)
+	h := lazyhttptest.New(t, lazyhttp.Config{
+		StoreEnvelope: true,
+		Chunking:      cache.Chunking{Threshold: 1000, ChunkSize: 400},
+		LocalCacheTTL: 60000,
+	})
+	h.Upstream.SetHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	ctx := context.Background()
+
+	if _, err := h.Client.Do(ctx, h.Request("/big", false)); err != nil {
+		t.Fatal(err)
+	}
+	h.WaitStored("/big")
+
+	results := h.Client.DoBatch(ctx, []*lazyhttp.Request{h.Request("/big", true)})
+	if results[0].Err != nil {
+		t.Fatal(results[0].Err)
+	}
+	h.AssertServedFromCache(results[0].Response)
+	if !bytes.Equal(results[0].Response.Body, body) {
+		t.Errorf("batch body is %d bytes, want the %d bytes of the chunks", len(results[0].Response.Body), len(body))
+	}
+
+	// the manifest read by the batch is not kept as a local copy
+	resp, err := h.Client.Do(ctx, h.Request("/big", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AssertServedFromCache(resp)
+	if !bytes.Equal(resp.Body, body) {
+		t.Errorf("body after the batch is %q, want the %d bytes of the chunks", truncate(resp.Body), len(body))
+	}
+	h.AssertUpstreamCalls(1)
+}
+
+func TestDoBatchOrder(t *testing.T) {
+	h := lazyhttptest.New(t, lazyhttp.Config{})
+	// the first requests answer last
+	h.Upstream.SetPathFault("/a", lazyhttptest.Fault{Latency: 60 * time.Millisecond})
+	h.Upstream.SetPathFault("/b", lazyhttptest.Fault{Latency: 30 * time.Millisecond})
+
+	paths := []string{"/a", "/b", "/c"}
+	var reqs []*lazyhttp.Request
+	for _, path := range paths {
+		reqs = append(reqs, h.Request(path, false))
+	}
+	for i, result := range h.Client.DoBatch(context.Background(), reqs) {
+		if result.Err != nil {
+			t.Fatalf("%s: %v", paths[i], result.Err)
+		}
+		if string(result.Response.Body) != paths[i] {
+			t.Errorf("result %d is %q, want %q", i, result.Response.Body, paths[i])
+		}
+	}
+}
+
+func TestDoBatchPerItemErrors(t *testing.T) {
+	h := lazyhttptest.New(t, lazyhttp.Config{})
+	h.Upstream.SetPathFault("/fail", lazyhttptest.Fault{Err: lazyhttptest.ErrInjected})
+
+	results := h.Client.DoBatch(context.Background(), []*lazyhttp.Request{
+		h.Request("/ok", false),
+		h.Request("/fail", false),
+		{URL: "://no-scheme", Method: http.MethodGet, Key: "invalid"},
+	})
+	if results[0].Err != nil || string(results[0].Response.Body) != "/ok" {
+		t.Errorf("/ok failed with the others: %v", results[0].Err)
+	}
+	for i, result := range results[1:] {
+		if result.Err == nil {
+			t.Errorf("result %d has no error", i+1)
+		}
+	}
+}
+
+func TestDoBatchDeadline(t *testing.T) {
+	h := lazyhttptest.New(t, lazyhttp.Config{WaitHttp: 1000, MainTimeout: 2000, HTTPRequestTimeout: 2000})
+	ctx := context.Background()
+	if _, err := h.Client.Do(ctx, h.Request("/cached", false)); err != nil {
+		t.Fatal(err)
+	}
+	h.WaitStored("/cached")
+	h.Upstream.SetFault(lazyhttptest.Fault{Latency: time.Second})
+
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	results := h.Client.DoBatch(ctx, []*lazyhttp.Request{h.Request("/cached", true), h.Request("/slow", false)})
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("batch took %s, want the 100ms of its context and not WaitHttp", elapsed)
+	}
+	if results[0].Err != nil {
+		t.Fatal(results[0].Err)
+	}
+	h.AssertServedFromCache(results[0].Response)
+	if results[1].Err == nil {
+		t.Error("/slow answered past the batch deadline")
+	}
+}
+
+func TestDoBatchChunkedAndPlain(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789"), 300)
+	h := lazyhttptest.New(t, lazyhttp.Config{
+		StoreEnvelope: true,
+		Chunking:      cache.Chunking{Threshold: 1000, ChunkSize: 400},
+	})
+	h.Upstream.SetHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/big" {
+			w.Write(big)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	ctx := context.Background()
+	for _, path := range []string{"/small", "/big"} {
+		if _, err := h.Client.Do(ctx, h.Request(path, false)); err != nil {
+			t.Fatal(err)
+		}
+		h.WaitStored(path)
+	}
+	h.Upstream.SetFault(lazyhttptest.Fault{Status: http.StatusServiceUnavailable})
+
+	// the single MGET returns a manifest for /big, its chunks are read after
+	results := h.Client.DoBatch(ctx, []*lazyhttp.Request{h.Request("/big", true), h.Request("/small", true)})
+	for i, want := range [][]byte{big, []byte("/small")} {
+		if results[i].Err != nil {
+			t.Fatal(results[i].Err)
+		}
+		h.AssertServedFromCache(results[i].Response)
+		if !bytes.Equal(results[i].Response.Body, want) {
+			t.Errorf("result %d is %q, want %q", i, truncate(results[i].Response.Body), truncate(want))
+		}
+	}
+	h.AssertCacherCalls("MGet", 1)
+}
+
+func truncate(b []byte) []byte {
+	if len(b) > 40 {
+		return b[:40]
+	}
+	return b
+}
@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"sync"
+
+	"github.com/dendhi31/lazyhttp/redis"
+)
+
+// Broker is an in-process pub/sub, for the Cachers that have no server to publish through.
+// Messages are queued per subscription without bound, so a publisher never blocks.
+type Broker struct {
+	mu     sync.Mutex
+	subs   map[*brokerSub]struct{}
+	closed bool
+}
+
+// NewBroker returns an empty Broker
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[*brokerSub]struct{})}
+}
+
+// Publish sends value to the subscriptions of channel and returns how many received it
+func (b *Broker) Publish(channel string, value interface{}) int {
+	payload := FormatValue(value)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var n int
+	for sub := range b.subs {
+		for _, pattern := range sub.channels {
+			msg := &redis.Message{Channel: channel, Payload: payload}
+			if sub.pattern {
+				if !MatchGlob(pattern, channel) {
+					continue
+				}
+				msg.Pattern = pattern
+			} else if pattern != channel {
+				continue
+			}
+			sub.push(msg)
+			n++
+		}
+	}
+	return n
+}
+
+// Subscribe subscribes to channels
+func (b *Broker) Subscribe(channels ...string) redis.Subscription {
+	return b.subscribe(false, channels)
+}
+
+// PSubscribe subscribes to the channels matching the glob patterns
+func (b *Broker) PSubscribe(patterns ...string) redis.Subscription {
+	return b.subscribe(true, patterns)
+}
+
+func (b *Broker) subscribe(pattern bool, channels []string) redis.Subscription {
+	sub := &brokerSub{
+		broker:   b,
+		pattern:  pattern,
+		channels: channels,
+		ch:       make(chan *redis.Message),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go sub.run()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(sub.done)
+	} else {
+		b.subs[sub] = struct{}{}
+	}
+	return sub
+}
+
+// Close closes every subscription, later ones are closed from the start
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		sub.closeOnce.Do(func() { close(sub.done) })
+	}
+}
+
+type brokerSub struct {
+	broker   *Broker
+	pattern  bool
+	channels []string
+
+	mu    sync.Mutex
+	queue []*redis.Message
+
+	ch        chan *redis.Message
+	wake      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *brokerSub) push(msg *redis.Message) {
+	s.mu.Lock()
+	s.queue = append(s.queue, msg)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run hands the queued messages to the channel reader until the subscription is closed
+func (s *brokerSub) run() {
+	defer close(s.ch)
+	for {
+		s.mu.Lock()
+		var msg *redis.Message
+		if len(s.queue) > 0 {
+			msg = s.queue[0]
+			s.queue = s.queue[1:]
+		}
+		s.mu.Unlock()
+		if msg == nil {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		select {
+		case s.ch <- msg:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *brokerSub) Channel() <-chan *redis.Message {
+	return s.ch
+}
+
+func (s *brokerSub) Close() error {
+	s.broker.mu.Lock()
+	delete(s.broker.subs, s)
+	s.broker.mu.Unlock()
+	s.closeOnce.Do(func() { close(s.done) })
+	return nil
+}
@@ -1,69 +1,213 @@
 package cache
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/dendhi31/lazyhttp/redis"
-	redisgo "github.com/go-redis/redis"
+	redisgo "github.com/redis/go-redis/v9"
 )
 
-// Cacher is a Cache handler that will handle all redis action related
-type Cacher interface {
+// ErrNotFound is returned by ContextCacher when a key does not exist
+var ErrNotFound = errors.New("cache: key not found")
+
+// ErrUnsupported is returned for the operations a cache has no equivalent of
+var ErrUnsupported = errors.New("cache: operation not supported")
+
+// ContextCacher is a Cache handler whose operations give up when their context is done.
+// Get and TTL return ErrNotFound for a missing key, an empty value is a value.
+// The admin, dead-letter and tag operations are optional, see Pinger, Lister, Tagger,
+// Scanner and PatternSubscriber. Caches holding connections implement io.Closer.
+type ContextCacher interface {
 	SetPrefix(prefix string)
-	Set(key string, value interface{}, ttl time.Duration) error
-	Get(key string) (string, error)
-	Remove(key string) error
-	Publish(channel string, value interface{}) error
-	Subscribe(channels ...string) *redisgo.PubSub
+	Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error
+	Get(ctx context.Context, key string) (string, error)
+	// MGet returns the values of the keys that exist, missing keys are left out
+	MGet(ctx context.Context, keys ...string) (map[string]string, error)
+	MSet(ctx context.Context, values map[string]interface{}, ttl time.Duration) error
+	Remove(ctx context.Context, key string) error
+	Exists(ctx context.Context, key string) (bool, error)
+	// TTL is 0 for a key that does not expire
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+	Publish(ctx context.Context, channel string, value interface{}) error
+	Subscribe(ctx context.Context, channels ...string) (redis.Subscription, error)
+}
+
+// Pinger is a cache which can check its server answers, it backs the health checks
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Lister is a cache keeping lists, it backs the dead letters
+type Lister interface {
+	LLen(ctx context.Context, key string) (int64, error)
+	// PushCapped appends value to the list stored at key, keeping its last max entries when max is above 0
+	PushCapped(ctx context.Context, key string, value interface{}, max int64) error
+}
+
+// Tagger is a cache keeping sets, it backs the tags and the warm manifests
+type Tagger interface {
+	SMembers(ctx context.Context, key string) ([]string, error)
+	// SAdd adds members to the set stored at key, and sets its ttl when it is not 0
+	SAdd(ctx context.Context, key string, ttl time.Duration, members ...string) error
+}
+
+// Scanner is a cache which can list its keys, it backs the prefix invalidation
+type Scanner interface {
+	// Scan calls fn with every key matching the glob pattern
+	Scan(ctx context.Context, pattern string, fn func(key string) error) error
+}
+
+// PatternSubscriber is a cache which can subscribe to glob patterns of channels, it backs the consumer
+type PatternSubscriber interface {
+	PSubscribe(ctx context.Context, patterns ...string) (redis.Subscription, error)
 }
 
 // Client is a Cache Client, in this case we are using Redis
 type Client struct {
 	redisClient redis.Clienter
 	prefix      string
-	pubsub      redisgo.PubSub
+	// options are kept for the go-redis v6 subscriptions of Legacy, nil for Wrap
+	options *redis.Options
 }
 
+var (
+	_ ContextCacher     = (*Client)(nil)
+	_ Pinger            = (*Client)(nil)
+	_ Lister            = (*Client)(nil)
+	_ Tagger            = (*Client)(nil)
+	_ Scanner           = (*Client)(nil)
+	_ PatternSubscriber = (*Client)(nil)
+)
+
 // NewCacheClient will construct new client to be reused
 func NewCacheClient(hosts []string, db int) (Cacher, error) {
-	readTimeoutDuration := time.Duration(10) * time.Minute
+	return NewCacheClientWithOptions(redis.Options{
+		Addrs: hosts,
+		DB:    db,
+	})
+}
+
+// NewCacheClientWithOptions constructs a client for the redis options,
+// the read timeout defaults to 10 minutes like NewCacheClient
+func NewCacheClientWithOptions(options redis.Options) (Cacher, error) {
+	client, err := NewClient(options)
+	if err != nil {
+		return nil, err
+	}
+	return Legacy(client), nil
+}
 
-	redisClient, err := redis.NewClient(hosts, db, readTimeoutDuration)
+// NewClient constructs a ContextCacher for the redis options, the read timeout defaults to 10 minutes.
+// Commands are bounded by their context deadline as well.
+func NewClient(options redis.Options) (*Client, error) {
+	if options.ReadTimeout == 0 {
+		options.ReadTimeout = 10 * time.Minute
+	}
 
+	redisClient, err := redis.NewClientWithOptions(options)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Client{
 		redisClient: redisClient,
+		options:     &options,
 	}, nil
 }
 
+// Wrap constructs a ContextCacher on an existing go-redis client, Close leaves it open.
+// Commands are bounded by their context deadline only when client has ContextTimeoutEnabled.
+func Wrap(client redisgo.UniversalClient) *Client {
+	return &Client{
+		redisClient: redis.Wrap(client),
+	}
+}
+
 // Set to store a key-value pair to Cache
-func (c *Client) Set(key string, value interface{}, ttl time.Duration) error {
+func (c *Client) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
 	key = c.addPrefix(key)
 
-	return c.redisClient.Set(key, value, ttl)
+	return c.redisClient.Set(ctx, key, value, ttl)
 }
 
 // Get will retrieve a certain data by it's key
-func (c *Client) Get(key string) (string, error) {
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
 	key = c.addPrefix(key)
 
-	val, err := c.redisClient.Get(key)
-	if err != nil {
-		return "", err
+	value, err := c.redisClient.Get(ctx, key)
+	return value, notFound(err)
+}
+
+// MGet returns the values of the keys that exist, in a single round trip
+func (c *Client) MGet(ctx context.Context, keys ...string) (map[string]string, error) {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = c.addPrefix(key)
+	}
+	values, err := c.redisClient.MGet(ctx, prefixed...)
+	if err != nil || c.prefix == "" {
+		return values, err
+	}
+	result := make(map[string]string, len(values))
+	for key, value := range values {
+		result[strings.TrimPrefix(key, c.prefix)] = value
+	}
+	return result, nil
+}
+
+// MSet stores every key-value pair of values with the same ttl, in a single round trip
+func (c *Client) MSet(ctx context.Context, values map[string]interface{}, ttl time.Duration) error {
+	if c.prefix != "" {
+		prefixed := make(map[string]interface{}, len(values))
+		for key, value := range values {
+			prefixed[c.addPrefix(key)] = value
+		}
+		values = prefixed
 	}
 
-	return val, nil
+	return c.redisClient.MSet(ctx, values, ttl)
 }
 
 // Remove will delete a certain value by key
-func (c *Client) Remove(key string) error {
+func (c *Client) Remove(ctx context.Context, key string) error {
+	key = c.addPrefix(key)
+
+	return c.redisClient.Remove(ctx, key)
+}
+
+// Exists reports whether key exists
+func (c *Client) Exists(ctx context.Context, key string) (bool, error) {
 	key = c.addPrefix(key)
 
-	return c.redisClient.Remove(key)
+	return c.redisClient.Exists(ctx, key)
+}
+
+// TTL returns the remaining time to live of key, 0 when it does not expire
+func (c *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	key = c.addPrefix(key)
+
+	ttl, err := c.redisClient.TTL(ctx, key)
+	return ttl, notFound(err)
+}
+
+// Expire sets the time to live of key
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	key = c.addPrefix(key)
+
+	return notFound(c.redisClient.Expire(ctx, key, ttl))
+}
+
+// notFound converts the redis not found error to ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, redis.ErrNotFound) {
+		return ErrNotFound
+	}
+	return err
 }
 
 // SetPrefix will append a prefix to this Cache Client
@@ -79,10 +223,75 @@ func (c *Client) addPrefix(key string) string {
 	return key
 }
 
-func (c *Client) Publish(channel string, value interface{}) error {
-	return c.redisClient.Publish(channel, value)
+func (c *Client) Publish(ctx context.Context, channel string, value interface{}) error {
+	return c.redisClient.Publish(ctx, channel, value)
+}
+
+// Subscribe subscribes to channels, channels are not prefixed
+func (c *Client) Subscribe(ctx context.Context, channels ...string) (redis.Subscription, error) {
+	return c.redisClient.Subscribe(ctx, channels...)
+}
+
+// Ping checks the cache server answers
+func (c *Client) Ping(ctx context.Context) error {
+	return c.redisClient.Ping(ctx)
+}
+
+// LLen returns the length of the list stored at key
+func (c *Client) LLen(ctx context.Context, key string) (int64, error) {
+	key = c.addPrefix(key)
+
+	return c.redisClient.LLen(ctx, key)
+}
+
+// SMembers returns the members of the set stored at key
+func (c *Client) SMembers(ctx context.Context, key string) ([]string, error) {
+	key = c.addPrefix(key)
+
+	return c.redisClient.SMembers(ctx, key)
+}
+
+// SAdd adds members to the set stored at key, and sets its ttl when it is not 0
+func (c *Client) SAdd(ctx context.Context, key string, ttl time.Duration, members ...string) error {
+	key = c.addPrefix(key)
+
+	return c.redisClient.SAdd(ctx, key, ttl, members...)
+}
+
+// Scan calls fn with every key matching the glob pattern, on every node of a cluster.
+// The prefix is added to pattern and stripped from the keys given to fn.
+func (c *Client) Scan(ctx context.Context, pattern string, fn func(key string) error) error {
+	return c.redisClient.Scan(ctx, EscapeGlob(c.prefix)+pattern, func(key string) error {
+		return fn(strings.TrimPrefix(key, c.prefix))
+	})
 }
 
-func (c *Client) Subscribe(channels ...string) *redisgo.PubSub {
-	return c.redisClient.Subscribe(channels...)
+// EscapeGlob escapes the glob characters of s, so it matches itself in a SCAN pattern
+func EscapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Close closes the connections of the cache client
+func (c *Client) Close() error {
+	return c.redisClient.Close()
+}
+
+// PSubscribe subscribes to the channels matching patterns, channels are not prefixed
+func (c *Client) PSubscribe(ctx context.Context, patterns ...string) (redis.Subscription, error) {
+	return c.redisClient.PSubscribe(ctx, patterns...)
+}
+
+// PushCapped appends value to the list stored at key, keeping its last max entries when max is above 0
+func (c *Client) PushCapped(ctx context.Context, key string, value interface{}, max int64) error {
+	key = c.addPrefix(key)
+
+	return c.redisClient.PushCapped(ctx, key, value, max)
 }
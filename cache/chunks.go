@@ -0,0 +1,306 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// manifestMagic prefixes the value of a chunked entry, its body lives in the chunk keys
+const manifestMagic = "lzh1c\n"
+
+const (
+	// DefaultChunkSize is the chunk size when Chunking.ChunkSize is 0
+	DefaultChunkSize = 1 << 20
+	// DefaultChunkGrace is how long replaced chunks stay readable when Chunking.Grace is 0
+	DefaultChunkGrace = 30 * time.Second
+	// DefaultChunkIdle is how long the chunks of an entry without ttl are kept unread when Chunking.Idle is 0
+	DefaultChunkIdle = 24 * time.Hour
+	// chunkWriteBatch is how many chunks are sent per round trip
+	chunkWriteBatch = 8
+)
+
+var (
+	// ErrChunkMissing is returned when a chunk of an entry expired or was replaced,
+	// reading the key again returns the entry that replaced it
+	ErrChunkMissing = errors.New("cache: chunk of the entry is missing")
+	// ErrChunkCorrupt is returned when the chunks do not add up to the body the manifest describes
+	ErrChunkCorrupt = errors.New("cache: chunks do not match the manifest")
+)
+
+// Chunking stores large bodies as several keys, so no single value blocks the server
+// or goes over its size limit
+type Chunking struct {
+	// Threshold is the stored body size, after compression, above which a body is chunked. 0 disables chunking.
+	Threshold int
+	// ChunkSize default is DefaultChunkSize
+	ChunkSize int
+	// Grace keeps the chunks of a replaced entry readable for this long, so readers streaming it can finish.
+	// Default is DefaultChunkGrace.
+	Grace time.Duration
+	// Idle is how long the chunks of an entry stored without ttl are kept after they were last read.
+	// It bounds the chunks a concurrent write of the same key left unreferenced. Default is DefaultChunkIdle.
+	Idle time.Duration
+}
+
+// Enabled reports whether bodies above Threshold are chunked
+func (c Chunking) Enabled() bool {
+	return c.Threshold > 0
+}
+
+// Validate reports negative sizes
+func (c Chunking) Validate() error {
+	if c.Threshold < 0 || c.ChunkSize < 0 || c.Grace < 0 || c.Idle < 0 {
+		return errors.New("chunking sizes must not be negative")
+	}
+	return nil
+}
+
+func (c Chunking) chunkSize() int {
+	if c.ChunkSize <= 0 {
+		return DefaultChunkSize
+	}
+	return c.ChunkSize
+}
+
+func (c Chunking) grace() time.Duration {
+	if c.Grace <= 0 {
+		return DefaultChunkGrace
+	}
+	return c.Grace
+}
+
+func (c Chunking) idle() time.Duration {
+	if c.Idle <= 0 {
+		return DefaultChunkIdle
+	}
+	return c.Idle
+}
+
+// manifest is the value of a chunked entry
+type manifest struct {
+	Meta    envelopeMeta `json:"meta"`
+	Version string       `json:"version"`
+	Chunks  int          `json:"chunks"`
+	// Size is the body size and StoredSize the size of the chunks, they differ when the body is compressed
+	Size       int64  `json:"size"`
+	StoredSize int64  `json:"stored_size"`
+	Sum        string `json:"sha256"`
+	// IdleMS is set for an entry without ttl, each read keeps its chunks for this long
+	IdleMS int64 `json:"idle_ms,omitempty"`
+}
+
+// ChunkedEntry is an entry whose body is stored as chunks
+type ChunkedEntry struct {
+	// Envelope carries the metadata, its Body is nil
+	*Envelope
+	Version    string
+	Chunks     int
+	Size       int64
+	StoredSize int64
+
+	sum  string
+	idle time.Duration
+}
+
+// IsManifest reports whether a cached value is the manifest of a chunked entry
+func IsManifest(value string) bool {
+	return strings.HasPrefix(value, manifestMagic)
+}
+
+// ParseManifest parses the manifest of a chunked entry
+func ParseManifest(value string) (*ChunkedEntry, error) {
+	if !IsManifest(value) {
+		return nil, errors.New("cache: value is not a chunk manifest")
+	}
+	var m manifest
+	if err := json.Unmarshal([]byte(value[len(manifestMagic):]), &m); err != nil {
+		return nil, fmt.Errorf("error decode chunk manifest: %v", err)
+	}
+	return &ChunkedEntry{
+		Envelope:   m.Meta.envelope(),
+		Version:    m.Version,
+		Chunks:     m.Chunks,
+		Size:       m.Size,
+		StoredSize: m.StoredSize,
+		sum:        m.Sum,
+		idle:       time.Duration(m.IdleMS) * time.Millisecond,
+	}, nil
+}
+
+// ChunkKey returns the key of chunk i of version of the entry stored under key
+func ChunkKey(key, version string, i int) string {
+	return key + ":chunk:" + version + ":" + strconv.Itoa(i)
+}
+
+// Store writes e under key, with body as its stored body compressed by codec. A body above
+// chunking.Threshold is written as chunks under the keys of a new version first, then the manifest
+// replaces the entry, so a reader gets the previous entry or the whole new one.
+// The chunks of the replaced entry expire after chunking.Grace.
+// It returns the value written under key: the envelope, or the manifest of a chunked entry.
+func Store(ctx context.Context, c ContextCacher, key string, e *Envelope, codec Codec, body []byte, chunking Chunking, ttl time.Duration) (string, error) {
+	if !chunking.Enabled() {
+		value := e.encode(codec, body)
+		return value, c.Set(ctx, key, value, ttl)
+	}
+	// the previous entry is read first, its chunks are released once it is replaced
+	previous, _ := c.Get(ctx, key)
+
+	var value string
+	if len(body) <= chunking.Threshold {
+		value = e.encode(codec, body)
+		if err := c.Set(ctx, key, value, ttl); err != nil {
+			return "", err
+		}
+	} else {
+		var err error
+		if value, err = storeChunks(ctx, c, key, e, codec, body, chunking, ttl); err != nil {
+			return "", err
+		}
+	}
+	if IsManifest(previous) {
+		if old, err := ParseManifest(previous); err == nil {
+			old.Release(ctx, c, key, chunking.Grace)
+		}
+	}
+	return value, nil
+}
+
+func storeChunks(ctx context.Context, c ContextCacher, key string, e *Envelope, codec Codec, body []byte, chunking Chunking, ttl time.Duration) (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	size := chunking.chunkSize()
+	sum := sha256.Sum256(body)
+	m := manifest{
+		Meta:       e.meta(codec),
+		Version:    hex.EncodeToString(id),
+		Chunks:     (len(body) + size - 1) / size,
+		Size:       int64(len(e.Body)),
+		StoredSize: int64(len(body)),
+		Sum:        hex.EncodeToString(sum[:]),
+	}
+
+	// chunks outlive the manifest, so a reader that got the manifest just before it expired can finish.
+	// Without ttl they still expire when unread, a concurrent write of the key may never release them.
+	chunkTTL := ttl + chunking.grace()
+	if ttl <= 0 {
+		chunkTTL = chunking.idle()
+		m.IdleMS = chunkTTL.Milliseconds()
+	}
+	batch := make(map[string]interface{}, chunkWriteBatch)
+	for i := 0; i < m.Chunks; i++ {
+		end := (i + 1) * size
+		if end > len(body) {
+			end = len(body)
+		}
+		batch[ChunkKey(key, m.Version, i)] = body[i*size : end]
+		if len(batch) == chunkWriteBatch || i == m.Chunks-1 {
+			if err := c.MSet(ctx, batch, chunkTTL); err != nil {
+				return "", fmt.Errorf("error store chunk: %v", err)
+			}
+			batch = make(map[string]interface{}, chunkWriteBatch)
+		}
+	}
+
+	manifestJSON, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	value := manifestMagic + string(manifestJSON)
+	if err := c.Set(ctx, key, value, ttl); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// Release lets the chunks of the entry expire after grace, DefaultChunkGrace when it is 0,
+// so readers streaming them can finish. Errors are ignored, the chunks expire with the entry ttl anyway.
+func (entry *ChunkedEntry) Release(ctx context.Context, c ContextCacher, key string, grace time.Duration) {
+	grace = Chunking{Grace: grace}.grace()
+	for i := 0; i < entry.Chunks; i++ {
+		c.Expire(ctx, ChunkKey(key, entry.Version, i), grace)
+	}
+}
+
+// Open returns a reader streaming the body of the entry stored under key, decompressed.
+// The first chunk is read before Open returns, so an entry replaced in the meantime is reported
+// as ErrChunkMissing by Open. Later a missing chunk or a body not matching the manifest is
+// returned by Read, a partial body never ends with io.EOF.
+func (entry *ChunkedEntry) Open(ctx context.Context, c ContextCacher, key string) (io.ReadCloser, error) {
+	r := &chunkReader{ctx: ctx, c: c, key: key, entry: entry, hash: sha256.New()}
+	if entry.Chunks > 0 {
+		if err := r.next(); err != nil {
+			return nil, err
+		}
+	}
+	return decompressReader(entry.Codec, r)
+}
+
+// chunkReader reads the chunks of an entry in order, one at a time
+type chunkReader struct {
+	ctx   context.Context
+	c     ContextCacher
+	key   string
+	entry *ChunkedEntry
+
+	i    int
+	buf  []byte
+	read int64
+	hash hash.Hash
+	err  error
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.i == r.entry.Chunks {
+			r.err = r.verify()
+			continue
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next reads the next chunk
+func (r *chunkReader) next() error {
+	value, err := r.c.Get(r.ctx, ChunkKey(r.key, r.entry.Version, r.i))
+	if errors.Is(err, ErrNotFound) {
+		return ErrChunkMissing
+	}
+	if err != nil {
+		return err
+	}
+	if r.entry.idle > 0 {
+		// errors are ignored, the read itself succeeded
+		r.c.Expire(r.ctx, ChunkKey(r.key, r.entry.Version, r.i), r.entry.idle)
+	}
+	r.i++
+	r.buf = []byte(value)
+	r.read += int64(len(value))
+	r.hash.Write(r.buf)
+	return nil
+}
+
+// verify checks the chunks read against the manifest, it returns io.EOF when they match
+func (r *chunkReader) verify() error {
+	if r.read != r.entry.StoredSize || hex.EncodeToString(r.hash.Sum(nil)) != r.entry.sum {
+		return ErrChunkCorrupt
+	}
+	return io.EOF
+}
@@ -0,0 +1,93 @@
+package cache_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dendhi31/lazyhttp/cache"
+	"github.com/dendhi31/lazyhttp/memory"
+)
+
+// clock is a time that only moves when told to
+type clock struct{ now time.Time }
+
+func (c *clock) Now() time.Time { return c.now }
+
+func storeChunked(t *testing.T, c cache.ContextCacher, key string, body []byte, chunking cache.Chunking, ttl time.Duration) *cache.ChunkedEntry {
+	t.Helper()
+	e := cache.NewEnvelope(time.Unix(0, 0), http.StatusOK, nil, body)
+	value, err := cache.Store(context.Background(), c, key, e, cache.CodecNone, body, chunking, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := cache.ParseManifest(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+func TestStoreChunksWithoutTTLExpireWhenIdle(t *testing.T) {
+	ctx := context.Background()
+	clk := &clock{now: time.Unix(0, 0)}
+	c := memory.New(memory.Options{Now: clk.Now})
+	body := bytes.Repeat([]byte("x"), 100)
+	chunking := cache.Chunking{Threshold: 10, ChunkSize: 40, Idle: time.Hour}
+
+	entry := storeChunked(t, c, "k", body, chunking, 0)
+	if ttl, _ := c.TTL(ctx, "k"); ttl != 0 {
+		t.Errorf("manifest ttl %s, want none", ttl)
+	}
+	if ttl, _ := c.TTL(ctx, cache.ChunkKey("k", entry.Version, 0)); ttl != time.Hour {
+		t.Errorf("chunk ttl %s, want the idle time", ttl)
+	}
+
+	// a read keeps the chunks for another idle time
+	clk.now = clk.now.Add(50 * time.Minute)
+	r, err := entry.Open(ctx, c, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+	clk.now = clk.now.Add(50 * time.Minute)
+	if _, err := entry.Open(ctx, c, "k"); err != nil {
+		t.Errorf("open after a read refreshed the chunks: %v", err)
+	}
+
+	// a concurrent write replaced the manifest without releasing the chunks, they expire unread
+	lost := storeChunked(t, c, "k", body, chunking, 0)
+	c.Set(ctx, "k", "written by another instance", 0)
+	clk.now = clk.now.Add(time.Hour)
+	if _, err := lost.Open(ctx, c, "k"); err != cache.ErrChunkMissing {
+		t.Errorf("open of an unreferenced version: %v, want %v", err, cache.ErrChunkMissing)
+	}
+}
+
+func TestStoreChunksWithTTL(t *testing.T) {
+	ctx := context.Background()
+	clk := &clock{now: time.Unix(0, 0)}
+	c := memory.New(memory.Options{Now: clk.Now})
+	body := bytes.Repeat([]byte("y"), 100)
+	chunking := cache.Chunking{Threshold: 10, ChunkSize: 40, Grace: time.Second}
+
+	entry := storeChunked(t, c, "k", body, chunking, time.Minute)
+	if entry.Chunks != 3 {
+		t.Errorf("%d chunks, want 3", entry.Chunks)
+	}
+	ttl, _ := c.TTL(ctx, cache.ChunkKey("k", entry.Version, 2))
+	if ttl != time.Minute+time.Second {
+		t.Errorf("chunk ttl %s, want the entry ttl and the grace", ttl)
+	}
+
+	// a replaced version is released after the grace
+	storeChunked(t, c, "k", body, chunking, time.Minute)
+	if ttl, _ := c.TTL(ctx, cache.ChunkKey("k", entry.Version, 0)); ttl != time.Second {
+		t.Errorf("replaced chunk ttl %s, want the grace", ttl)
+	}
+}
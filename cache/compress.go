@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is a compression of the envelope bodies
+type Codec string
+
+const (
+	// CodecNone stores the bodies as they are
+	CodecNone Codec = ""
+	CodecGzip Codec = "gzip"
+	CodecZstd Codec = "zstd"
+	// CodecSnappy is the fastest and compresses the least
+	CodecSnappy Codec = "snappy"
+)
+
+// DefaultCompressMinSize is the body size compression starts at when Compression.MinSize is 0
+const DefaultCompressMinSize = 1024
+
+// Compression selects how envelope bodies are compressed
+type Compression struct {
+	Codec Codec
+	// MinSize is the smallest body compressed, default is DefaultCompressMinSize.
+	// Smaller bodies gain little and cost a decode on every read.
+	MinSize int
+}
+
+// zstd encoders and decoders are costly to build and safe for concurrent EncodeAll and DecodeAll
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// Validate reports an unknown codec
+func (c Compression) Validate() error {
+	switch c.Codec {
+	case CodecNone, CodecGzip, CodecZstd, CodecSnappy:
+		return nil
+	}
+	return fmt.Errorf("unknown compression codec %q", c.Codec)
+}
+
+func compress(codec Codec, body []byte) ([]byte, error) {
+	switch codec {
+	case CodecGzip:
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	case CodecZstd:
+		encoder, _, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(body, nil), nil
+	case CodecSnappy:
+		return snappy.Encode(nil, body), nil
+	}
+	return nil, fmt.Errorf("unknown compression codec %q", codec)
+}
+
+func decompress(codec Codec, body []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return body, nil
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case CodecZstd:
+		_, decoder, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return decoder.DecodeAll(body, nil)
+	case CodecSnappy:
+		return snappy.Decode(nil, body)
+	}
+	return nil, fmt.Errorf("unknown compression codec %q", codec)
+}
+
+// decompressReader decompresses r as it is read. Snappy bodies are stored in the block format,
+// which cannot be streamed, so they are read whole first.
+func decompressReader(codec Codec, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case CodecNone:
+		return io.NopCloser(r), nil
+	case CodecGzip:
+		return gzip.NewReader(r)
+	case CodecZstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case CodecSnappy:
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		body, err = snappy.Decode(nil, body)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return nil, fmt.Errorf("unknown compression codec %q", codec)
+}
@@ -0,0 +1,623 @@
+// Package disk is a cache.ContextCacher stored in a local bbolt file, for deployments without redis.
+// Writes are transactional and synced, so a crash loses at most the write in progress.
+// Pub/sub only reaches the subscribers of the same process.
+package disk
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dendhi31/lazyhttp/cache"
+	"github.com/dendhi31/lazyhttp/redis"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// ErrWrongType is returned when a key holds another kind of value than the operation expects
+	ErrWrongType = errors.New("disk: operation against a key holding the wrong kind of value")
+	// ErrTooLarge is returned when the values of a write do not fit in MaxSize, nothing is written then
+	ErrTooLarge = errors.New("disk: value is larger than the cache size limit")
+	// ErrClosed is returned by the operations of a closed cache
+	ErrClosed = errors.New("disk: cache is closed")
+)
+
+var (
+	bucketData   = []byte("data")
+	bucketExpiry = []byte("expiry")
+	bucketMeta   = []byte("meta")
+	metaSize     = []byte("size")
+	// bucketOrder indexes the keys by write sequence, bucketSeq holds the sequence of every key
+	bucketOrder = []byte("order")
+	bucketSeq   = []byte("seq")
+)
+
+// kinds of stored values
+const (
+	kindString byte = iota
+	kindList
+	kindSet
+)
+
+// headerSize is the kind byte and the expiry of a record
+const headerSize = 9
+
+// Options configures a Cache, zero values keep the defaults
+type Options struct {
+	// MaxSize caps the bytes of keys and values, 0 is unbounded. When it is reached the expired entries
+	// are evicted, then the least recently written ones, never the ones of the write in progress.
+	MaxSize int64
+	// CompactInterval is how often expired entries are removed, default is 1 minute.
+	// Expired entries are never returned in between.
+	CompactInterval time.Duration
+	// LockTimeout is how long Open waits for another process to release the file, default is 1 second
+	LockTimeout time.Duration
+}
+
+// Cache is a cache.ContextCacher backed by a bbolt file
+type Cache struct {
+	db      *bolt.DB
+	options Options
+	prefix  string
+	broker  *cache.Broker
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closed    bool
+	closedMu  sync.RWMutex
+}
+
+var (
+	_ cache.ContextCacher     = (*Cache)(nil)
+	_ cache.Pinger            = (*Cache)(nil)
+	_ cache.Lister            = (*Cache)(nil)
+	_ cache.Tagger            = (*Cache)(nil)
+	_ cache.Scanner           = (*Cache)(nil)
+	_ cache.PatternSubscriber = (*Cache)(nil)
+)
+
+// Open opens or creates the cache file at path and starts removing expired entries in the background
+func Open(path string, options Options) (*Cache, error) {
+	if options.CompactInterval <= 0 {
+		options.CompactInterval = time.Minute
+	}
+	if options.LockTimeout <= 0 {
+		options.LockTimeout = time.Second
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: options.LockTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("error open %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketData, bucketExpiry, bucketMeta, bucketOrder, bucketSeq} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error open %s: %v", path, err)
+	}
+
+	c := &Cache{
+		db:      db,
+		options: options,
+		broker:  cache.NewBroker(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go c.compactLoop()
+	return c, nil
+}
+
+// SetPrefix will append a prefix to the keys of this cache
+func (c *Cache) SetPrefix(prefix string) {
+	c.prefix = prefix
+}
+
+func (c *Cache) addPrefix(key string) []byte {
+	return []byte(c.prefix + key)
+}
+
+// Set stores value under key, a ttl of 0 does not expire
+func (c *Cache) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return c.update(ctx, func(tx *bolt.Tx) error {
+		return c.put(tx, c.addPrefix(key), kindString, expiryOf(ttl), []byte(cache.FormatValue(value)))
+	})
+}
+
+// Get returns the value of key, ErrNotFound when it does not exist
+func (c *Cache) Get(ctx context.Context, key string) (string, error) {
+	var value string
+	err := c.view(ctx, func(tx *bolt.Tx) error {
+		kind, _, payload := record(tx, c.addPrefix(key), time.Now())
+		if payload == nil {
+			return cache.ErrNotFound
+		}
+		if kind != kindString {
+			return ErrWrongType
+		}
+		value = string(payload)
+		return nil
+	})
+	return value, err
+}
+
+// MGet returns the values of the keys that exist, from a single transaction
+func (c *Cache) MGet(ctx context.Context, keys ...string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	err := c.view(ctx, func(tx *bolt.Tx) error {
+		now := time.Now()
+		for _, key := range keys {
+			if kind, _, payload := record(tx, c.addPrefix(key), now); payload != nil && kind == kindString {
+				values[key] = string(payload)
+			}
+		}
+		return nil
+	})
+	return values, err
+}
+
+// MSet stores every key-value pair of values with the same ttl, in a single transaction
+func (c *Cache) MSet(ctx context.Context, values map[string]interface{}, ttl time.Duration) error {
+	return c.update(ctx, func(tx *bolt.Tx) error {
+		expiry := expiryOf(ttl)
+		for key, value := range values {
+			if err := c.put(tx, c.addPrefix(key), kindString, expiry, []byte(cache.FormatValue(value))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Remove deletes key, a missing key is not an error
+func (c *Cache) Remove(ctx context.Context, key string) error {
+	return c.update(ctx, func(tx *bolt.Tx) error {
+		return remove(tx, c.addPrefix(key))
+	})
+}
+
+// Exists reports whether key exists
+func (c *Cache) Exists(ctx context.Context, key string) (bool, error) {
+	var exists bool
+	err := c.view(ctx, func(tx *bolt.Tx) error {
+		_, _, payload := record(tx, c.addPrefix(key), time.Now())
+		exists = payload != nil
+		return nil
+	})
+	return exists, err
+}
+
+// TTL returns the remaining time to live of key, 0 when it does not expire
+func (c *Cache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	var ttl time.Duration
+	err := c.view(ctx, func(tx *bolt.Tx) error {
+		now := time.Now()
+		_, expiry, payload := record(tx, c.addPrefix(key), now)
+		if payload == nil {
+			return cache.ErrNotFound
+		}
+		if expiry != 0 {
+			ttl = time.Unix(0, expiry).Sub(now)
+		}
+		return nil
+	})
+	return ttl, err
+}
+
+// Expire sets the time to live of key, ErrNotFound when it does not exist.
+// A ttl of 0 or less removes the key, like redis does.
+func (c *Cache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return c.update(ctx, func(tx *bolt.Tx) error {
+		k := c.addPrefix(key)
+		kind, _, payload := record(tx, k, time.Now())
+		if payload == nil {
+			return cache.ErrNotFound
+		}
+		if ttl <= 0 {
+			return remove(tx, k)
+		}
+		return c.put(tx, k, kind, expiryOf(ttl), payload)
+	})
+}
+
+// Publish sends value to the subscribers of channel in this process
+func (c *Cache) Publish(ctx context.Context, channel string, value interface{}) error {
+	if err := c.check(ctx); err != nil {
+		return err
+	}
+	c.broker.Publish(channel, value)
+	return nil
+}
+
+// Subscribe subscribes to channels, channels are not prefixed
+func (c *Cache) Subscribe(ctx context.Context, channels ...string) (redis.Subscription, error) {
+	if err := c.check(ctx); err != nil {
+		return nil, err
+	}
+	return c.broker.Subscribe(channels...), nil
+}
+
+// PSubscribe subscribes to the channels matching patterns, channels are not prefixed
+func (c *Cache) PSubscribe(ctx context.Context, patterns ...string) (redis.Subscription, error) {
+	if err := c.check(ctx); err != nil {
+		return nil, err
+	}
+	return c.broker.PSubscribe(patterns...), nil
+}
+
+// Ping reports whether the cache is open
+func (c *Cache) Ping(ctx context.Context) error {
+	return c.check(ctx)
+}
+
+// LLen returns the length of the list stored at key
+func (c *Cache) LLen(ctx context.Context, key string) (int64, error) {
+	var n int64
+	err := c.view(ctx, func(tx *bolt.Tx) error {
+		list, err := readList(tx, c.addPrefix(key), kindList)
+		n = int64(len(list))
+		return err
+	})
+	return n, err
+}
+
+// PushCapped appends value to the list stored at key, keeping its last max entries when max is above 0
+func (c *Cache) PushCapped(ctx context.Context, key string, value interface{}, max int64) error {
+	return c.update(ctx, func(tx *bolt.Tx) error {
+		k := c.addPrefix(key)
+		list, err := readList(tx, k, kindList)
+		if err != nil {
+			return err
+		}
+		list = append(list, cache.FormatValue(value))
+		if max > 0 && int64(len(list)) > max {
+			list = list[int64(len(list))-max:]
+		}
+		_, expiry, _ := record(tx, k, time.Now())
+		return c.putList(tx, k, kindList, expiry, list)
+	})
+}
+
+// SMembers returns the members of the set stored at key
+func (c *Cache) SMembers(ctx context.Context, key string) ([]string, error) {
+	var members []string
+	err := c.view(ctx, func(tx *bolt.Tx) (err error) {
+		members, err = readList(tx, c.addPrefix(key), kindSet)
+		return err
+	})
+	return members, err
+}
+
+// SAdd adds members to the set stored at key, and sets its ttl when it is not 0
+func (c *Cache) SAdd(ctx context.Context, key string, ttl time.Duration, members ...string) error {
+	return c.update(ctx, func(tx *bolt.Tx) error {
+		k := c.addPrefix(key)
+		set, err := readList(tx, k, kindSet)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			if i := sort.SearchStrings(set, member); i == len(set) || set[i] != member {
+				set = append(set, "")
+				copy(set[i+1:], set[i:])
+				set[i] = member
+			}
+		}
+		expiry := expiryOf(ttl)
+		if ttl <= 0 {
+			_, expiry, _ = record(tx, k, time.Now())
+		}
+		return c.putList(tx, k, kindSet, expiry, set)
+	})
+}
+
+// Scan calls fn with every key matching the glob pattern.
+// The prefix is added to pattern and stripped from the keys given to fn.
+func (c *Cache) Scan(ctx context.Context, pattern string, fn func(key string) error) error {
+	pattern = cache.EscapeGlob(c.prefix) + pattern
+	var keys []string
+	err := c.view(ctx, func(tx *bolt.Tx) error {
+		now := time.Now().UnixNano()
+		cursor := tx.Bucket(bucketData).Cursor()
+		for k, v := cursor.Seek([]byte(c.prefix)); k != nil && strings.HasPrefix(string(k), c.prefix); k, v = cursor.Next() {
+			if expiry := int64(binary.BigEndian.Uint64(v[1:headerSize])); expiry != 0 && expiry <= now {
+				continue
+			}
+			if cache.MatchGlob(pattern, string(k)) {
+				keys = append(keys, strings.TrimPrefix(string(k), c.prefix))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// fn runs outside the transaction, so it may write
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Size returns the bytes of keys and values stored, the file itself does not shrink
+func (c *Cache) Size() (int64, error) {
+	var size int64
+	err := c.view(context.Background(), func(tx *bolt.Tx) error {
+		size = readSize(tx)
+		return nil
+	})
+	return size, err
+}
+
+// Close stops the background compaction, closes the subscriptions and the file. It can be called more than once.
+func (c *Cache) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		<-c.done
+		c.closedMu.Lock()
+		c.closed = true
+		c.closedMu.Unlock()
+		c.broker.Close()
+		err = c.db.Close()
+	})
+	return err
+}
+
+// Compact removes the expired entries now
+func (c *Cache) Compact() (int, error) {
+	var removed int
+	for {
+		var n int
+		err := c.update(context.Background(), func(tx *bolt.Tx) error {
+			n = 0
+			now := time.Now().UnixNano()
+			cursor := tx.Bucket(bucketExpiry).Cursor()
+			// a transaction is capped, so the file stays available to the readers in between
+			for k, _ := cursor.First(); k != nil && n < 1000; k, _ = cursor.First() {
+				if int64(binary.BigEndian.Uint64(k[:8])) > now {
+					break
+				}
+				if err := remove(tx, k[8:]); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		})
+		removed += n
+		if err != nil || n < 1000 {
+			return removed, err
+		}
+	}
+}
+
+func (c *Cache) compactLoop() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.options.CompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.Compact()
+		}
+	}
+}
+
+func (c *Cache) check(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.closedMu.RLock()
+	defer c.closedMu.RUnlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+func (c *Cache) view(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := c.check(ctx); err != nil {
+		return err
+	}
+	return c.db.View(fn)
+}
+
+// update runs fn in a write transaction, then evicts the entries written before it while MaxSize is exceeded
+func (c *Cache) update(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := c.check(ctx); err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		// the entries written by fn have a later sequence
+		written := tx.Bucket(bucketOrder).Sequence()
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if c.options.MaxSize > 0 && readSize(tx) > c.options.MaxSize {
+			return evict(tx, c.options.MaxSize, written)
+		}
+		return nil
+	})
+}
+
+// put writes a record and indexes its expiry and write order
+func (c *Cache) put(tx *bolt.Tx, key []byte, kind byte, expiry int64, payload []byte) error {
+	value := make([]byte, headerSize+len(payload))
+	value[0] = kind
+	binary.BigEndian.PutUint64(value[1:headerSize], uint64(expiry))
+	copy(value[headerSize:], payload)
+	if c.options.MaxSize > 0 && int64(len(key)+len(value)) > c.options.MaxSize {
+		return ErrTooLarge
+	}
+
+	if err := remove(tx, key); err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketData).Put(key, value); err != nil {
+		return err
+	}
+	if err := index(tx, key); err != nil {
+		return err
+	}
+	if expiry != 0 {
+		if err := tx.Bucket(bucketExpiry).Put(expiryKey(expiry, key), nil); err != nil {
+			return err
+		}
+	}
+	return writeSize(tx, readSize(tx)+int64(len(key)+len(value)))
+}
+
+func (c *Cache) putList(tx *bolt.Tx, key []byte, kind byte, expiry int64, list []string) error {
+	payload, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return c.put(tx, key, kind, expiry, payload)
+}
+
+// evict removes the expired entries, then the least recently written ones, until the size is back under max.
+// Entries written after the written sequence are kept, ErrTooLarge is returned when they do not fit.
+func evict(tx *bolt.Tx, max int64, written uint64) error {
+	now := time.Now().UnixNano()
+	expiries := tx.Bucket(bucketExpiry).Cursor()
+	for k, _ := expiries.First(); k != nil && readSize(tx) > max; k, _ = expiries.First() {
+		if int64(binary.BigEndian.Uint64(k[:8])) > now {
+			break
+		}
+		if err := remove(tx, k[8:]); err != nil {
+			return err
+		}
+	}
+	order := tx.Bucket(bucketOrder).Cursor()
+	for k, _ := order.First(); k != nil && readSize(tx) > max; k, _ = order.First() {
+		if binary.BigEndian.Uint64(k[:8]) > written {
+			return ErrTooLarge
+		}
+		if err := remove(tx, k[8:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// index appends key to the write order, a key written again moves to the end
+func index(tx *bolt.Tx, key []byte) error {
+	order := tx.Bucket(bucketOrder)
+	seq, err := order.NextSequence()
+	if err != nil {
+		return err
+	}
+	k := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(k, seq)
+	copy(k[8:], key)
+	if err := order.Put(k, nil); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketSeq).Put(key, k[:8])
+}
+
+// remove deletes key, its expiry and order index entries and its size
+func remove(tx *bolt.Tx, key []byte) error {
+	data := tx.Bucket(bucketData)
+	value := data.Get(key)
+	if value == nil {
+		return nil
+	}
+	if expiry := int64(binary.BigEndian.Uint64(value[1:headerSize])); expiry != 0 {
+		if err := tx.Bucket(bucketExpiry).Delete(expiryKey(expiry, key)); err != nil {
+			return err
+		}
+	}
+	seqs := tx.Bucket(bucketSeq)
+	if seq := seqs.Get(key); seq != nil {
+		k := make([]byte, 0, len(seq)+len(key))
+		k = append(append(k, seq...), key...)
+		if err := tx.Bucket(bucketOrder).Delete(k); err != nil {
+			return err
+		}
+		if err := seqs.Delete(key); err != nil {
+			return err
+		}
+	}
+	size := readSize(tx) - int64(len(key)+len(value))
+	if err := data.Delete(key); err != nil {
+		return err
+	}
+	return writeSize(tx, size)
+}
+
+// record returns the kind, expiry and payload of key, the payload is nil when it is missing or expired.
+// The payload is only valid during tx.
+func record(tx *bolt.Tx, key []byte, now time.Time) (byte, int64, []byte) {
+	value := tx.Bucket(bucketData).Get(key)
+	if value == nil {
+		return 0, 0, nil
+	}
+	expiry := int64(binary.BigEndian.Uint64(value[1:headerSize]))
+	if expiry != 0 && expiry <= now.UnixNano() {
+		return 0, 0, nil
+	}
+	return value[0], expiry, value[headerSize:]
+}
+
+// readList decodes the list or set stored at key, empty when it is missing
+func readList(tx *bolt.Tx, key []byte, kind byte) ([]string, error) {
+	k, _, payload := record(tx, key, time.Now())
+	if payload == nil {
+		return nil, nil
+	}
+	if k != kind {
+		return nil, ErrWrongType
+	}
+	var list []string
+	err := json.Unmarshal(payload, &list)
+	return list, err
+}
+
+func readSize(tx *bolt.Tx) int64 {
+	if v := tx.Bucket(bucketMeta).Get(metaSize); len(v) == 8 {
+		return int64(binary.BigEndian.Uint64(v))
+	}
+	return 0
+}
+
+func writeSize(tx *bolt.Tx, size int64) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(size))
+	return tx.Bucket(bucketMeta).Put(metaSize, v)
+}
+
+// expiryKey sorts the expiry index by time, then key
+func expiryKey(expiry int64, key []byte) []byte {
+	k := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(k, uint64(expiry))
+	copy(k[8:], key)
+	return k
+}
+
+// expiryOf returns the expiry of a ttl in unix nanoseconds, 0 when it does not expire
+func expiryOf(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
@@ -0,0 +1,140 @@
+package disk_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dendhi31/lazyhttp/cache"
+	"github.com/dendhi31/lazyhttp/cache/disk"
+)
+
+func open(t *testing.T, options disk.Options) *disk.Cache {
+	t.Helper()
+	c, err := disk.Open(filepath.Join(t.TempDir(), "cache.db"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func assertKeys(t *testing.T, c *disk.Cache, exist map[string]bool) {
+	t.Helper()
+	for key, want := range exist {
+		if ok, err := c.Exists(context.Background(), key); err != nil || ok != want {
+			t.Errorf("Exists(%s) = %t, %v, want %t", key, ok, err, want)
+		}
+	}
+}
+
+// a one-byte key and a ten-byte value take 20 bytes with the record header
+const value = "0123456789"
+
+func TestMaxSizeEvictsLeastRecentlyWritten(t *testing.T) {
+	ctx := context.Background()
+	c := open(t, disk.Options{MaxSize: 50})
+
+	for _, key := range []string{"a", "b"} {
+		if err := c.Set(ctx, key, value, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a written again is now the most recent
+	if err := c.Set(ctx, "a", value, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(ctx, "c", value, 0); err != nil {
+		t.Fatal(err)
+	}
+	assertKeys(t, c, map[string]bool{"a": true, "b": false, "c": true})
+	if size, _ := c.Size(); size != 40 {
+		t.Errorf("size %d, want 40", size)
+	}
+}
+
+func TestMaxSizeEvictsExpiredFirst(t *testing.T) {
+	ctx := context.Background()
+	c := open(t, disk.Options{MaxSize: 50, CompactInterval: time.Hour})
+
+	if err := c.Set(ctx, "a", value, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(ctx, "b", value, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := c.Set(ctx, "c", value, 0); err != nil {
+		t.Fatal(err)
+	}
+	assertKeys(t, c, map[string]bool{"a": true, "b": false, "c": true})
+}
+
+func TestMaxSizeTooLarge(t *testing.T) {
+	ctx := context.Background()
+	c := open(t, disk.Options{MaxSize: 50})
+
+	if err := c.Set(ctx, "a", value, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(ctx, "big", strings.Repeat("x", 50), 0); err != disk.ErrTooLarge {
+		t.Errorf("Set of a value over MaxSize: %v, want %v", err, disk.ErrTooLarge)
+	}
+	// every value fits but not all of them, the write in progress is not evicted
+	err := c.MSet(ctx, map[string]interface{}{"b": value, "c": value, "d": value}, 0)
+	if err != disk.ErrTooLarge {
+		t.Errorf("MSet over MaxSize: %v, want %v", err, disk.ErrTooLarge)
+	}
+	assertKeys(t, c, map[string]bool{"a": true, "big": false, "b": false, "c": false, "d": false})
+	if size, _ := c.Size(); size != 20 {
+		t.Errorf("size %d, want the 20 bytes of a", size)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	ctx := context.Background()
+	c := open(t, disk.Options{CompactInterval: time.Hour})
+
+	if err := c.Set(ctx, "a", value, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := c.TTL(ctx, "a"); err != nil || ttl <= 0 || ttl > 10*time.Millisecond {
+		t.Errorf("TTL = %s, %v", ttl, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := c.Get(ctx, "a"); err != cache.ErrNotFound {
+		t.Errorf("Get of an expired key: %v, want %v", err, cache.ErrNotFound)
+	}
+	if err := c.Expire(ctx, "a", time.Minute); err != cache.ErrNotFound {
+		t.Errorf("Expire of an expired key: %v, want %v", err, cache.ErrNotFound)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	c := open(t, disk.Options{CompactInterval: time.Hour})
+
+	if err := c.Set(ctx, "a", value, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(ctx, "b", value, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(ctx, "c", value, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	// the expired entry takes space until it is compacted
+	if size, _ := c.Size(); size != 60 {
+		t.Errorf("size %d before Compact, want 60", size)
+	}
+	if n, err := c.Compact(); err != nil || n != 1 {
+		t.Errorf("Compact = %d, %v, want 1 removed", n, err)
+	}
+	if size, _ := c.Size(); size != 40 {
+		t.Errorf("size %d after Compact, want 40", size)
+	}
+	assertKeys(t, c, map[string]bool{"a": true, "b": false, "c": true})
+}
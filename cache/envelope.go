@@ -0,0 +1,172 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// envelopeMagic prefixes every value written by lazyhttp,
+// values without it are raw bodies stored by older versions
+const envelopeMagic = "lzh1\n"
+
+// Envelope wraps a cached response body with the metadata needed to serve it back
+type Envelope struct {
+	StoredAt   time.Time
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Codec is the compression the body was stored with, Body is always decompressed
+	Codec Codec
+}
+
+type envelopeMeta struct {
+	StoredAt   int64       `json:"stored_at,omitempty"`
+	StatusCode int         `json:"status,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	Codec      Codec       `json:"codec,omitempty"`
+}
+
+// unstoredHeaders are never kept in the cache, they are either bound to the
+// connection or to a single user
+var unstoredHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Set-Cookie",
+}
+
+// NewEnvelope creates an envelope for a response received at storedAt
+func NewEnvelope(storedAt time.Time, statusCode int, header http.Header, body []byte) *Envelope {
+	if header != nil {
+		header = header.Clone()
+		for _, h := range unstoredHeaders {
+			header.Del(h)
+		}
+	}
+	return &Envelope{
+		StoredAt:   storedAt,
+		StatusCode: statusCode,
+		Header:     header,
+		Body:       body,
+	}
+}
+
+// Encode serializes the envelope to the value stored in the cache, the body is not compressed
+func (e *Envelope) Encode() string {
+	return e.encode(CodecNone, e.Body)
+}
+
+// EncodeCompressed is Encode with the body compressed by c, when it is at least c.MinSize bytes
+// and compression makes it smaller. It returns the size of the stored body as well.
+func (e *Envelope) EncodeCompressed(c Compression) (string, int, error) {
+	codec, body, err := e.Compress(c)
+	if err != nil {
+		return "", 0, err
+	}
+	return e.encode(codec, body), len(body), nil
+}
+
+// Compress returns the body to store and its codec, the body itself when it is below c.MinSize
+// or compression does not make it smaller
+func (e *Envelope) Compress(c Compression) (Codec, []byte, error) {
+	minSize := c.MinSize
+	if minSize <= 0 {
+		minSize = DefaultCompressMinSize
+	}
+	if c.Codec == CodecNone || len(e.Body) < minSize {
+		return CodecNone, e.Body, nil
+	}
+	body, err := compress(c.Codec, e.Body)
+	if err != nil {
+		return CodecNone, nil, err
+	}
+	if len(body) >= len(e.Body) {
+		return CodecNone, e.Body, nil
+	}
+	return c.Codec, body, nil
+}
+
+func (e *Envelope) encode(codec Codec, body []byte) string {
+	meta := e.meta(codec)
+	// json.Marshal escapes newlines, so the first one after the meta ends it
+	metaJSON, _ := json.Marshal(meta)
+
+	var b strings.Builder
+	b.Grow(len(envelopeMagic) + len(metaJSON) + 1 + len(body))
+	b.WriteString(envelopeMagic)
+	b.Write(metaJSON)
+	b.WriteByte('\n')
+	b.Write(body)
+	return b.String()
+}
+
+func (e *Envelope) meta(codec Codec) envelopeMeta {
+	meta := envelopeMeta{
+		StatusCode: e.StatusCode,
+		Header:     e.Header,
+		Codec:      codec,
+	}
+	if !e.StoredAt.IsZero() {
+		meta.StoredAt = e.StoredAt.UnixNano() / int64(time.Millisecond)
+	}
+	return meta
+}
+
+// envelope returns the envelope meta describes, without its body
+func (meta envelopeMeta) envelope() *Envelope {
+	e := &Envelope{
+		StatusCode: meta.StatusCode,
+		Header:     meta.Header,
+		Codec:      meta.Codec,
+	}
+	if meta.StoredAt > 0 {
+		e.StoredAt = time.Unix(0, meta.StoredAt*int64(time.Millisecond))
+	}
+	return e
+}
+
+// DecodeEnvelope parses a cached value, values written before envelopes
+// existed are returned as a body with an unknown StoredAt.
+// A body that cannot be decompressed is left nil, ParseEnvelope returns the error.
+func DecodeEnvelope(value string) *Envelope {
+	e, _ := ParseEnvelope(value)
+	return e
+}
+
+// ParseEnvelope is DecodeEnvelope returning an error when the body cannot be decompressed,
+// the envelope still carries the metadata then
+func ParseEnvelope(value string) (*Envelope, error) {
+	if !strings.HasPrefix(value, envelopeMagic) {
+		return &Envelope{Body: []byte(value)}, nil
+	}
+	rest := value[len(envelopeMagic):]
+	end := strings.IndexByte(rest, '\n')
+	if end < 0 {
+		return &Envelope{Body: []byte(value)}, nil
+	}
+
+	var meta envelopeMeta
+	if err := json.Unmarshal([]byte(rest[:end]), &meta); err != nil {
+		return &Envelope{Body: []byte(value)}, nil
+	}
+	e := meta.envelope()
+	body, err := decompress(meta.Codec, []byte(rest[end+1:]))
+	if err != nil {
+		return e, fmt.Errorf("error decompress %s body: %v", meta.Codec, err)
+	}
+	e.Body = body
+	return e, nil
+}
+
+// Age returns how old the envelope is at now, or -1 when it is unknown
+func (e *Envelope) Age(now time.Time) time.Duration {
+	if e.StoredAt.IsZero() {
+		return -1
+	}
+	age := now.Sub(e.StoredAt)
+	if age < 0 {
+		age = 0
+	}
+	return age
+}
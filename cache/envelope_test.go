@@ -0,0 +1,92 @@
+package cache_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dendhi31/lazyhttp/cache"
+)
+
+func TestEnvelopeCompressionRoundTrip(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"id":42,"name":"lazyhttp"},`), 200)
+	storedAt := time.UnixMilli(1700000000000)
+	header := http.Header{"Content-Type": {"application/json"}}
+
+	for _, codec := range []cache.Codec{cache.CodecNone, cache.CodecGzip, cache.CodecZstd, cache.CodecSnappy} {
+		e := cache.NewEnvelope(storedAt, http.StatusOK, header, body)
+		value, stored, err := e.EncodeCompressed(cache.Compression{Codec: codec})
+		if err != nil {
+			t.Fatalf("%q: %v", codec, err)
+		}
+		if codec != cache.CodecNone && stored >= len(body) {
+			t.Errorf("%q stored %d bytes of %d", codec, stored, len(body))
+		}
+
+		got, err := cache.ParseEnvelope(value)
+		if err != nil {
+			t.Fatalf("%q: %v", codec, err)
+		}
+		if got.Codec != codec || !bytes.Equal(got.Body, body) {
+			t.Errorf("%q read back as %q with %d bytes", codec, got.Codec, len(got.Body))
+		}
+		if !got.StoredAt.Equal(storedAt) || got.StatusCode != http.StatusOK || got.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%q metadata %v %d %v", codec, got.StoredAt, got.StatusCode, got.Header)
+		}
+	}
+}
+
+func TestEnvelopeCompressionSkipped(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.Read(random)
+	for name, body := range map[string][]byte{
+		"small":          bytes.Repeat([]byte("a"), cache.DefaultCompressMinSize-1),
+		"incompressible": random,
+	} {
+		e := cache.NewEnvelope(time.Time{}, http.StatusOK, nil, body)
+		value, stored, err := e.EncodeCompressed(cache.Compression{Codec: cache.CodecGzip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := cache.ParseEnvelope(value)
+		if got.Codec != cache.CodecNone || stored != len(body) || !bytes.Equal(got.Body, body) {
+			t.Errorf("%s body stored with %q, %d of %d bytes", name, got.Codec, stored, len(body))
+		}
+	}
+}
+
+func TestParseEnvelopeWrittenBeforeCompression(t *testing.T) {
+	for name, tt := range map[string]struct {
+		value  string
+		body   string
+		status int
+	}{
+		// an envelope without a codec in its meta
+		"envelope": {"lzh1\n{\"stored_at\":1700000000000,\"status\":200}\nbody", "body", http.StatusOK},
+		// a raw body stored before envelopes
+		"raw": {`{"id":42}`, `{"id":42}`, 0},
+		// a raw body that happens to start like an envelope
+		"magic only": {"lzh1\nno meta", "lzh1\nno meta", 0},
+		"bad meta":   {"lzh1\nnot json\nbody", "lzh1\nnot json\nbody", 0},
+	} {
+		e, err := cache.ParseEnvelope(tt.value)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if e.Codec != cache.CodecNone || string(e.Body) != tt.body || e.StatusCode != tt.status {
+			t.Errorf("%s read as %q %d %q", name, e.Codec, e.StatusCode, e.Body)
+		}
+	}
+}
+
+func TestParseEnvelopeCorruptBody(t *testing.T) {
+	e, err := cache.ParseEnvelope("lzh1\n{\"status\":200,\"codec\":\"zstd\"}\nnot zstd")
+	if err == nil {
+		t.Fatal("a body that does not decompress was read")
+	}
+	if e.StatusCode != http.StatusOK || e.Body != nil {
+		t.Errorf("envelope %d with %d bytes, want the metadata and no body", e.StatusCode, len(e.Body))
+	}
+}
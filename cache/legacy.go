@@ -0,0 +1,462 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dendhi31/lazyhttp/redis"
+	redisv6 "github.com/go-redis/redis"
+)
+
+// Cacher is a Cache handler that will handle all redis action related, without contexts:
+// its operations can block as long as the server. Get returns an empty string for a missing key.
+// Use ContextCacher for new code.
+type Cacher interface {
+	SetPrefix(prefix string)
+	Set(key string, value interface{}, ttl time.Duration) error
+	Get(key string) (string, error)
+	Remove(key string) error
+	Publish(channel string, value interface{}) error
+	Subscribe(channels ...string) *redisv6.PubSub
+}
+
+// The optional operations of a Cacher, Upgrade passes them through when it has them
+type (
+	legacyPinger interface {
+		Ping() error
+	}
+	legacyLister interface {
+		LLen(key string) (int64, error)
+		PushCapped(key string, value interface{}, max int64) error
+	}
+	legacyTagger interface {
+		SMembers(key string) ([]string, error)
+		SAdd(key string, ttl time.Duration, members ...string) error
+	}
+	legacyScanner interface {
+		Scan(pattern string, fn func(key string) error) error
+	}
+	legacyPatternSubscriber interface {
+		PSubscribe(patterns ...string) *redisv6.PubSub
+	}
+)
+
+// Legacy adapts a ContextCacher to Cacher, operations run with a background context.
+// Subscribe dials a go-redis v6 connection to the servers of a Client created by NewClient, on the
+// standalone, cluster and sentinel topologies, a second connection beside the go-redis v9 one of c.
+// Ring shards are picked differently by go-redis v6, so rings are not supported: on a ring, a wrapped
+// client or any other cache, the returned PubSub fails with ErrUnsupported.
+// The optional operations of c are kept, Close closes c and the subscription connection.
+//
+// Deprecated: Legacy only exists for code still expecting a Cacher and goes with go-redis v6
+// in the next major version, use the ContextCacher directly.
+func Legacy(c ContextCacher) Cacher {
+	if u, ok := c.(upgraded); ok {
+		return u.Cacher
+	}
+	return &legacy{c: c}
+}
+
+type legacy struct {
+	c ContextCacher
+
+	subscriberOnce sync.Once
+	subscriber     interface {
+		Subscribe(channels ...string) *redisv6.PubSub
+		Close() error
+	}
+}
+
+func (l *legacy) SetPrefix(prefix string) { l.c.SetPrefix(prefix) }
+
+func (l *legacy) Set(key string, value interface{}, ttl time.Duration) error {
+	return l.c.Set(context.Background(), key, value, ttl)
+}
+
+func (l *legacy) Get(key string) (string, error) {
+	value, err := l.c.Get(context.Background(), key)
+	if errors.Is(err, ErrNotFound) {
+		return "", nil
+	}
+	return value, err
+}
+
+func (l *legacy) Remove(key string) error { return l.c.Remove(context.Background(), key) }
+
+func (l *legacy) Publish(channel string, value interface{}) error {
+	return l.c.Publish(context.Background(), channel, value)
+}
+
+func (l *legacy) Subscribe(channels ...string) *redisv6.PubSub {
+	l.subscriberOnce.Do(func() {
+		l.subscriber = newSubscriber(l.c)
+	})
+	return l.subscriber.Subscribe(channels...)
+}
+
+func (l *legacy) Ping() error {
+	if p, ok := l.c.(Pinger); ok {
+		return p.Ping(context.Background())
+	}
+	return ErrUnsupported
+}
+
+func (l *legacy) LLen(key string) (int64, error) {
+	if lister, ok := l.c.(Lister); ok {
+		return lister.LLen(context.Background(), key)
+	}
+	return 0, ErrUnsupported
+}
+
+func (l *legacy) PushCapped(key string, value interface{}, max int64) error {
+	if lister, ok := l.c.(Lister); ok {
+		return lister.PushCapped(context.Background(), key, value, max)
+	}
+	return ErrUnsupported
+}
+
+func (l *legacy) SMembers(key string) ([]string, error) {
+	if t, ok := l.c.(Tagger); ok {
+		return t.SMembers(context.Background(), key)
+	}
+	return nil, ErrUnsupported
+}
+
+func (l *legacy) SAdd(key string, ttl time.Duration, members ...string) error {
+	if t, ok := l.c.(Tagger); ok {
+		return t.SAdd(context.Background(), key, ttl, members...)
+	}
+	return ErrUnsupported
+}
+
+func (l *legacy) Scan(pattern string, fn func(key string) error) error {
+	if s, ok := l.c.(Scanner); ok {
+		return s.Scan(context.Background(), pattern, fn)
+	}
+	return ErrUnsupported
+}
+
+// Close closes the subscription connection and c
+func (l *legacy) Close() error {
+	// a later Subscribe gets a closed client
+	l.subscriberOnce.Do(func() {
+		l.subscriber = unsupportedSubscriber()
+	})
+	err := l.subscriber.Close()
+	if c, ok := l.c.(io.Closer); ok {
+		if cerr := c.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// newSubscriber returns the go-redis v6 client subscriptions of c are made on
+func newSubscriber(c ContextCacher) interface {
+	Subscribe(channels ...string) *redisv6.PubSub
+	Close() error
+} {
+	client, ok := c.(*Client)
+	if !ok || client.options == nil || len(client.options.Addrs) == 0 {
+		return unsupportedSubscriber()
+	}
+	o := client.options
+	// go-redis v6 has no ACL user, the AUTH is sent once connected
+	password := o.Password
+	var onConnect func(cn *redisv6.Conn) error
+	if o.Username != "" {
+		password = ""
+		onConnect = func(cn *redisv6.Conn) error {
+			return cn.Do("auth", o.Username, o.Password).Err()
+		}
+	}
+	switch o.ResolvedTopology() {
+	case redis.TopologyStandalone:
+		return redisv6.NewClient(&redisv6.Options{
+			Addr:         o.Addrs[0],
+			DB:           o.DB,
+			Password:     password,
+			OnConnect:    onConnect,
+			TLSConfig:    o.TLSConfig,
+			DialTimeout:  o.DialTimeout,
+			ReadTimeout:  o.ReadTimeout,
+			WriteTimeout: o.WriteTimeout,
+			PoolSize:     o.PoolSize,
+			MinIdleConns: o.MinIdleConns,
+			MaxRetries:   o.MaxRetries,
+		})
+	case redis.TopologyCluster:
+		return redisv6.NewClusterClient(&redisv6.ClusterOptions{
+			Addrs:        o.Addrs,
+			Password:     password,
+			OnConnect:    onConnect,
+			TLSConfig:    o.TLSConfig,
+			DialTimeout:  o.DialTimeout,
+			ReadTimeout:  o.ReadTimeout,
+			WriteTimeout: o.WriteTimeout,
+			PoolSize:     o.PoolSize,
+			MinIdleConns: o.MinIdleConns,
+			MaxRetries:   o.MaxRetries,
+		})
+	case redis.TopologySentinel:
+		return redisv6.NewFailoverClient(&redisv6.FailoverOptions{
+			MasterName:    o.MasterName,
+			SentinelAddrs: o.Addrs,
+			DB:            o.DB,
+			Password:      password,
+			OnConnect:     onConnect,
+			TLSConfig:     o.TLSConfig,
+			DialTimeout:   o.DialTimeout,
+			ReadTimeout:   o.ReadTimeout,
+			WriteTimeout:  o.WriteTimeout,
+			PoolSize:      o.PoolSize,
+			MinIdleConns:  o.MinIdleConns,
+			MaxRetries:    o.MaxRetries,
+		})
+	}
+	return unsupportedSubscriber()
+}
+
+// unsupportedSubscriber returns a client whose connections fail with ErrUnsupported
+func unsupportedSubscriber() *redisv6.Client {
+	return redisv6.NewClient(&redisv6.Options{
+		Dialer: func() (net.Conn, error) {
+			return nil, ErrUnsupported
+		},
+		MaxRetries: -1,
+	})
+}
+
+// Upgrade adapts a Cacher to ContextCacher. The wrapped operations cannot be interrupted,
+// so when ctx is done first the call returns ctx.Err() and the operation finishes in the background.
+// An empty Get result is reported as ErrNotFound, TTL and Expire return ErrUnsupported.
+// The optional operations are passed through when c has their context-free form, Ping() error,
+// LLen and PushCapped, SMembers and SAdd, Scan or PSubscribe, and return ErrUnsupported otherwise.
+func Upgrade(c Cacher) ContextCacher {
+	if l, ok := c.(*legacy); ok {
+		return l.c
+	}
+	return upgraded{c}
+}
+
+type upgraded struct {
+	Cacher
+}
+
+// wait runs fn until it returns or ctx is done
+func wait(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (u upgraded) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return wait(ctx, func() error { return u.Cacher.Set(key, value, ttl) })
+}
+
+func (u upgraded) Get(ctx context.Context, key string) (string, error) {
+	var value string
+	err := wait(ctx, func() (err error) {
+		value, err = u.Cacher.Get(key)
+		return err
+	})
+	if err != nil {
+		// value may still be written when ctx is done
+		return "", err
+	}
+	if value == "" {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (u upgraded) MGet(ctx context.Context, keys ...string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value, err := u.Get(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+func (u upgraded) MSet(ctx context.Context, values map[string]interface{}, ttl time.Duration) error {
+	for key, value := range values {
+		if err := u.Set(ctx, key, value, ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u upgraded) Remove(ctx context.Context, key string) error {
+	return wait(ctx, func() error { return u.Cacher.Remove(key) })
+}
+
+func (u upgraded) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := u.Get(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (u upgraded) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return 0, ErrUnsupported
+}
+
+func (u upgraded) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return ErrUnsupported
+}
+
+func (u upgraded) Publish(ctx context.Context, channel string, value interface{}) error {
+	return wait(ctx, func() error { return u.Cacher.Publish(channel, value) })
+}
+
+func (u upgraded) Subscribe(ctx context.Context, channels ...string) (redis.Subscription, error) {
+	return newLegacySubscription(ctx, u.Cacher.Subscribe(channels...))
+}
+
+func (u upgraded) PSubscribe(ctx context.Context, patterns ...string) (redis.Subscription, error) {
+	p, ok := u.Cacher.(legacyPatternSubscriber)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return newLegacySubscription(ctx, p.PSubscribe(patterns...))
+}
+
+func (u upgraded) Ping(ctx context.Context) error {
+	p, ok := u.Cacher.(legacyPinger)
+	if !ok {
+		return ErrUnsupported
+	}
+	return wait(ctx, p.Ping)
+}
+
+func (u upgraded) LLen(ctx context.Context, key string) (int64, error) {
+	lister, ok := u.Cacher.(legacyLister)
+	if !ok {
+		return 0, ErrUnsupported
+	}
+	var n int64
+	if err := wait(ctx, func() (err error) {
+		n, err = lister.LLen(key)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (u upgraded) PushCapped(ctx context.Context, key string, value interface{}, max int64) error {
+	lister, ok := u.Cacher.(legacyLister)
+	if !ok {
+		return ErrUnsupported
+	}
+	return wait(ctx, func() error { return lister.PushCapped(key, value, max) })
+}
+
+func (u upgraded) SMembers(ctx context.Context, key string) ([]string, error) {
+	tagger, ok := u.Cacher.(legacyTagger)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	var members []string
+	if err := wait(ctx, func() (err error) {
+		members, err = tagger.SMembers(key)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (u upgraded) SAdd(ctx context.Context, key string, ttl time.Duration, members ...string) error {
+	tagger, ok := u.Cacher.(legacyTagger)
+	if !ok {
+		return ErrUnsupported
+	}
+	return wait(ctx, func() error { return tagger.SAdd(key, ttl, members...) })
+}
+
+func (u upgraded) Scan(ctx context.Context, pattern string, fn func(key string) error) error {
+	scanner, ok := u.Cacher.(legacyScanner)
+	if !ok {
+		return ErrUnsupported
+	}
+	return wait(ctx, func() error { return scanner.Scan(pattern, fn) })
+}
+
+// Close closes the Cacher when it is an io.Closer
+func (u upgraded) Close() error {
+	if c, ok := u.Cacher.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// legacySubscription is a redis.Subscription on a go-redis v6 PubSub
+type legacySubscription struct {
+	pubsub    *redisv6.PubSub
+	ch        chan *redis.Message
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLegacySubscription(ctx context.Context, pubsub *redisv6.PubSub) (*legacySubscription, error) {
+	// the baseline Cacher implementations return no PubSub when they cannot subscribe
+	if pubsub == nil {
+		return nil, ErrUnsupported
+	}
+	// the first reply confirms the subscription, so a failure is reported here and not lost
+	if err := wait(ctx, func() error {
+		_, err := pubsub.Receive()
+		return err
+	}); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	s := &legacySubscription{pubsub: pubsub, ch: make(chan *redis.Message, 100), done: make(chan struct{})}
+	go func() {
+		defer close(s.ch)
+		for msg := range pubsub.Channel() {
+			select {
+			case s.ch <- &redis.Message{Channel: msg.Channel, Pattern: msg.Pattern, Payload: msg.Payload}:
+			case <-s.done:
+				// the driver stops once it sees the closed connection, until then it waits for a reader
+				for range pubsub.Channel() {
+				}
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (s *legacySubscription) Channel() <-chan *redis.Message {
+	return s.ch
+}
+
+func (s *legacySubscription) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return s.pubsub.Close()
+}
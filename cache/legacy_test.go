@@ -0,0 +1,22 @@
+package cache_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dendhi31/lazyhttp/cache"
+	redisv6 "github.com/go-redis/redis"
+)
+
+// nilSubscriber is a Cacher whose Subscribe returns no PubSub, like the baseline implementations
+// that cannot subscribe
+type nilSubscriber struct{ cache.Cacher }
+
+func (nilSubscriber) Subscribe(channels ...string) *redisv6.PubSub { return nil }
+
+func TestUpgradeSubscribeWithoutPubSub(t *testing.T) {
+	c := cache.Upgrade(nilSubscriber{})
+	if _, err := c.Subscribe(context.Background(), "jobs"); err != cache.ErrUnsupported {
+		t.Errorf("Subscribe error %v, want %v", err, cache.ErrUnsupported)
+	}
+}
@@ -0,0 +1,254 @@
+package memcached
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dendhi31/lazyhttp/cache"
+)
+
+var (
+	errNotStored = errors.New("memcached: not stored")
+	errExists    = errors.New("memcached: item modified since it was read")
+)
+
+// ServerError is an error reply of the server, the connection stays usable
+type ServerError struct {
+	Reply string
+}
+
+func (e *ServerError) Error() string {
+	return "memcached: " + e.Reply
+}
+
+// item is a value read from the server
+type item struct {
+	value []byte
+	flags uint32
+	cas   uint64
+}
+
+// server is a memcached server and its idle connections
+type server struct {
+	addr    string
+	options *Options
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+type conn struct {
+	nc net.Conn
+	rw *bufio.ReadWriter
+}
+
+// do runs fn on a connection of the server. The connection deadline follows ctx and Timeout,
+// and a cancelled ctx interrupts the I/O. A connection left in an unknown state is closed.
+func (s *server) do(ctx context.Context, fn func(c *conn) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c, err := s.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(s.options.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.nc.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		c.nc.SetDeadline(time.Unix(1, 0))
+	})
+	err = fn(c)
+	if !stop() && err != nil {
+		err = ctx.Err()
+	}
+
+	if clean(err) {
+		s.put(c)
+	} else {
+		c.nc.Close()
+	}
+	return err
+}
+
+// clean tells whether a connection is still aligned on the protocol after err
+func clean(err error) bool {
+	var serverErr *ServerError
+	return err == nil || err == cache.ErrNotFound || err == errNotStored || err == errExists || errors.As(err, &serverErr)
+}
+
+func (s *server) get(ctx context.Context) (*conn, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(s.idle); n > 0 {
+		c := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mu.Unlock()
+		return c, nil
+	}
+	s.mu.Unlock()
+
+	dialer := net.Dialer{Timeout: s.options.DialTimeout}
+	nc, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{nc: nc, rw: bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))}, nil
+}
+
+func (s *server) put(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || len(s.idle) >= s.options.MaxIdleConns {
+		c.nc.Close()
+		return
+	}
+	s.idle = append(s.idle, c)
+}
+
+func (s *server) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, c := range s.idle {
+		c.nc.Close()
+	}
+	s.idle = nil
+}
+
+// get reads keys with get, or gets when the cas values are needed. Missing keys are left out.
+func (c *conn) get(keys []string, withCAS bool) (map[string]item, error) {
+	command := "get"
+	if withCAS {
+		command = "gets"
+	}
+	if _, err := fmt.Fprintf(c.rw, "%s %s\r\n", command, strings.Join(keys, " ")); err != nil {
+		return nil, err
+	}
+	if err := c.rw.Flush(); err != nil {
+		return nil, err
+	}
+
+	items := make(map[string]item, len(keys))
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "END" {
+			return items, nil
+		}
+		// VALUE <key> <flags> <bytes> [<cas>]
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "VALUE" {
+			return nil, fmt.Errorf("memcached: unexpected reply %q", line)
+		}
+		flags, err1 := strconv.ParseUint(fields[2], 10, 32)
+		size, err2 := strconv.Atoi(fields[3])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("memcached: unexpected reply %q", line)
+		}
+		it := item{flags: uint32(flags), value: make([]byte, size+2)}
+		if len(fields) > 4 {
+			it.cas, _ = strconv.ParseUint(fields[4], 10, 64)
+		}
+		if _, err := io.ReadFull(c.rw, it.value); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(it.value, []byte("\r\n")) {
+			return nil, errors.New("memcached: value is not terminated")
+		}
+		it.value = it.value[:size]
+		items[fields[1]] = it
+	}
+}
+
+// writeStore writes a set, add or cas command without flushing, so stores can be pipelined
+func (c *conn) writeStore(command, key string, flags uint32, exptime int64, value []byte, cas uint64) error {
+	var err error
+	if command == "cas" {
+		_, err = fmt.Fprintf(c.rw, "cas %s %d %d %d %d\r\n", key, flags, exptime, len(value), cas)
+	} else {
+		_, err = fmt.Fprintf(c.rw, "%s %s %d %d %d\r\n", command, key, flags, exptime, len(value))
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(value); err != nil {
+		return err
+	}
+	_, err = c.rw.WriteString("\r\n")
+	return err
+}
+
+// readStore reads the reply of a store command
+func (c *conn) readStore() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	switch line {
+	case "STORED":
+		return nil
+	case "NOT_STORED":
+		return errNotStored
+	case "EXISTS":
+		return errExists
+	case "NOT_FOUND":
+		return cache.ErrNotFound
+	}
+	return fmt.Errorf("memcached: unexpected reply %q", line)
+}
+
+func (c *conn) store(command, key string, flags uint32, exptime int64, value []byte, cas uint64) error {
+	if err := c.writeStore(command, key, flags, exptime, value, cas); err != nil {
+		return err
+	}
+	if err := c.rw.Flush(); err != nil {
+		return err
+	}
+	return c.readStore()
+}
+
+// call sends a single line command and returns the reply line
+func (c *conn) call(format string, args ...interface{}) (string, error) {
+	if _, err := fmt.Fprintf(c.rw, format+"\r\n", args...); err != nil {
+		return "", err
+	}
+	if err := c.rw.Flush(); err != nil {
+		return "", err
+	}
+	return c.readLine()
+}
+
+// readLine reads a reply line, error replies are returned as errors
+func (c *conn) readLine() (string, error) {
+	line, err := c.rw.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch {
+	case strings.HasPrefix(line, "SERVER_ERROR"):
+		return "", &ServerError{Reply: line}
+	case line == "ERROR" || strings.HasPrefix(line, "CLIENT_ERROR"):
+		return "", fmt.Errorf("memcached: %s", line)
+	}
+	return line, nil
+}
@@ -0,0 +1,443 @@
+// Package memcached is a cache.ContextCacher speaking the memcached text protocol, with the meta
+// protocol for TTL and Exists, to one or more servers picked by consistent hashing.
+// Memcached has no pub/sub, lists or key listing, so the refresh jobs need a separate transport,
+// see lazyhttp.Config.StorageMemcached.
+package memcached
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dendhi31/lazyhttp/cache"
+	"github.com/dendhi31/lazyhttp/redis"
+)
+
+var (
+	// ErrWrongType is returned when a key holds another kind of value than the operation expects
+	ErrWrongType = errors.New("memcached: operation against a key holding the wrong kind of value")
+	// ErrClosed is returned by the operations of a closed client
+	ErrClosed = errors.New("memcached: client is closed")
+)
+
+// flags of the stored values. Values, envelopes included, are stored as they are since
+// memcached values are binary safe.
+const (
+	flagString uint32 = 0
+	flagSet    uint32 = 1
+)
+
+// maxRelativeTTL is the longest exptime memcached reads as seconds, longer ones are unix times
+const maxRelativeTTL = 30 * 24 * time.Hour
+
+// casRetries bounds the read-modify-write loop of SAdd
+const casRetries = 10
+
+// Options configures a Client, zero values keep the defaults
+type Options struct {
+	// Servers are the host:port of the memcached servers
+	Servers []string
+	// DialTimeout default is 1 second
+	DialTimeout time.Duration
+	// Timeout bounds an operation when its context has no earlier deadline, default is 1 second
+	Timeout time.Duration
+	// MaxIdleConns is the number of idle connections kept per server, default is 8
+	MaxIdleConns int
+}
+
+// Client is a cache.ContextCacher backed by memcached servers
+type Client struct {
+	options Options
+	servers []*server
+	ring    *ring
+	prefix  string
+}
+
+var (
+	_ cache.ContextCacher = (*Client)(nil)
+	_ cache.Pinger        = (*Client)(nil)
+	_ cache.Tagger        = (*Client)(nil)
+)
+
+// New creates a client for the servers of options and checks every one of them answers
+func New(options Options) (*Client, error) {
+	if len(options.Servers) == 0 {
+		return nil, errors.New("no memcached server found")
+	}
+	if options.DialTimeout <= 0 {
+		options.DialTimeout = time.Second
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = time.Second
+	}
+	if options.MaxIdleConns <= 0 {
+		options.MaxIdleConns = 8
+	}
+
+	c := &Client{options: options}
+	for _, addr := range options.Servers {
+		c.servers = append(c.servers, &server{addr: addr, options: &c.options})
+	}
+	c.ring = newRing(c.servers)
+	if err := c.Ping(context.Background()); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// SetPrefix will append a prefix to the keys of this client
+func (c *Client) SetPrefix(prefix string) {
+	c.prefix = prefix
+}
+
+// key returns the memcached key of key. Keys memcached does not accept, longer than
+// 250 bytes or with spaces or control characters, are replaced by their hash.
+func (c *Client) key(key string) string {
+	key = c.prefix + key
+	valid := len(key) <= 250
+	for i := 0; valid && i < len(key); i++ {
+		valid = key[i] > ' ' && key[i] != 0x7f
+	}
+	if valid {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "lazyhttp-sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Set stores value under key, a ttl of 0 does not expire
+func (c *Client) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	k := c.key(key)
+	return c.ring.pick(k).do(ctx, func(conn *conn) error {
+		return conn.store("set", k, flagString, exptime(ttl), []byte(cache.FormatValue(value)), 0)
+	})
+}
+
+// Get returns the value of key, ErrNotFound when it does not exist
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	k := c.key(key)
+	var it item
+	err := c.ring.pick(k).do(ctx, func(conn *conn) error {
+		items, err := conn.get([]string{k}, false)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if it, ok = items[k]; !ok {
+			return cache.ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if it.flags != flagString {
+		return "", ErrWrongType
+	}
+	return string(it.value), nil
+}
+
+// MGet returns the values of the keys that exist, with one multi-key get per server sent concurrently
+func (c *Client) MGet(ctx context.Context, keys ...string) (map[string]string, error) {
+	byServer := make(map[*server][]string)
+	names := make(map[string]string, len(keys))
+	for _, key := range keys {
+		k := c.key(key)
+		names[k] = key
+		s := c.ring.pick(k)
+		byServer[s] = append(byServer[s], k)
+	}
+
+	values := make(map[string]string, len(keys))
+	var mu sync.Mutex
+	err := c.each(ctx, byServer, func(conn *conn, keys []string) error {
+		items, err := conn.get(keys, false)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for k, it := range items {
+			if it.flags == flagString {
+				values[names[k]] = string(it.value)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// MSet stores every key-value pair of values with the same ttl, the sets to a server are pipelined
+func (c *Client) MSet(ctx context.Context, values map[string]interface{}, ttl time.Duration) error {
+	byServer := make(map[*server][]string)
+	payloads := make(map[string][]byte, len(values))
+	for key, value := range values {
+		k := c.key(key)
+		payloads[k] = []byte(cache.FormatValue(value))
+		s := c.ring.pick(k)
+		byServer[s] = append(byServer[s], k)
+	}
+
+	expiry := exptime(ttl)
+	return c.each(ctx, byServer, func(conn *conn, keys []string) error {
+		for _, k := range keys {
+			if err := conn.writeStore("set", k, flagString, expiry, payloads[k], 0); err != nil {
+				return err
+			}
+		}
+		if err := conn.rw.Flush(); err != nil {
+			return err
+		}
+		// every reply is read, so the connection stays aligned
+		var first error
+		for range keys {
+			if err := conn.readStore(); err != nil && first == nil {
+				first = err
+			}
+		}
+		return first
+	})
+}
+
+// each runs fn concurrently on the keys of every server and returns the first error
+func (c *Client) each(ctx context.Context, byServer map[*server][]string, fn func(conn *conn, keys []string) error) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var first error
+	for s, keys := range byServer {
+		wg.Add(1)
+		go func(s *server, keys []string) {
+			defer wg.Done()
+			err := s.do(ctx, func(conn *conn) error {
+				return fn(conn, keys)
+			})
+			if err != nil {
+				mu.Lock()
+				if first == nil {
+					first = fmt.Errorf("%s: %w", s.addr, err)
+				}
+				mu.Unlock()
+			}
+		}(s, keys)
+	}
+	wg.Wait()
+	return first
+}
+
+// Remove deletes key, a missing key is not an error
+func (c *Client) Remove(ctx context.Context, key string) error {
+	k := c.key(key)
+	return c.ring.pick(k).do(ctx, func(conn *conn) error {
+		reply, err := conn.call("delete %s", k)
+		if err != nil {
+			return err
+		}
+		if reply != "DELETED" && reply != "NOT_FOUND" {
+			return fmt.Errorf("memcached: unexpected reply %q", reply)
+		}
+		return nil
+	})
+}
+
+// Exists reports whether key exists
+func (c *Client) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := c.meta(ctx, key)
+	if err == cache.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// TTL returns the remaining time to live of key, 0 when it does not expire. Memcached counts in seconds.
+func (c *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	reply, err := c.meta(ctx, key, "t")
+	if err != nil {
+		return 0, err
+	}
+	for _, field := range strings.Fields(reply)[1:] {
+		if strings.HasPrefix(field, "t") {
+			seconds, err := strconv.ParseInt(field[1:], 10, 64)
+			if err != nil || seconds < 0 {
+				return 0, err
+			}
+			return time.Duration(seconds) * time.Second, nil
+		}
+	}
+	return 0, fmt.Errorf("memcached: unexpected reply %q", reply)
+}
+
+// meta sends a meta get with flags and returns its HD reply, ErrNotFound on EN
+func (c *Client) meta(ctx context.Context, key string, flags ...string) (string, error) {
+	k := c.key(key)
+	var reply string
+	err := c.ring.pick(k).do(ctx, func(conn *conn) (err error) {
+		reply, err = conn.call("%s", strings.Join(append([]string{"mg", k}, flags...), " "))
+		if err != nil {
+			return err
+		}
+		switch {
+		case reply == "EN":
+			return cache.ErrNotFound
+		case reply != "HD" && !strings.HasPrefix(reply, "HD "):
+			return fmt.Errorf("memcached: unexpected reply %q", reply)
+		}
+		return nil
+	})
+	return reply, err
+}
+
+// Expire sets the time to live of key, ErrNotFound when it does not exist.
+// A ttl of 0 or less removes the key, like redis does.
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	if ttl <= 0 {
+		if ok, err := c.Exists(ctx, key); err != nil || !ok {
+			if err == nil {
+				err = cache.ErrNotFound
+			}
+			return err
+		}
+		return c.Remove(ctx, key)
+	}
+	k := c.key(key)
+	return c.ring.pick(k).do(ctx, func(conn *conn) error {
+		reply, err := conn.call("touch %s %d", k, exptime(ttl))
+		if err != nil {
+			return err
+		}
+		switch reply {
+		case "TOUCHED":
+			return nil
+		case "NOT_FOUND":
+			return cache.ErrNotFound
+		}
+		return fmt.Errorf("memcached: unexpected reply %q", reply)
+	})
+}
+
+// Publish is not supported by memcached
+func (c *Client) Publish(ctx context.Context, channel string, value interface{}) error {
+	return cache.ErrUnsupported
+}
+
+// Subscribe is not supported by memcached
+func (c *Client) Subscribe(ctx context.Context, channels ...string) (redis.Subscription, error) {
+	return nil, cache.ErrUnsupported
+}
+
+// Ping checks every server answers
+func (c *Client) Ping(ctx context.Context) error {
+	for _, s := range c.servers {
+		err := s.do(ctx, func(conn *conn) error {
+			reply, err := conn.call("version")
+			if err == nil && !strings.HasPrefix(reply, "VERSION") {
+				err = fmt.Errorf("memcached: unexpected reply %q", reply)
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.addr, err)
+		}
+	}
+	return nil
+}
+
+// SMembers returns the members of the set stored at key
+func (c *Client) SMembers(ctx context.Context, key string) ([]string, error) {
+	members, _, err := c.readSet(ctx, c.key(key), false)
+	return members, err
+}
+
+// SAdd adds members to the set stored at key, and sets its ttl when it is not 0.
+// The set is a JSON value updated with cas, so concurrent adds are not lost.
+func (c *Client) SAdd(ctx context.Context, key string, ttl time.Duration, members ...string) error {
+	k := c.key(key)
+	s := c.ring.pick(k)
+	for i := 0; i < casRetries; i++ {
+		set, cas, err := c.readSet(ctx, k, true)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			if j := sort.SearchStrings(set, member); j == len(set) || set[j] != member {
+				set = append(set, "")
+				copy(set[j+1:], set[j:])
+				set[j] = member
+			}
+		}
+		value, err := json.Marshal(set)
+		if err != nil {
+			return err
+		}
+		err = s.do(ctx, func(conn *conn) error {
+			if cas == 0 {
+				return conn.store("add", k, flagSet, exptime(ttl), value, 0)
+			}
+			return conn.store("cas", k, flagSet, exptime(ttl), value, cas)
+		})
+		if err != errNotStored && err != errExists && err != cache.ErrNotFound {
+			return err
+		}
+		// another writer won, back off a little so the next read sees a settled set
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(rand.Int63n(int64(i+1) * int64(time.Millisecond)))):
+		}
+	}
+	return fmt.Errorf("memcached: set %s kept changing", key)
+}
+
+// readSet reads the set stored at k, empty when it is missing
+func (c *Client) readSet(ctx context.Context, k string, withCAS bool) ([]string, uint64, error) {
+	var it item
+	var found bool
+	err := c.ring.pick(k).do(ctx, func(conn *conn) error {
+		items, err := conn.get([]string{k}, withCAS)
+		it, found = items[k]
+		return err
+	})
+	if err != nil || !found {
+		return nil, 0, err
+	}
+	if it.flags != flagSet {
+		return nil, 0, ErrWrongType
+	}
+	var set []string
+	if err := json.Unmarshal(it.value, &set); err != nil {
+		return nil, 0, err
+	}
+	return set, it.cas, nil
+}
+
+// Close closes the idle connections, the client cannot be used after
+func (c *Client) Close() error {
+	for _, s := range c.servers {
+		s.close()
+	}
+	return nil
+}
+
+// exptime converts a ttl to memcached seconds, rounded up. Beyond 30 days memcached
+// reads the value as a unix time, so a long ttl is sent as one.
+func exptime(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	if ttl > maxRelativeTTL {
+		return time.Now().Add(ttl).Unix()
+	}
+	return int64((ttl + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,347 @@
+package memcached
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer speaks the part of the memcached text protocol the client uses
+type fakeServer struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	items    map[string]*fakeItem
+	cas      uint64
+	commands []string
+	// beforeStore runs before a store command is applied, with the lock held
+	beforeStore func(command, key string)
+}
+
+type fakeItem struct {
+	value   []byte
+	flags   uint32
+	exptime int64
+	cas     uint64
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{ln: ln, items: make(map[string]*fakeItem)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(nc)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+// sent returns the commands received starting with name
+func (s *fakeServer) sent(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var commands []string
+	for _, command := range s.commands {
+		if strings.HasPrefix(command, name+" ") {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+func (s *fakeServer) has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.items[key]
+	return ok
+}
+
+func (s *fakeServer) serve(nc net.Conn) {
+	defer nc.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, strings.TrimSpace(line))
+		s.mu.Unlock()
+		if err := s.handle(rw, fields); err != nil {
+			return
+		}
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeServer) handle(rw *bufio.ReadWriter, fields []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch fields[0] {
+	case "version":
+		rw.WriteString("VERSION fake\r\n")
+	case "get", "gets":
+		for _, key := range fields[1:] {
+			it, ok := s.items[key]
+			if !ok {
+				continue
+			}
+			if fields[0] == "gets" {
+				fmt.Fprintf(rw, "VALUE %s %d %d %d\r\n", key, it.flags, len(it.value), it.cas)
+			} else {
+				fmt.Fprintf(rw, "VALUE %s %d %d\r\n", key, it.flags, len(it.value))
+			}
+			rw.Write(it.value)
+			rw.WriteString("\r\n")
+		}
+		rw.WriteString("END\r\n")
+	case "set", "add", "cas":
+		// <command> <key> <flags> <exptime> <bytes> [<cas>]
+		key := fields[1]
+		flags, _ := strconv.ParseUint(fields[2], 10, 32)
+		exptime, _ := strconv.ParseInt(fields[3], 10, 64)
+		size, _ := strconv.Atoi(fields[4])
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(rw, value); err != nil {
+			return err
+		}
+		if s.beforeStore != nil {
+			s.beforeStore(fields[0], key)
+		}
+		it, exists := s.items[key]
+		switch {
+		case fields[0] == "add" && exists:
+			rw.WriteString("NOT_STORED\r\n")
+			return nil
+		case fields[0] == "cas" && !exists:
+			rw.WriteString("NOT_FOUND\r\n")
+			return nil
+		case fields[0] == "cas" && strconv.FormatUint(it.cas, 10) != fields[5]:
+			rw.WriteString("EXISTS\r\n")
+			return nil
+		}
+		s.cas++
+		s.items[key] = &fakeItem{value: value[:size], flags: uint32(flags), exptime: exptime, cas: s.cas}
+		rw.WriteString("STORED\r\n")
+	case "delete":
+		if _, ok := s.items[fields[1]]; !ok {
+			rw.WriteString("NOT_FOUND\r\n")
+			return nil
+		}
+		delete(s.items, fields[1])
+		rw.WriteString("DELETED\r\n")
+	default:
+		rw.WriteString("ERROR\r\n")
+	}
+	return nil
+}
+
+func newTestClient(t *testing.T, servers ...*fakeServer) *Client {
+	t.Helper()
+	var addrs []string
+	for _, s := range servers {
+		addrs = append(addrs, s.addr())
+	}
+	c, err := New(Options{Servers: addrs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestRing(t *testing.T) {
+	ctx := context.Background()
+	a, b := newFakeServer(t), newFakeServer(t)
+	c := newTestClient(t, a, b)
+
+	values := make(map[string]interface{})
+	var keys []string
+	for i := 0; i < 100; i++ {
+		key := "key-" + strconv.Itoa(i)
+		keys = append(keys, key)
+		values[key] = key
+	}
+	if err := c.MSet(ctx, values, 0); err != nil {
+		t.Fatal(err)
+	}
+	var onA []string
+	for _, key := range keys {
+		if a.has(key) == b.has(key) {
+			t.Fatalf("%s is on a: %t and b: %t, want exactly one server", key, a.has(key), b.has(key))
+		}
+		if a.has(key) {
+			onA = append(onA, key)
+		}
+	}
+	if len(onA) == 0 || len(onA) == len(keys) {
+		t.Errorf("%d of %d keys on a, want them spread", len(onA), len(keys))
+	}
+
+	// MGet sends one multi-key get per server
+	found, err := c.MGet(ctx, keys...)
+	if err != nil || len(found) != len(keys) {
+		t.Fatalf("MGet found %d keys, %v", len(found), err)
+	}
+	if n := len(a.sent("get")) + len(b.sent("get")); n != 2 {
+		t.Errorf("%d get commands, want one per server", n)
+	}
+
+	// a new server only takes keys, the others do not move between a and b
+	grown := newTestClient(t, a, b, newFakeServer(t))
+	for _, key := range keys {
+		owner := grown.ring.pick(key).addr
+		if a.has(key) && owner == b.addr() || b.has(key) && owner == a.addr() {
+			t.Errorf("%s moved between the servers already there", key)
+		}
+	}
+}
+
+func TestSAddRetriesOnConflict(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeServer(t)
+	c := newTestClient(t, s)
+
+	if err := c.SAdd(ctx, "tags", 0, "a"); err != nil {
+		t.Fatal(err)
+	}
+	// another writer adds b between the read and the cas of the next two tries
+	conflicts := 2
+	s.mu.Lock()
+	s.beforeStore = func(command, key string) {
+		if command == "cas" && conflicts > 0 {
+			conflicts--
+			s.cas++
+			s.items[key] = &fakeItem{value: []byte(`["a","b"]`), flags: flagSet, cas: s.cas}
+		}
+	}
+	s.mu.Unlock()
+	if err := c.SAdd(ctx, "tags", 0, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.sent("cas")); n != 3 {
+		t.Errorf("%d cas commands, want 2 conflicts and a success", n)
+	}
+	members, err := c.SMembers(ctx, "tags")
+	if err != nil || strings.Join(members, ",") != "a,b,c" {
+		t.Errorf("SMembers = %v, %v, want the member of the other writer kept", members, err)
+	}
+
+	// a writer that always wins makes the add fail instead of looping
+	s.mu.Lock()
+	s.beforeStore = func(command, key string) {
+		if command == "cas" {
+			s.cas++
+			s.items[key].cas = s.cas
+		}
+	}
+	s.mu.Unlock()
+	if err := c.SAdd(ctx, "tags", 0, "d"); err == nil {
+		t.Error("SAdd succeeded while every cas conflicted")
+	}
+}
+
+func TestSAddCreatesWithAdd(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeServer(t)
+	c := newTestClient(t, s)
+
+	// another writer creates the set between the read and the add
+	s.mu.Lock()
+	s.beforeStore = func(command, key string) {
+		if command == "add" && s.items[key] == nil {
+			s.cas++
+			s.items[key] = &fakeItem{value: []byte(`["a"]`), flags: flagSet, cas: s.cas}
+		}
+	}
+	s.mu.Unlock()
+	if err := c.SAdd(ctx, "tags", time.Minute, "b"); err != nil {
+		t.Fatal(err)
+	}
+	members, _ := c.SMembers(ctx, "tags")
+	if strings.Join(members, ",") != "a,b" {
+		t.Errorf("members %v, want the set created by the other writer extended", members)
+	}
+}
+
+func TestExptime(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeServer(t)
+	c := newTestClient(t, s)
+
+	for _, tt := range []struct {
+		key string
+		ttl time.Duration
+	}{{"none", 0}, {"rounded", 1500 * time.Millisecond}, {"month", maxRelativeTTL}, {"long", 60 * 24 * time.Hour}} {
+		if err := c.Set(ctx, tt.key, "v", tt.ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, want := range map[string]int64{"none": 0, "rounded": 2, "month": int64(maxRelativeTTL / time.Second)} {
+		if got := s.items[key].exptime; got != want {
+			t.Errorf("%s exptime %d, want %d", key, got, want)
+		}
+	}
+	// beyond 30 days memcached reads a unix time
+	want := time.Now().Add(60 * 24 * time.Hour).Unix()
+	if got := s.items["long"].exptime; got < want-5 || got > want {
+		t.Errorf("long exptime %d, want the unix time %d", got, want)
+	}
+}
+
+func TestHashedKeys(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeServer(t)
+	c := newTestClient(t, s)
+	c.SetPrefix("p:")
+
+	long := strings.Repeat("k", 300)
+	for _, key := range []string{long, "with space", "ok"} {
+		if err := c.Set(ctx, key, key, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := c.Get(ctx, key); err != nil || got != key {
+			t.Errorf("Get(%.20q) = %.20q, %v", key, got, err)
+		}
+	}
+	for _, command := range s.sent("set") {
+		key := strings.Fields(command)[1]
+		if len(key) > 250 {
+			t.Errorf("key of %d bytes sent", len(key))
+		}
+		if key != "p:ok" && !strings.HasPrefix(key, "lazyhttp-sha256:") {
+			t.Errorf("key %q sent, want a hash", key)
+		}
+	}
+	if !s.has("p:ok") {
+		t.Error("a valid key was hashed")
+	}
+}
@@ -0,0 +1,49 @@
+package memcached
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// pointsPerServer is the number of points a server has on the ring, like ketama
+const pointsPerServer = 160
+
+// ring maps keys to servers by consistent hashing,
+// so adding or removing a server only moves the keys of its own arcs
+type ring struct {
+	points  []uint32
+	servers map[uint32]*server
+}
+
+func newRing(servers []*server) *ring {
+	r := &ring{servers: make(map[uint32]*server, len(servers)*pointsPerServer)}
+	for _, s := range servers {
+		for i := 0; i < pointsPerServer/4; i++ {
+			// each digest gives four points
+			digest := md5.Sum([]byte(s.addr + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				point := binary.LittleEndian.Uint32(digest[j*4:])
+				if _, taken := r.servers[point]; taken {
+					continue
+				}
+				r.servers[point] = s
+				r.points = append(r.points, point)
+			}
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// pick returns the server owning key, the first point at or after its hash
+func (r *ring) pick(key string) *server {
+	digest := md5.Sum([]byte(key))
+	hash := binary.LittleEndian.Uint32(digest[:4])
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.servers[r.points[i]]
+}
@@ -0,0 +1,161 @@
+package lazyhttp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/dendhi31/lazyhttp/cache"
+)
+
+// ErrBodyTooLarge is returned when an upstream response body is larger than MaxBodySize
+var ErrBodyTooLarge = errors.New("response body exceeds MaxBodySize")
+
+// CachedBody is a cached response whose body is read from the cache as it is consumed
+type CachedBody struct {
+	StatusCode int
+	Header     http.Header
+	StoredAt   time.Time
+	// Age is -1 for entries stored without a timestamp
+	Age time.Duration
+	// Size is the body size
+	Size int64
+	// Chunked tells the body is streamed from the chunks of the entry
+	Chunked bool
+	// Body must be closed
+	Body io.ReadCloser
+}
+
+// OpenCached returns the response cached under key without asking the upstream, cache.ErrNotFound
+// when there is none. A chunked body is streamed chunk by chunk, so it is never held whole in memory,
+// and a chunk missing or corrupt midway is returned by Body.Read. The local copies are not used.
+func (httprequest *Client) OpenCached(ctx context.Context, key string) (*CachedBody, error) {
+	for attempt := 0; ; attempt++ {
+		value, err := httprequest.CacheClient.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if !cache.IsManifest(value) {
+			envelope, err := cache.ParseEnvelope(value)
+			if err != nil {
+				return nil, err
+			}
+			return httprequest.cachedBody(envelope, int64(len(envelope.Body)), false, ioutil.NopCloser(bytes.NewReader(envelope.Body))), nil
+		}
+
+		entry, err := cache.ParseManifest(value)
+		if err != nil {
+			return nil, err
+		}
+		body, err := entry.Open(ctx, httprequest.CacheClient, key)
+		if errors.Is(err, cache.ErrChunkMissing) && attempt == 0 {
+			// replaced since the manifest was read, the new one is read once
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return httprequest.cachedBody(entry.Envelope, entry.Size, true, body), nil
+	}
+}
+
+func (httprequest *Client) cachedBody(envelope *cache.Envelope, size int64, chunked bool, body io.ReadCloser) *CachedBody {
+	code := envelope.StatusCode
+	if code == 0 {
+		code = http.StatusOK
+	}
+	return &CachedBody{
+		StatusCode: code,
+		Header:     envelope.Header,
+		StoredAt:   envelope.StoredAt,
+		Age:        httprequest.entryAge(envelope.StoredAt),
+		Size:       size,
+		Chunked:    chunked,
+		Body:       body,
+	}
+}
+
+// readBody reads an upstream body up to limit bytes, 0 is unbounded. A body the upstream cut short
+// is an error, so a partial body is never cached.
+func readBody(response *http.Response, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error read response body: %v", err)
+		}
+		return body, nil
+	}
+	if response.ContentLength > limit {
+		return nil, fmt.Errorf("%w: %d bytes announced, limit is %d", ErrBodyTooLarge, response.ContentLength, limit)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("error read response body: %v", err)
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("%w: limit is %d bytes", ErrBodyTooLarge, limit)
+	}
+	return body, nil
+}
+
+// chunkedResult reads a chunked entry whole for the redis leg. An entry replaced while it is read
+// is read again once, then it is a miss. It returns the value it read last, empty on a miss.
+func (httprequest *Client) chunkedResult(ctx context.Context, key, value string) (redisChannel, string) {
+	for attempt := 0; ; attempt++ {
+		envelope, err := httprequest.readChunked(ctx, key, value)
+		if errors.Is(err, cache.ErrChunkMissing) {
+			if attempt > 0 {
+				return redisChannel{}, ""
+			}
+			value, err = httprequest.CacheClient.Get(ctx, key)
+			if errors.Is(err, cache.ErrNotFound) {
+				return redisChannel{}, ""
+			}
+			if err != nil {
+				return redisChannel{ErrorChan: err}, value
+			}
+			if !cache.IsManifest(value) {
+				return envelopeResult(value), value
+			}
+			continue
+		}
+		if err != nil {
+			return redisChannel{ErrorChan: err}, value
+		}
+		return redisChannel{
+			ResultChan: string(envelope.Body),
+			StatusCode: envelope.StatusCode,
+			Header:     envelope.Header,
+			StoredAt:   envelope.StoredAt,
+		}, value
+	}
+}
+
+// readChunked reads the chunks of the manifest value of key
+func (httprequest *Client) readChunked(ctx context.Context, key, value string) (*cache.Envelope, error) {
+	entry, err := cache.ParseManifest(value)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	defer func() {
+		httprequest.Metrics.ObserveRedis("get_chunks", time.Since(start))
+	}()
+	body, err := entry.Open(ctx, httprequest.CacheClient, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var b bytes.Buffer
+	b.Grow(int(entry.Size))
+	if _, err := b.ReadFrom(body); err != nil {
+		return nil, err
+	}
+	entry.Envelope.Body = b.Bytes()
+	return entry.Envelope, nil
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dendhi31/lazyhttp"
+	"github.com/dendhi31/lazyhttp/cache"
+	"github.com/dendhi31/lazyhttp/redis"
+	redisgo "github.com/redis/go-redis/v9"
+)
+
+func runGet(e *env, args []string) error {
+	flags := flag.NewFlagSet("get", flag.ExitOnError)
+	noBody := flags.Bool("no-body", false, "do not print the body")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: get <key>")
+	}
+
+	client, err := e.storage()
+	if err != nil {
+		return err
+	}
+	rc, err := client.Client()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	key := e.key(flags.Arg(0))
+	value, err := client.Get(ctx, key)
+	if errors.Is(err, redis.ErrNotFound) {
+		return fmt.Errorf("key %s not found", key)
+	}
+	if err != nil {
+		return err
+	}
+	ttl, err := rc.PTTL(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+
+	var envelope *cache.Envelope
+	var chunked *cache.ChunkedEntry
+	if cache.IsManifest(value) {
+		if chunked, err = cache.ParseManifest(value); err != nil {
+			return fmt.Errorf("key %s: %v", key, err)
+		}
+		envelope = chunked.Envelope
+	} else if envelope, err = cache.ParseEnvelope(value); err != nil {
+		return fmt.Errorf("key %s: %v", key, err)
+	}
+	w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "key:\t%s\n", key)
+	fmt.Fprintf(w, "ttl:\t%s\n", formatTTL(ttl))
+	if envelope.StoredAt.IsZero() {
+		fmt.Fprintf(w, "stored at:\tunknown, raw value\n")
+	} else {
+		fmt.Fprintf(w, "stored at:\t%s\n", envelope.StoredAt.Format(time.RFC3339))
+		fmt.Fprintf(w, "age:\t%s\n", envelope.Age(time.Now()).Round(time.Second))
+	}
+	if envelope.StatusCode != 0 {
+		fmt.Fprintf(w, "status:\t%d\n", envelope.StatusCode)
+	}
+	if chunked != nil {
+		if envelope.Codec != cache.CodecNone {
+			fmt.Fprintf(w, "compression:\t%s, %d bytes stored\n", envelope.Codec, chunked.StoredSize)
+		}
+		fmt.Fprintf(w, "chunks:\t%d, version %s\n", chunked.Chunks, chunked.Version)
+		fmt.Fprintf(w, "size:\t%d bytes\n", chunked.Size)
+	} else {
+		if envelope.Codec != cache.CodecNone {
+			fmt.Fprintf(w, "compression:\t%s, %d bytes stored\n", envelope.Codec, len(value))
+		}
+		fmt.Fprintf(w, "size:\t%d bytes\n", len(envelope.Body))
+	}
+	w.Flush()
+
+	if len(envelope.Header) > 0 {
+		fmt.Fprintln(e.out)
+		names := make([]string, 0, len(envelope.Header))
+		for name := range envelope.Header {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(e.out, "%s: %s\n", name, strings.Join(envelope.Header[name], ", "))
+		}
+	}
+	if !*noBody {
+		fmt.Fprintln(e.out)
+		if chunked != nil {
+			// the key carries the prefix already, so do the chunk keys
+			body, err := chunked.Open(ctx, cache.Wrap(rc), key)
+			if err != nil {
+				return fmt.Errorf("key %s: %v", key, err)
+			}
+			_, err = io.Copy(e.out, body)
+			body.Close()
+			if err != nil {
+				return fmt.Errorf("key %s: %v", key, err)
+			}
+		} else {
+			e.out.Write(envelope.Body)
+		}
+		fmt.Fprintln(e.out)
+	}
+	return nil
+}
+
+func runDel(e *env, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: del <key|pattern>")
+	}
+	client, err := e.storage()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if !isPattern(args[0]) {
+		if err := client.Remove(ctx, e.key(args[0])); err != nil {
+			return err
+		}
+		fmt.Fprintf(e.out, "deleted %s\n", e.key(args[0]))
+		return nil
+	}
+
+	// deleting one by one keeps working on a cluster, where keys live in different slots
+	var deleted int
+	err = client.Scan(ctx, e.key(args[0]), func(key string) error {
+		if err := client.Remove(ctx, key); err != nil {
+			return err
+		}
+		deleted++
+		return nil
+	})
+	fmt.Fprintf(e.out, "deleted %d keys\n", deleted)
+	return err
+}
+
+func runLs(e *env, args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ExitOnError)
+	long := flags.Bool("l", false, "show TTL and size of every key")
+	flags.Parse(args)
+
+	pattern := "*"
+	if flags.NArg() > 0 {
+		pattern = flags.Arg(0)
+	}
+	client, err := e.storage()
+	if err != nil {
+		return err
+	}
+	rc, err := client.Client()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	return client.Scan(ctx, e.key(pattern), func(key string) error {
+		name := strings.TrimPrefix(key, e.config.TempStorageKeyPrefix)
+		if !*long {
+			fmt.Fprintln(w, name)
+			return nil
+		}
+		ttl, err := rc.PTTL(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		size, err := rc.StrLen(ctx, key).Result()
+		if err != nil {
+			size = -1
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\n", name, formatTTL(ttl), size)
+		return nil
+	})
+}
+
+func runStats(e *env, args []string) error {
+	client, err := e.storage()
+	if err != nil {
+		return err
+	}
+	rc, err := client.Client()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var keys, bytes int64
+	var minTTL, maxTTL time.Duration = -1, -1
+	err = client.Scan(ctx, e.key("*"), func(key string) error {
+		keys++
+		if size, err := rc.StrLen(ctx, key).Result(); err == nil {
+			bytes += size
+		}
+		ttl, err := rc.PTTL(ctx, key).Result()
+		if err != nil || ttl < 0 {
+			return nil
+		}
+		if minTTL < 0 || ttl < minTTL {
+			minTTL = ttl
+		}
+		if ttl > maxTTL {
+			maxTTL = ttl
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var hits, misses int64
+	err = forEachNode(ctx, rc, func(node redisgo.Cmdable) error {
+		info, err := node.Info(ctx, "stats").Result()
+		if err != nil {
+			return err
+		}
+		hits += infoInt(info, "keyspace_hits")
+		misses += infoInt(info, "keyspace_misses")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(e.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "prefix:\t%q\n", e.config.TempStorageKeyPrefix)
+	fmt.Fprintf(w, "keys:\t%d\n", keys)
+	fmt.Fprintf(w, "size:\t%d bytes\n", bytes)
+	fmt.Fprintf(w, "min ttl:\t%s\n", formatTTL(minTTL))
+	fmt.Fprintf(w, "max ttl:\t%s\n", formatTTL(maxTTL))
+	fmt.Fprintf(w, "redis keyspace hits:\t%d\n", hits)
+	fmt.Fprintf(w, "redis keyspace misses:\t%d\n", misses)
+	if hits+misses > 0 {
+		fmt.Fprintf(w, "redis hit ratio:\t%.2f\n", float64(hits)/float64(hits+misses))
+	}
+	return w.Flush()
+}
+
+func runWarm(e *env, args []string) error {
+	flags := flag.NewFlagSet("warm", flag.ExitOnError)
+	concurrency := flags.Int("c", 4, "number of concurrent requests")
+	rate := flags.Float64("rate", 0, "maximum requests per second, 0 is unlimited")
+	set := flags.String("set", "", "read the manifest from this redis set instead of a file")
+	every := flags.Duration("every", 0, "warm again on this interval until interrupted")
+	quiet := flags.Bool("q", false, "only print failures and the summary")
+	flags.Parse(args)
+	if (*set == "") == (flags.NArg() == 0) || flags.NArg() > 1 {
+		return errors.New("usage: warm [-c n] [-rate r] [-every d] <manifest-file> | -set <key>")
+	}
+
+	client, err := e.client()
+	if err != nil {
+		return err
+	}
+	load := warmLoader(client, flags.Arg(0), *set)
+
+	var mu sync.Mutex
+	opts := lazyhttp.WarmOptions{
+		Concurrency: *concurrency,
+		Rate:        *rate,
+		Progress: func(result lazyhttp.WarmResult) {
+			mu.Lock()
+			defer mu.Unlock()
+			req := result.Request
+			switch {
+			case result.Err != nil:
+				fmt.Fprintf(e.out, "FAIL %s %s: %v\n", req.Method, req.URL, result.Err)
+			case !*quiet:
+				fmt.Fprintf(e.out, "OK   %s %s -> %s\n", req.Method, req.URL, req.Key)
+			}
+		},
+	}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *every > 0 {
+		err := client.WarmEvery(ctx, *every, load, opts)
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+		return err
+	}
+
+	manifest, err := load()
+	if err != nil {
+		return err
+	}
+	report, err := client.Warm(ctx, manifest, opts)
+	fmt.Fprintf(e.out, "warmed %d of %d in %s\n", report.Succeeded, len(manifest), report.Duration.Round(time.Millisecond))
+	if err != nil {
+		return err
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%d requests failed", report.Failed)
+	}
+	return nil
+}
+
+// warmLoader returns the manifest loader of a file, or of a redis set when set is given
+func warmLoader(client *lazyhttp.Client, path, set string) func() ([]*lazyhttp.Request, error) {
+	if set != "" {
+		return func() ([]*lazyhttp.Request, error) {
+			return client.ManifestFromSet(set)
+		}
+	}
+	return func() ([]*lazyhttp.Request, error) {
+		return lazyhttp.LoadManifest(path)
+	}
+}
+
+func isPattern(key string) bool {
+	return strings.ContainsAny(key, "*?[")
+}
+
+// formatTTL formats a PTTL reply, -2 is a missing key and -1 a key without expiry
+func formatTTL(ttl time.Duration) string {
+	switch {
+	case ttl == -2:
+		return "missing"
+	case ttl < 0:
+		return "none"
+	}
+	return ttl.Round(time.Millisecond).String()
+}
+
+// forEachNode calls fn with every master of a cluster, or with client itself
+func forEachNode(ctx context.Context, client redisgo.Cmdable, fn func(node redisgo.Cmdable) error) error {
+	if cluster, ok := client.(*redisgo.ClusterClient); ok {
+		var mu sync.Mutex
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redisgo.Client) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return fn(node)
+		})
+	}
+	return fn(client)
+}
+
+// infoInt reads an integer field of an INFO reply
+func infoInt(info string, field string) int64 {
+	for _, line := range strings.Split(info, "\n") {
+		if strings.HasPrefix(line, field+":") {
+			n, _ := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, field+":")), 10, 64)
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dendhi31/lazyhttp"
+	"github.com/dendhi31/lazyhttp/logger"
+	"github.com/dendhi31/lazyhttp/redis"
+	"github.com/dendhi31/lazyhttp/redismaint"
+	redisgo "github.com/redis/go-redis/v9"
+)
+
+// headerFlag collects repeated -header name=value flags
+type headerFlag map[string]string
+
+func (h headerFlag) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h headerFlag) Set(value string) error {
+	name, v, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("header %q is not name=value", value)
+	}
+	h[name] = v
+	return nil
+}
+
+// pubsub returns a client on the pubsub hosts, where refresh jobs and dead letters live
+func (e *env) pubsub() (*redis.Client, error) {
+	addrs := e.config.PubSubAddrs()
+	if addrs == nil {
+		return nil, errors.New("RedisHost is not configured")
+	}
+	options, err := e.config.PubSubRedis.Options(addrs, e.config.StorageDB)
+	if err != nil {
+		return nil, err
+	}
+	client, err := redis.NewClientWithOptions(options)
+	if err != nil {
+		return nil, fmt.Errorf("error connect %s: %v", strings.Join(addrs, ","), err)
+	}
+	return client, nil
+}
+
+// channel returns the refresh channel, the same way the client resolves it
+func (e *env) channel() string {
+	if e.config.Channel == "" {
+		return lazyhttp.DefaultChannel
+	}
+	return e.config.Channel
+}
+
+// client returns a lazyhttp client for the config, logging only errors to stderr
+func (e *env) client() (*lazyhttp.Client, error) {
+	if e.config.Logger == nil {
+		e.config.Logger = logger.Nop()
+	}
+	return lazyhttp.New(e.config)
+}
+
+func runTail(e *env, args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	raw := flags.Bool("raw", false, "print the messages as received, one per line")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return errors.New("usage: tail [-raw]")
+	}
+
+	client, err := e.pubsub()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// the consumer subscribes with a pattern, tail does the same to see the same jobs
+	sub, err := client.PSubscribe(context.Background(), e.channel())
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	fmt.Fprintf(os.Stderr, "tailing %s on %s\n", e.channel(), strings.Join(e.config.PubSubAddrs(), ","))
+
+	for msg := range sub.Channel() {
+		if *raw {
+			fmt.Fprintln(e.out, msg.Payload)
+			continue
+		}
+		printJob(e.out, msg.Channel, []byte(msg.Payload))
+	}
+	return nil
+}
+
+// printJob pretty-prints a published RequestRequirement, undecodable messages are shown as is
+func printJob(w io.Writer, channel string, payload []byte) {
+	var job redismaint.RequestRequirement
+	if err := json.Unmarshal(payload, &job); err != nil {
+		fmt.Fprintf(w, "%s %s undecodable message: %s\n", time.Now().Format(time.RFC3339), channel, payload)
+		return
+	}
+	fmt.Fprintf(w, "%s %s %s %s\n", time.Now().Format(time.RFC3339), channel, job.Action, job.Url)
+	fmt.Fprintf(w, "  key: %s\n", job.Key)
+	if !job.PublishedAt.IsZero() {
+		fmt.Fprintf(w, "  published: %s (lag %s)\n", job.PublishedAt.Format(time.RFC3339), time.Since(job.PublishedAt).Round(time.Millisecond))
+	}
+	names := make([]string, 0, len(job.Header))
+	for name := range job.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s: %s\n", name, job.Header[name])
+	}
+	if len(job.Payload) > 0 {
+		fmt.Fprintf(w, "  payload: %s\n", job.Payload)
+	}
+	if traceparent := job.TraceContext["traceparent"]; traceparent != "" {
+		fmt.Fprintf(w, "  traceparent: %s\n", traceparent)
+	}
+}
+
+func runPublish(e *env, args []string) error {
+	flags := flag.NewFlagSet("publish", flag.ExitOnError)
+	rawURL := flags.String("url", "", "URL to refresh")
+	method := flags.String("method", "GET", "request method")
+	key := flags.String("key", "", "cache key, default is the URL")
+	payload := flags.String("payload", "", "request body")
+	jsonJob := flags.String("json", "", "the job as a JSON RequestRequirement, instead of the flags")
+	header := headerFlag{}
+	flags.Var(header, "header", "request header as name=value, repeatable")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return errors.New("usage: publish -url URL [-method M] [-key K] [-header name=value] [-payload P] | -json JOB")
+	}
+
+	job := redismaint.RequestRequirement{
+		Url:     *rawURL,
+		Action:  strings.ToUpper(*method),
+		Payload: []byte(*payload),
+		Header:  header,
+		Key:     *key,
+	}
+	if *jsonJob != "" {
+		job = redismaint.RequestRequirement{}
+		if err := json.Unmarshal([]byte(*jsonJob), &job); err != nil {
+			return fmt.Errorf("error decode job: %v", err)
+		}
+	}
+	if job.Url == "" {
+		return errors.New("no URL given, use -url or -json")
+	}
+	if job.Key == "" {
+		job.Key = job.Url
+	}
+
+	client, err := e.client()
+	if err != nil {
+		return err
+	}
+	if err := client.Refresh(context.Background(), jobRequest(job)); err != nil {
+		return err
+	}
+	fmt.Fprintf(e.out, "published %s %s -> %s on %s\n", job.Action, job.Url, job.Key, e.channel())
+	return nil
+}
+
+func runReplay(e *env, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	deadLetter := flags.Bool("dead-letter", false, "replay the jobs of the dead-letter store, removing them")
+	limit := flags.Int("n", 0, "replay at most n jobs, 0 is all")
+	flags.Parse(args)
+	if *deadLetter == (flags.NArg() == 1) || flags.NArg() > 1 {
+		return errors.New("usage: replay [-n count] <file|-> | replay [-n count] -dead-letter")
+	}
+
+	client, err := e.client()
+	if err != nil {
+		return err
+	}
+	if *deadLetter {
+		return replayDeadLetters(e, client, *limit)
+	}
+
+	in := os.Stdin
+	if flags.Arg(0) != "-" {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var replayed int
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan() && (*limit == 0 || replayed < *limit); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		job, err := decodeJob([]byte(text))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", flags.Arg(0), line, err)
+		}
+		if err := client.Refresh(context.Background(), jobRequest(job)); err != nil {
+			return fmt.Errorf("%s:%d: %v", flags.Arg(0), line, err)
+		}
+		replayed++
+		fmt.Fprintf(e.out, "published %s %s -> %s\n", job.Action, job.Url, job.Key)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(e.out, "replayed %d jobs\n", replayed)
+	return nil
+}
+
+// replayDeadLetters pops the dead letters one by one and publishes them again,
+// a job is pushed back when it could not be published
+func replayDeadLetters(e *env, client *lazyhttp.Client, limit int) error {
+	if e.config.DeadLetterKey == "" {
+		return errors.New("DeadLetterKey is not configured")
+	}
+	pubsub, err := e.pubsub()
+	if err != nil {
+		return err
+	}
+	defer pubsub.Close()
+	rc, err := pubsub.Client()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var replayed int
+	for limit == 0 || replayed < limit {
+		entry, err := rc.LPop(ctx, e.config.DeadLetterKey).Result()
+		if err == redisgo.Nil {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		job, err := decodeJob([]byte(entry))
+		if err == nil {
+			err = client.Refresh(ctx, jobRequest(job))
+		}
+		if err != nil {
+			if perr := rc.LPush(ctx, e.config.DeadLetterKey, entry).Err(); perr != nil {
+				return fmt.Errorf("%v, and the dead letter could not be restored: %v", err, perr)
+			}
+			return err
+		}
+		replayed++
+		fmt.Fprintf(e.out, "published %s %s -> %s\n", job.Action, job.Url, job.Key)
+	}
+	fmt.Fprintf(e.out, "replayed %d jobs\n", replayed)
+	return nil
+}
+
+// decodeJob decodes a RequestRequirement, or the job of a redismaint.DeadLetter
+func decodeJob(data []byte) (redismaint.RequestRequirement, error) {
+	var letter struct {
+		Job *redismaint.RequestRequirement `json:"job"`
+	}
+	if err := json.Unmarshal(data, &letter); err != nil {
+		return redismaint.RequestRequirement{}, err
+	}
+	if letter.Job != nil {
+		return *letter.Job, nil
+	}
+	var job redismaint.RequestRequirement
+	err := json.Unmarshal(data, &job)
+	if err == nil && job.Url == "" {
+		err = errors.New("job has no url")
+	}
+	return job, err
+}
+
+func jobRequest(job redismaint.RequestRequirement) *lazyhttp.Request {
+	if job.Action == "" {
+		job.Action = "GET"
+	}
+	return &lazyhttp.Request{
+		URL:      job.Url,
+		Method:   job.Action,
+		Body:     job.Payload,
+		Header:   job.Header,
+		Key:      job.Key,
+		UseCache: true,
+		Tags:     job.Tags,
+	}
+}
+
+func runConsume(e *env, args []string) error {
+	flags := flag.NewFlagSet("consume", flag.ExitOnError)
+	debug := flags.Bool("debug", e.config.Debug, "log every job")
+	warmFile := flags.String("warm", "", "warm the cache from this manifest file at start")
+	warmSet := flags.String("warm-set", "", "warm the cache from this redis set at start")
+	warmEvery := flags.Duration("warm-every", time.Hour, "interval between two warm runs, 0 warms once at start")
+	concurrency := flags.Int("warm-c", 4, "number of concurrent warm requests")
+	rate := flags.Float64("warm-rate", 0, "maximum warm requests per second, 0 is unlimited")
+	flags.Parse(args)
+	if flags.NArg() != 0 || (*warmFile != "" && *warmSet != "") {
+		return errors.New("usage: consume [-debug] [-warm file | -warm-set key] [-warm-every d]")
+	}
+
+	if e.config.Logger == nil {
+		e.config.Logger = logger.New(logger.Config{Debug: *debug, Output: os.Stderr})
+	}
+	client, err := e.client()
+	if err != nil {
+		return err
+	}
+	if *warmFile != "" || *warmSet != "" {
+		opts := lazyhttp.WarmOptions{Concurrency: *concurrency, Rate: *rate}
+		if err := opts.Validate(); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		load := warmLoader(client, *warmFile, *warmSet)
+		go func() {
+			var err error
+			if *warmEvery > 0 {
+				err = client.WarmEvery(ctx, *warmEvery, load, opts)
+			} else {
+				var manifest []*lazyhttp.Request
+				if manifest, err = load(); err == nil {
+					_, err = client.Warm(ctx, manifest, opts)
+				}
+			}
+			if err != nil && ctx.Err() == nil {
+				client.Logger.Error("cache warming stopped", logger.KeyError, err)
+			}
+		}()
+	}
+	return client.Consumer()
+}
@@ -0,0 +1,147 @@
+// Command lazyhttp inspects and manages the entries cached by lazyhttp.
+//
+// It reads the same lazyhttp.Config the services use, as JSON:
+//
+//	lazyhttp -config config.json get <key>
+//	lazyhttp -config config.json del <key|pattern>
+//	lazyhttp -config config.json ls [pattern]
+//	lazyhttp -config config.json stats
+//	lazyhttp -config config.json warm <manifest-file|-set key>
+//	lazyhttp -config config.json tail
+//	lazyhttp -config config.json publish -url <url>
+//	lazyhttp -config config.json replay <file|-dead-letter>
+//	lazyhttp -config config.json consume
+//
+// Keys are given without TempStorageKeyPrefix, it is added and stripped by the command.
+// The cache commands read a redis storage, they fail when StorageDisk or StorageMemcached is configured.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dendhi31/lazyhttp"
+	"github.com/dendhi31/lazyhttp/redis"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(env *env, args []string) error
+}
+
+var commands = []command{
+	{"get", "get <key>\tshow the cached envelope of key, its age and TTL", runGet},
+	{"del", "del <key|pattern>\tdelete a key, or every key matching a glob pattern", runDel},
+	{"ls", "ls [pattern]\tlist the keys matching a glob pattern, default *", runLs},
+	{"stats", "stats\tshow cache and redis statistics", runStats},
+	{"warm", "warm <manifest-file> | -set <key>\tfetch every request of the manifest and store the responses", runWarm},
+	{"tail", "tail [-raw]\tprint the refresh jobs published on Channel", runTail},
+	{"publish", "publish -url URL | -json JOB\tpublish a refresh job", runPublish},
+	{"replay", "replay <file|-> | -dead-letter\tpublish again the jobs of a JSON lines file or of the dead-letter store", runReplay},
+	{"consume", "consume [-retries n] [-warm file]\trun the refresh job consumer until interrupted, optionally warming the cache", runConsume},
+}
+
+// env is what every command works with
+type env struct {
+	config lazyhttp.Config
+	out    io.Writer
+	redis  *redis.Client
+}
+
+func (e *env) storage() (*redis.Client, error) {
+	if e.redis != nil {
+		return e.redis, nil
+	}
+	// the client would store elsewhere, a redis on the default address is not that storage
+	switch {
+	case e.config.StorageDisk.Path != "":
+		return nil, fmt.Errorf("storage is the disk file %s, only a redis storage is supported", e.config.StorageDisk.Path)
+	case len(e.config.StorageMemcached.Servers) > 0:
+		return nil, fmt.Errorf("storage is memcached on %s, only a redis storage is supported", strings.Join(e.config.StorageMemcached.Servers, ","))
+	}
+	options, err := e.config.StorageRedis.Options(e.config.StorageHostServer, e.config.StorageDB)
+	if err != nil {
+		return nil, err
+	}
+	if options.ReadTimeout == 0 {
+		options.ReadTimeout = 10 * time.Second
+	}
+	client, err := redis.NewClientWithOptions(options)
+	if err != nil {
+		return nil, fmt.Errorf("error create storage client: %v", err)
+	}
+	e.redis = client
+	return client, nil
+}
+
+func (e *env) key(key string) string {
+	return e.config.TempStorageKeyPrefix + key
+}
+
+func main() {
+	flags := flag.NewFlagSet("lazyhttp", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("LAZYHTTP_CONFIG"), "path of the JSON lazyhttp config, default is $LAZYHTTP_CONFIG")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: lazyhttp [-config file] <command> [args]\n\ncommands:\n")
+		w := tabwriter.NewWriter(flags.Output(), 0, 4, 2, ' ', 0)
+		for _, cmd := range commands {
+			fmt.Fprintf(w, "  %s\n", cmd.usage)
+		}
+		w.Flush()
+		fmt.Fprintf(flags.Output(), "\nflags:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == flags.Arg(0) {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "lazyhttp: unknown command %q\n", flags.Arg(0))
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lazyhttp: %v\n", err)
+		os.Exit(1)
+	}
+	if err := cmd.run(&env{config: config, out: os.Stdout}, flags.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "lazyhttp %s: %v\n", cmd.name, err)
+		os.Exit(1)
+	}
+}
+
+// loadConfig reads a lazyhttp.Config from a JSON file,
+// durations are in milliseconds like in code
+func loadConfig(path string) (lazyhttp.Config, error) {
+	var config lazyhttp.Config
+	if path == "" {
+		return config, fmt.Errorf("no config given, use -config or $LAZYHTTP_CONFIG")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return config, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&config); err != nil {
+		return config, fmt.Errorf("error decode config %s: %v", path, err)
+	}
+	return config, nil
+}
@@ -0,0 +1,72 @@
+package lazyhttp
+
+import (
+	"context"
+	"net/http"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	requestStateKey
+	cacheKeyKey
+	strategyKey
+	upstreamKey
+	tagsKey
+)
+
+// RequestIDHeader is the header checked for a request ID when none is set on the context
+const RequestIDHeader = "X-Request-Id"
+
+// WithRequestID returns a copy of ctx carrying id, it is added to every log entry of the request
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestIDFromContext returns the request ID stored by WithRequestID
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// requestID looks up the request ID on the context first, then on the outgoing headers
+func requestID(ctx context.Context, header map[string]string) string {
+	if id := RequestIDFromContext(ctx); id != "" {
+		return id
+	}
+	for k, v := range header {
+		if http.CanonicalHeaderKey(k) == RequestIDHeader {
+			return v
+		}
+	}
+	return ""
+}
+
+// WithCacheKey returns a copy of ctx selecting the cache key of a request sent through Transport
+func WithCacheKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, cacheKeyKey, key)
+}
+
+// WithStrategy returns a copy of ctx selecting the strategy of a request sent through Transport
+func WithStrategy(ctx context.Context, strategy Strategy) context.Context {
+	return context.WithValue(ctx, strategyKey, strategy)
+}
+
+// WithTags returns a copy of ctx selecting the tags of a request sent through Transport
+func WithTags(ctx context.Context, tags ...string) context.Context {
+	return context.WithValue(ctx, tagsKey, tags)
+}
+
+// withUpstream makes the HTTP leg of the request use client instead of Client.HTTPClient
+func withUpstream(ctx context.Context, client *http.Client) context.Context {
+	return context.WithValue(ctx, upstreamKey, client)
+}
+
+// upstreamClient returns the client the HTTP leg of the request in ctx goes through
+func (httprequest *Client) upstreamClient(ctx context.Context) *http.Client {
+	if client, ok := ctx.Value(upstreamKey).(*http.Client); ok {
+		return client
+	}
+	return httprequest.HTTPClient
+}
@@ -0,0 +1,26 @@
+package lazyhttp
+
+import (
+	"time"
+
+	"github.com/dendhi31/lazyhttp/cache/disk"
+)
+
+// DiskOptions stores the responses in a local file instead of redis, see the cache/disk package
+type DiskOptions struct {
+	// Path enables the disk storage, StorageHostServer and StorageRedis are ignored then.
+	// Without RedisHost the refresh jobs and invalidations stay in the process as well.
+	Path string
+	// MaxSize caps the stored bytes, 0 is unbounded. Expired entries are evicted first, then the least recently written.
+	MaxSize int64
+	// CompactInterval is how often expired entries are removed in milliseconds, default is 1 minute
+	CompactInterval time.Duration
+}
+
+// Options returns the disk package options
+func (o DiskOptions) Options() disk.Options {
+	return disk.Options{
+		MaxSize:         o.MaxSize,
+		CompactInterval: o.CompactInterval * time.Millisecond,
+	}
+}
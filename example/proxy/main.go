@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/dendhi31/lazyhttp"
+	"github.com/dendhi31/lazyhttp/proxy"
+)
+
+func main() {
+	httpReq, err := lazyhttp.New(lazyhttp.Config{
+		ExpiryTime:         600000, //In MiliSecond
+		HTTPRequestTimeout: 10000,  //In MiliSecond
+		WaitHttp:           1000,   //In MiliSecond
+		StorageHostServer:  []string{"localhost:6379"},
+		Channel:            "first",
+		RedisHost:          "localhost:6379",
+		Debug:              true,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	target, err := url.Parse("http://localhost:9096")
+	if err != nil {
+		log.Fatal(err)
+	}
+	handler := proxy.New(httpReq, target,
+		proxy.Route{Prefix: "/foo", Cacheable: true},
+		proxy.Route{Prefix: "/bar", Cacheable: true, Strategy: lazyhttp.StrategyOptimistic},
+	)
+	log.Fatal(http.ListenAndServe(":8080", handler))
+}
@@ -0,0 +1,340 @@
+package lazyhttp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// FixtureMode selects whether the upstream responses are recorded or replayed
+type FixtureMode string
+
+const (
+	// FixturesOff sends the requests to the upstream
+	FixturesOff FixtureMode = ""
+	// FixturesRecord sends the requests to the upstream and writes the exchanges to the fixture files
+	FixturesRecord FixtureMode = "record"
+	// FixturesReplay answers from the fixture files only, the upstream is never called
+	FixturesReplay FixtureMode = "replay"
+)
+
+// FixtureOptions enables record or replay of the upstream responses
+type FixtureOptions struct {
+	Mode FixtureMode
+	// Dir holds one file per cache key, it is created when recording
+	Dir string
+	// Match selects what else than the cache key a request must share with a recorded one
+	Match MatchRules
+}
+
+// MatchRules lists the request fields compared when looking for a recorded exchange,
+// the cache key is always compared. An exchange recorded again replaces the one it matches.
+type MatchRules struct {
+	Method bool
+	URL    bool
+	Body   bool
+	// Headers are the request headers whose values must be equal, they are the only request headers
+	// recorded, so credentials like Authorization or Cookie stay out of the fixtures
+	Headers []string
+}
+
+// UnmatchedError is returned in replay mode for a request no fixture matches
+type UnmatchedError struct {
+	Key    string
+	Method string
+	URL    string
+}
+
+func (e *UnmatchedError) Error() string {
+	return fmt.Sprintf("no fixture for %s %s under key %q", e.Method, e.URL, e.Key)
+}
+
+// Fixtures records the upstream exchanges to files and replays them
+type Fixtures struct {
+	options FixtureOptions
+
+	mu        sync.Mutex
+	unmatched []*UnmatchedError
+}
+
+// fixtureFile is the content of a fixture file, the exchanges recorded under a cache key
+type fixtureFile struct {
+	Key       string     `json:"key"`
+	Exchanges []exchange `json:"exchanges"`
+}
+
+type exchange struct {
+	Method     string            `json:"method"`
+	URL        string            `json:"url"`
+	Header     map[string]string `json:"header,omitempty"`
+	Body       fixtureBody       `json:"body,omitempty"`
+	RecordedAt time.Time         `json:"recorded_at"`
+	Response   struct {
+		StatusCode int         `json:"status_code"`
+		Header     http.Header `json:"header,omitempty"`
+		Body       fixtureBody `json:"body,omitempty"`
+	} `json:"response"`
+}
+
+// fixtureBody is written as a string when it is valid UTF-8, so fixtures stay readable and editable,
+// and as base64 bytes otherwise
+type fixtureBody []byte
+
+func (b fixtureBody) MarshalJSON() ([]byte, error) {
+	if utf8.Valid(b) {
+		return json.Marshal(string(b))
+	}
+	return json.Marshal(struct {
+		Base64 []byte `json:"base64"`
+	}{b})
+}
+
+func (b *fixtureBody) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*b = fixtureBody(text)
+		return nil
+	}
+	var encoded struct {
+		Base64 []byte `json:"base64"`
+	}
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	*b = encoded.Base64
+	return nil
+}
+
+// NewFixtures checks options, a nil Fixtures is returned when Mode is FixturesOff
+func NewFixtures(options FixtureOptions) (*Fixtures, error) {
+	switch options.Mode {
+	case FixturesOff:
+		return nil, nil
+	case FixturesRecord:
+		if options.Dir == "" {
+			return nil, errors.New("fixture dir is required")
+		}
+		if err := os.MkdirAll(options.Dir, 0755); err != nil {
+			return nil, err
+		}
+	case FixturesReplay:
+		if _, err := os.Stat(options.Dir); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown fixture mode %q", options.Mode)
+	}
+	return &Fixtures{options: options}, nil
+}
+
+// Mode returns the mode of f
+func (f *Fixtures) Mode() FixtureMode {
+	return f.options.Mode
+}
+
+// Unmatched returns the requests replay found no fixture for, each was also returned to its caller
+func (f *Fixtures) Unmatched() []*UnmatchedError {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*UnmatchedError(nil), f.unmatched...)
+}
+
+// Path returns the fixture file of key
+func (f *Fixtures) Path(key string) string {
+	return filepath.Join(f.options.Dir, fixtureName(key)+".json")
+}
+
+// fixtureName returns key when it is a safe file name, otherwise its safe characters
+// followed by a hash of key, so distinct keys never share a file
+func fixtureName(key string) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, key)
+	if safe == key && len(key) <= 100 && !strings.HasPrefix(key, ".") {
+		return key
+	}
+	if len(safe) > 100 {
+		safe = safe[:100]
+	}
+	sum := sha256.Sum256([]byte(key))
+	return safe + "-" + hex.EncodeToString(sum[:4])
+}
+
+// send sends req to client or the fixtures, depending on the mode.
+// A recorded body is read up to maxBodySize bytes, like the one of an upstream.
+func (f *Fixtures) send(client *http.Client, key string, req *http.Request, maxBodySize int64) (*http.Response, error) {
+	ex, err := f.newExchange(req)
+	if err != nil {
+		return nil, err
+	}
+	if f.options.Mode == FixturesReplay {
+		return f.replay(key, req, ex)
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := readBody(response, maxBodySize)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	ex.RecordedAt = time.Now()
+	ex.Response.StatusCode = response.StatusCode
+	// the session cookies the upstream hands out are not written to the fixtures
+	ex.Response.Header = response.Header.Clone()
+	ex.Response.Header.Del("Set-Cookie")
+	ex.Response.Body = body
+	if err := f.record(key, ex); err != nil {
+		return nil, fmt.Errorf("error record fixture %s: %v", key, err)
+	}
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	return response, nil
+}
+
+// newExchange copies the request fields of req, its body is left readable.
+// Only the headers of the match rules are copied.
+func (f *Fixtures) newExchange(req *http.Request) (exchange, error) {
+	ex := exchange{Method: req.Method, URL: req.URL.String()}
+	for _, name := range f.options.Match.Headers {
+		name = http.CanonicalHeaderKey(name)
+		if _, ok := req.Header[name]; !ok {
+			continue
+		}
+		if ex.Header == nil {
+			ex.Header = make(map[string]string, len(f.options.Match.Headers))
+		}
+		ex.Header[name] = req.Header.Get(name)
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return ex, err
+		}
+		defer body.Close()
+		if ex.Body, err = io.ReadAll(body); err != nil {
+			return ex, err
+		}
+	}
+	return ex, nil
+}
+
+func (f *Fixtures) replay(key string, req *http.Request, ex exchange) (*http.Response, error) {
+	file, err := f.read(key)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error read fixture %s: %v", key, err)
+	}
+	for _, recorded := range file.Exchanges {
+		if f.matches(recorded, ex) {
+			header := recorded.Response.Header.Clone()
+			if header == nil {
+				header = http.Header{}
+			}
+			return &http.Response{
+				Status:        fmt.Sprintf("%d %s", recorded.Response.StatusCode, http.StatusText(recorded.Response.StatusCode)),
+				StatusCode:    recorded.Response.StatusCode,
+				Proto:         "HTTP/1.1",
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Header:        header,
+				Body:          io.NopCloser(bytes.NewReader(recorded.Response.Body)),
+				ContentLength: int64(len(recorded.Response.Body)),
+				Request:       req,
+			}, nil
+		}
+	}
+	unmatched := &UnmatchedError{Key: key, Method: ex.Method, URL: ex.URL}
+	f.mu.Lock()
+	f.unmatched = append(f.unmatched, unmatched)
+	f.mu.Unlock()
+	return nil, unmatched
+}
+
+// record replaces the exchange matching ex in the file of key, or adds ex
+func (f *Fixtures) record(key string, ex exchange) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := f.read(key)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	file.Key = key
+	replaced := false
+	for i, recorded := range file.Exchanges {
+		if f.matches(recorded, ex) {
+			file.Exchanges[i] = ex
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		file.Exchanges = append(file.Exchanges, ex)
+	}
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	// written aside and renamed, so a replay never reads half a file
+	tmp, err := os.CreateTemp(f.options.Dir, ".fixture-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path(key))
+}
+
+func (f *Fixtures) read(key string) (fixtureFile, error) {
+	var file fixtureFile
+	data, err := os.ReadFile(f.Path(key))
+	if err != nil {
+		return file, err
+	}
+	err = json.Unmarshal(data, &file)
+	return file, err
+}
+
+// matches compares the request fields selected by the match rules
+func (f *Fixtures) matches(recorded, ex exchange) bool {
+	rules := f.options.Match
+	if rules.Method && recorded.Method != ex.Method {
+		return false
+	}
+	if rules.URL && recorded.URL != ex.URL {
+		return false
+	}
+	if rules.Body && !bytes.Equal(recorded.Body, ex.Body) {
+		return false
+	}
+	for _, name := range rules.Headers {
+		name = http.CanonicalHeaderKey(name)
+		if recorded.Header[name] != ex.Header[name] {
+			return false
+		}
+	}
+	return true
+}
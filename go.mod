@@ -1,17 +1,33 @@
 module github.com/dendhi31/lazyhttp
 
-go 1.12
+go 1.21
 
 require (
-	github.com/dendhi31/redismaint v0.0.0-20191002083918-8085b51094ed
 	github.com/go-redis/redis v6.15.7+incompatible
-	github.com/gomodule/redigo v2.0.0+incompatible
-	github.com/onsi/ginkgo v1.12.0 // indirect
-	github.com/onsi/gomega v1.9.0 // indirect
+	github.com/klauspost/compress v1.17.9
 	github.com/pkg/errors v0.9.1
-	github.com/sirupsen/logrus v1.4.2 // indirect
-	github.com/syariatifaris/arkeus v0.0.0-20180613183514-0880c3780042 // indirect
-	github.com/syariatifaris/redismaint v0.0.0-20191002083918-8085b51094ed // indirect
-	golang.org/x/net v0.0.0-20200202094626-16171245cfb2
-	golang.org/x/tools v0.0.0-20200220224806-8a925fa4c0df
+	github.com/prometheus/client_golang v1.20.5
+	github.com/redis/go-redis/v9 v9.7.3
+	github.com/sirupsen/logrus v1.9.3
+	go.etcd.io/bbolt v1.3.10
+	go.opentelemetry.io/otel v1.28.0
+	go.opentelemetry.io/otel/trace v1.28.0
+	go.uber.org/zap v1.27.0
+	golang.org/x/net v0.26.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.55.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
+	go.opentelemetry.io/otel/metric v1.28.0 // indirect
+	go.uber.org/multierr v1.10.0 // indirect
+	golang.org/x/sys v0.22.0 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
 )
@@ -0,0 +1,193 @@
+package lazyhttp
+
+import (
+	"context"
+	"time"
+)
+
+// Hooks receives the client lifecycle events, use it for auditing, custom metrics or alerting.
+// Hooks are called synchronously on the request path, so they should return quickly.
+// Embed NopHooks to implement only the events you need, or use HookFuncs.
+type Hooks interface {
+	// BeforeRequest is called when Do or SendRequest starts
+	BeforeRequest(ctx context.Context, event *RequestEvent)
+	// AfterResponse is called when Do or SendRequest returns
+	AfterResponse(ctx context.Context, event *ResponseEvent)
+	// StaleServed is called when a cached value is returned instead of a live response
+	StaleServed(ctx context.Context, event *StaleEvent)
+	// UpstreamFailed is called when the upstream errors, times out or answers with a non 200 status
+	UpstreamFailed(ctx context.Context, event *UpstreamFailureEvent)
+	// RefreshPublished is called after a refresh job publish attempt, Err is set when it failed
+	RefreshPublished(ctx context.Context, event *RefreshEvent)
+	// CacheWriteFailed is called when a response could not be stored
+	CacheWriteFailed(ctx context.Context, event *CacheWriteEvent)
+}
+
+// RequestEvent describes the request an event belongs to
+type RequestEvent struct {
+	RequestID string
+	URL       string
+	Method    string
+	Header    map[string]string
+	Payload   []byte
+	Key       string
+	Tags      []string
+	UseCache  bool
+	StartedAt time.Time
+}
+
+// ResponseEvent is passed to Hooks.AfterResponse
+type ResponseEvent struct {
+	Request    *RequestEvent
+	StatusCode int
+	Body       []byte
+	Outcome    Outcome
+	// Age is the age of the served cache entry, -1 when it is unknown or the response is live
+	Age      time.Duration
+	Duration time.Duration
+	Err      error
+}
+
+// StaleEvent is passed to Hooks.StaleServed
+type StaleEvent struct {
+	Request *RequestEvent
+	// Outcome is OutcomeCacheHit or OutcomeFallbackHit
+	Outcome  Outcome
+	StoredAt time.Time
+	// Age is -1 when the entry was stored without a timestamp
+	Age time.Duration
+	// UpstreamErr is the upstream failure that caused a fallback, nil on a cache hit
+	UpstreamErr error
+}
+
+// UpstreamFailureEvent is passed to Hooks.UpstreamFailed
+type UpstreamFailureEvent struct {
+	Request *RequestEvent
+	// StatusCode is set when the upstream answered with a non 200 status
+	StatusCode int
+	Err        error
+	Duration   time.Duration
+}
+
+// RefreshEvent is passed to Hooks.RefreshPublished
+type RefreshEvent struct {
+	Request *RequestEvent
+	Channel string
+	Err     error
+}
+
+// CacheWriteEvent is passed to Hooks.CacheWriteFailed
+type CacheWriteEvent struct {
+	Request *RequestEvent
+	Key     string
+	Size    int
+	TTL     time.Duration
+	Err     error
+}
+
+// NopHooks implements Hooks doing nothing
+type NopHooks struct{}
+
+func (NopHooks) BeforeRequest(ctx context.Context, event *RequestEvent)          {}
+func (NopHooks) AfterResponse(ctx context.Context, event *ResponseEvent)         {}
+func (NopHooks) StaleServed(ctx context.Context, event *StaleEvent)              {}
+func (NopHooks) UpstreamFailed(ctx context.Context, event *UpstreamFailureEvent) {}
+func (NopHooks) RefreshPublished(ctx context.Context, event *RefreshEvent)       {}
+func (NopHooks) CacheWriteFailed(ctx context.Context, event *CacheWriteEvent)    {}
+
+// HookFuncs implements Hooks with optional callbacks, nil callbacks are skipped
+type HookFuncs struct {
+	OnBeforeRequest    func(ctx context.Context, event *RequestEvent)
+	OnAfterResponse    func(ctx context.Context, event *ResponseEvent)
+	OnStaleServed      func(ctx context.Context, event *StaleEvent)
+	OnUpstreamFailed   func(ctx context.Context, event *UpstreamFailureEvent)
+	OnRefreshPublished func(ctx context.Context, event *RefreshEvent)
+	OnCacheWriteFailed func(ctx context.Context, event *CacheWriteEvent)
+}
+
+func (h HookFuncs) BeforeRequest(ctx context.Context, event *RequestEvent) {
+	if h.OnBeforeRequest != nil {
+		h.OnBeforeRequest(ctx, event)
+	}
+}
+
+func (h HookFuncs) AfterResponse(ctx context.Context, event *ResponseEvent) {
+	if h.OnAfterResponse != nil {
+		h.OnAfterResponse(ctx, event)
+	}
+}
+
+func (h HookFuncs) StaleServed(ctx context.Context, event *StaleEvent) {
+	if h.OnStaleServed != nil {
+		h.OnStaleServed(ctx, event)
+	}
+}
+
+func (h HookFuncs) UpstreamFailed(ctx context.Context, event *UpstreamFailureEvent) {
+	if h.OnUpstreamFailed != nil {
+		h.OnUpstreamFailed(ctx, event)
+	}
+}
+
+func (h HookFuncs) RefreshPublished(ctx context.Context, event *RefreshEvent) {
+	if h.OnRefreshPublished != nil {
+		h.OnRefreshPublished(ctx, event)
+	}
+}
+
+func (h HookFuncs) CacheWriteFailed(ctx context.Context, event *CacheWriteEvent) {
+	if h.OnCacheWriteFailed != nil {
+		h.OnCacheWriteFailed(ctx, event)
+	}
+}
+
+// requestState collects what the request path learnt, so Do can report it
+type requestState struct {
+	event   *RequestEvent
+	outcome Outcome
+	age     time.Duration
+}
+
+func withRequestState(ctx context.Context, event *RequestEvent) (context.Context, *requestState) {
+	state := &requestState{event: event, age: -1}
+	return context.WithValue(ctx, requestStateKey, state), state
+}
+
+// recordOutcome stores how the request was served on the request state and span found in ctx
+func recordOutcome(ctx context.Context, outcome Outcome, age time.Duration) {
+	if state, ok := ctx.Value(requestStateKey).(*requestState); ok {
+		state.outcome = outcome
+		state.age = age
+	}
+	setOutcome(ctx, outcome, age)
+}
+
+func (httprequest *Client) hooks() Hooks {
+	if httprequest.Hooks == nil {
+		return NopHooks{}
+	}
+	return httprequest.Hooks
+}
+
+// requestEventFrom returns the event created by Do, or a new one for
+// requests entering elsewhere such as the consumer
+func requestEventFrom(ctx context.Context, req *Request) *RequestEvent {
+	if state, ok := ctx.Value(requestStateKey).(*requestState); ok && state.event != nil {
+		return state.event
+	}
+	return newRequestEvent(ctx, req)
+}
+
+func newRequestEvent(ctx context.Context, req *Request) *RequestEvent {
+	return &RequestEvent{
+		RequestID: requestID(ctx, req.Header),
+		URL:       req.URL,
+		Method:    req.Method,
+		Header:    req.Header,
+		Payload:   req.Body,
+		Key:       req.Key,
+		Tags:      req.Tags,
+		UseCache:  req.UseCache,
+		StartedAt: time.Now(),
+	}
+}
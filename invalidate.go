@@ -0,0 +1,159 @@
+package lazyhttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dendhi31/lazyhttp/cache"
+	"github.com/dendhi31/lazyhttp/logger"
+)
+
+// TagKeyPrefix prefixes the redis sets holding the keys of a tag
+const TagKeyPrefix = "lazyhttp-tag:"
+
+// tagExpiryMargin keeps a tag set a little longer than the entries written after it
+const tagExpiryMargin = time.Minute
+
+// TagKey returns the redis set holding the keys tagged with tag, before TempStorageKeyPrefix
+func TagKey(tag string) string {
+	return TagKeyPrefix + tag
+}
+
+// Invalidate removes the cached responses of keys, so the next request goes to the upstream
+func (httprequest *Client) Invalidate(ctx context.Context, keys ...string) error {
+	_, err := httprequest.InvalidateKeys(ctx, keys...)
+	return err
+}
+
+// InvalidateKeys is Invalidate returning how many of keys were cached and removed
+func (httprequest *Client) InvalidateKeys(ctx context.Context, keys ...string) (int, error) {
+	var removed int
+	for _, key := range keys {
+		ok, err := httprequest.CacheClient.Exists(ctx, key)
+		if err == nil && ok {
+			err = httprequest.remove(ctx, key)
+		}
+		if err != nil {
+			return removed, fmt.Errorf("error invalidate %s: %v", key, err)
+		}
+		if ok {
+			removed++
+			httprequest.Logger.Debug("cache entry invalidated", logger.KeyCacheKey, key)
+		}
+	}
+	// the local copies of other instances may outlive the shared entry, they are dropped anyway
+	httprequest.invalidateLocal(ctx, keys, nil)
+	return removed, nil
+}
+
+// InvalidateTags removes the cached responses stored with any of tags, and returns how many keys were removed.
+// Keys are removed one by one, so it works on a cluster where they live in different slots.
+func (httprequest *Client) InvalidateTags(ctx context.Context, tags ...string) (int, error) {
+	tagger, err := httprequest.tagger()
+	if err != nil {
+		return 0, err
+	}
+	var removed int
+	for _, tag := range tags {
+		keys, err := tagger.SMembers(ctx, TagKey(tag))
+		if err != nil {
+			return removed, fmt.Errorf("error read tag %s: %v", tag, err)
+		}
+		for _, key := range keys {
+			if err := ctx.Err(); err != nil {
+				return removed, err
+			}
+			if err := httprequest.remove(ctx, key); err != nil {
+				return removed, fmt.Errorf("error invalidate %s: %v", key, err)
+			}
+			removed++
+		}
+		httprequest.invalidateLocal(ctx, keys, nil)
+		// the set goes last, so a failed run can be retried
+		if err := httprequest.CacheClient.Remove(ctx, TagKey(tag)); err != nil {
+			return removed, fmt.Errorf("error remove tag %s: %v", tag, err)
+		}
+		httprequest.Logger.Debug("cache tag invalidated", "tag", tag, "keys", len(keys))
+	}
+	return removed, nil
+}
+
+// InvalidatePrefix removes the cached responses whose key starts with prefix, and returns how many keys were removed.
+// Every node of a cluster is scanned and keys are removed one by one, the chunks of chunked entries match
+// the prefix as well and are counted. It returns cache.ErrUnsupported when the cache cannot list its keys.
+func (httprequest *Client) InvalidatePrefix(ctx context.Context, prefix string) (int, error) {
+	scanner, ok := httprequest.CacheClient.(cache.Scanner)
+	if !ok {
+		return 0, cache.ErrUnsupported
+	}
+	var removed int
+	err := scanner.Scan(ctx, cache.EscapeGlob(prefix)+"*", func(key string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := httprequest.CacheClient.Remove(ctx, key); err != nil {
+			return fmt.Errorf("error invalidate %s: %v", key, err)
+		}
+		removed++
+		return nil
+	})
+	httprequest.invalidateLocal(ctx, nil, []string{prefix})
+	httprequest.Logger.Debug("cache prefix invalidated", "prefix", prefix, "keys", removed)
+	return removed, err
+}
+
+// remove removes key. With chunking enabled, the chunks of a chunked entry expire after the chunking grace,
+// otherwise they expire with the entry ttl.
+func (httprequest *Client) remove(ctx context.Context, key string) error {
+	var value string
+	if httprequest.Chunking.Enabled() {
+		var err error
+		value, err = httprequest.CacheClient.Get(ctx, key)
+		if err != nil && !errors.Is(err, cache.ErrNotFound) {
+			return err
+		}
+	}
+	if err := httprequest.CacheClient.Remove(ctx, key); err != nil {
+		return err
+	}
+	if cache.IsManifest(value) {
+		if entry, err := cache.ParseManifest(value); err == nil {
+			entry.Release(ctx, httprequest.CacheClient, key, httprequest.Chunking.Grace)
+		}
+	}
+	return nil
+}
+
+// tag adds key to the set of every tag. The sets expire with the entries they list,
+// every write pushes their expiry past the entry ttl so a set outlives its keys.
+// Without ExpiryTime the entries and the sets never expire.
+func (httprequest *Client) tag(ctx context.Context, key string, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	tagger, err := httprequest.tagger()
+	if err != nil {
+		return err
+	}
+	var ttl time.Duration
+	if httprequest.ExpiryTime > 0 {
+		ttl = httprequest.ExpiryTime*time.Millisecond + tagExpiryMargin
+	}
+	for _, tag := range tags {
+		if err := tagger.SAdd(ctx, TagKey(tag), ttl, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tagger returns the cache sets, cache.ErrUnsupported when the cache keeps none
+func (httprequest *Client) tagger() (cache.Tagger, error) {
+	tagger, ok := httprequest.CacheClient.(cache.Tagger)
+	if !ok {
+		return nil, cache.ErrUnsupported
+	}
+	return tagger, nil
+}
@@ -0,0 +1,52 @@
+package lazyhttp_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dendhi31/lazyhttp"
+	"github.com/dendhi31/lazyhttp/lazyhttptest"
+	"github.com/dendhi31/lazyhttp/logger"
+	"github.com/dendhi31/lazyhttp/memory"
+)
+
+func TestInvalidateTagsWithoutExpiry(t *testing.T) {
+	ctx := context.Background()
+	upstream := lazyhttptest.NewUpstream(nil)
+	defer upstream.Close()
+	clock := lazyhttptest.NewClock(time.Time{})
+	store := memory.New(memory.Options{Now: clock.Now})
+	client, err := lazyhttp.New(lazyhttp.Config{WaitHttp: 200, WaitRedis: 50, MainTimeout: 500, HTTPRequestTimeout: 200},
+		lazyhttp.WithCacher(store), lazyhttp.WithPublisher(memory.NewQueue(memory.Options{})),
+		lazyhttp.WithClock(clock.Now), lazyhttp.WithLogger(logger.Nop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	req := &lazyhttp.Request{URL: upstream.URL + "/a", Method: "GET", Key: "a", Tags: []string{"list"}}
+	if _, err := client.Do(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if ok, _ := store.Exists(ctx, "a"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("a was not stored")
+		}
+	}
+	if ttl, _ := store.TTL(ctx, lazyhttp.TagKey("list")); ttl != 0 {
+		t.Errorf("tag set ttl %s, want none like the entry", ttl)
+	}
+
+	clock.Advance(24 * time.Hour)
+	n, err := client.InvalidateTags(ctx, "list")
+	if err != nil || n != 1 {
+		t.Errorf("InvalidateTags = %d, %v, want the entry tagged a day ago", n, err)
+	}
+	if ok, _ := store.Exists(ctx, "a"); ok {
+		t.Error("a is still cached")
+	}
+}
@@ -0,0 +1,116 @@
+package lazyhttp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+
+	"github.com/dendhi31/lazyhttp/logger"
+)
+
+// DefaultInvalidationChannel is the control channel used when Config.InvalidationChannel is empty
+const DefaultInvalidationChannel = "lazyhttp-invalidation"
+
+// invalidation is the message broadcast on the control channel when cache entries change.
+// Tags are resolved to keys by the sender, since local copies do not know their tags.
+type invalidation struct {
+	Origin   string   `json:"origin"`
+	Keys     []string `json:"keys,omitempty"`
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+// startInvalidationBus subscribes to the control channel and evicts the local copies
+// other instances invalidate. Missed messages are covered by the local ttl.
+func (httprequest *Client) startInvalidationBus() error {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	httprequest.instanceID = hex.EncodeToString(id)
+
+	sub, err := httprequest.PubsubClient.Subscribe(context.Background(), httprequest.InvalidationChannel)
+	if err != nil {
+		return err
+	}
+
+	httprequest.busStop = make(chan struct{})
+	httprequest.busDone = make(chan struct{})
+	messages := sub.Channel()
+	go func() {
+		defer close(httprequest.busDone)
+		defer sub.Close()
+		for {
+			select {
+			case <-httprequest.busStop:
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				httprequest.applyInvalidation(msg.Payload)
+			}
+		}
+	}()
+	return nil
+}
+
+func (httprequest *Client) applyInvalidation(payload string) {
+	var event invalidation
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		httprequest.Logger.Warn("unable to decode invalidation", logger.KeyError, err)
+		return
+	}
+	if event.Origin == httprequest.instanceID {
+		return
+	}
+	httprequest.local.delete(event.Keys...)
+	for _, prefix := range event.Prefixes {
+		httprequest.local.deletePrefix(prefix)
+	}
+	httprequest.Logger.Debug("local cache invalidated", "keys", len(event.Keys), "prefixes", len(event.Prefixes))
+}
+
+// invalidateLocal evicts the local copies of keys and prefixes, and tells the other instances to do the same
+func (httprequest *Client) invalidateLocal(ctx context.Context, keys []string, prefixes []string) {
+	if httprequest.local == nil || (len(keys) == 0 && len(prefixes) == 0) {
+		return
+	}
+	httprequest.local.delete(keys...)
+	for _, prefix := range prefixes {
+		httprequest.local.deletePrefix(prefix)
+	}
+	message, err := json.Marshal(invalidation{
+		Origin:   httprequest.instanceID,
+		Keys:     keys,
+		Prefixes: prefixes,
+	})
+	if err == nil {
+		err = httprequest.PubsubClient.Publish(ctx, httprequest.InvalidationChannel, message)
+	}
+	if err != nil {
+		// the other instances catch up when their local copies expire
+		httprequest.Logger.Warn("unable to publish invalidation", "channel", httprequest.InvalidationChannel, logger.KeyError, err)
+	}
+}
+
+// Close stops the invalidation subscriber and closes the redis connections of the client
+func (httprequest *Client) Close() error {
+	var err error
+	httprequest.closeOnce.Do(func() {
+		if httprequest.busStop != nil {
+			close(httprequest.busStop)
+			<-httprequest.busDone
+		}
+		if c, ok := httprequest.PubsubClient.(io.Closer); ok {
+			err = c.Close()
+		}
+		if c, ok := httprequest.CacheClient.(io.Closer); ok {
+			if cerr := c.Close(); cerr != nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
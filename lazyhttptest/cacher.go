@@ -0,0 +1,247 @@
+package lazyhttptest
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/dendhi31/lazyhttp/cache"
+	"github.com/dendhi31/lazyhttp/redis"
+)
+
+// Cacher is a cache.ContextCacher in front of another one, whose calls can be faulted and are counted.
+// Faults are set per operation, named after the ContextCacher method like "Get" or "MGet".
+// The optional operations, like Ping or SAdd, return cache.ErrUnsupported when next has none.
+type Cacher struct {
+	next   cache.ContextCacher
+	faults *faults
+}
+
+var (
+	_ cache.ContextCacher     = (*Cacher)(nil)
+	_ cache.Pinger            = (*Cacher)(nil)
+	_ cache.Lister            = (*Cacher)(nil)
+	_ cache.Tagger            = (*Cacher)(nil)
+	_ cache.Scanner           = (*Cacher)(nil)
+	_ cache.PatternSubscriber = (*Cacher)(nil)
+)
+
+// NewCacher returns a Cacher passing the calls to next, memory.New is a good next
+func NewCacher(next cache.ContextCacher) *Cacher {
+	return &Cacher{next: next, faults: newFaults()}
+}
+
+// SetFault applies fault to every operation
+func (c *Cacher) SetFault(fault Fault) {
+	c.faults.set("", fault)
+}
+
+// SetOpFault applies fault to the calls of op, before the fault of SetFault
+func (c *Cacher) SetOpFault(op string, fault Fault) {
+	c.faults.set(op, fault)
+}
+
+// ClearFaults lets every call through again
+func (c *Cacher) ClearFaults() {
+	c.faults.clear()
+}
+
+// Calls returns the number of calls to op, every call when op is empty
+func (c *Cacher) Calls(op string) int {
+	return c.faults.count(op)
+}
+
+// ResetCalls sets the counts back to 0
+func (c *Cacher) ResetCalls() {
+	c.faults.reset()
+}
+
+// Next returns the ContextCacher the calls are passed to
+func (c *Cacher) Next() cache.ContextCacher {
+	return c.next
+}
+
+// inject counts a call to op and applies its fault
+func (c *Cacher) inject(ctx context.Context, op string) (Fault, error) {
+	fault := c.faults.take(op)
+	if err := fault.wait(ctx); err != nil {
+		return fault, err
+	}
+	return fault, fault.Err
+}
+
+func half(value string) string {
+	return value[:len(value)/2]
+}
+
+// SetPrefix is passed through, it is not faulted
+func (c *Cacher) SetPrefix(prefix string) {
+	c.next.SetPrefix(prefix)
+}
+
+func (c *Cacher) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	if _, err := c.inject(ctx, "Set"); err != nil {
+		return err
+	}
+	return c.next.Set(ctx, key, value, ttl)
+}
+
+func (c *Cacher) Get(ctx context.Context, key string) (string, error) {
+	fault, err := c.inject(ctx, "Get")
+	if err != nil {
+		return "", err
+	}
+	value, err := c.next.Get(ctx, key)
+	if err == nil && fault.PartialBody {
+		value = half(value)
+	}
+	return value, err
+}
+
+func (c *Cacher) MGet(ctx context.Context, keys ...string) (map[string]string, error) {
+	fault, err := c.inject(ctx, "MGet")
+	if err != nil {
+		return nil, err
+	}
+	values, err := c.next.MGet(ctx, keys...)
+	if err == nil && fault.PartialBody {
+		for key, value := range values {
+			values[key] = half(value)
+		}
+	}
+	return values, err
+}
+
+func (c *Cacher) MSet(ctx context.Context, values map[string]interface{}, ttl time.Duration) error {
+	if _, err := c.inject(ctx, "MSet"); err != nil {
+		return err
+	}
+	return c.next.MSet(ctx, values, ttl)
+}
+
+func (c *Cacher) Remove(ctx context.Context, key string) error {
+	if _, err := c.inject(ctx, "Remove"); err != nil {
+		return err
+	}
+	return c.next.Remove(ctx, key)
+}
+
+func (c *Cacher) Exists(ctx context.Context, key string) (bool, error) {
+	if _, err := c.inject(ctx, "Exists"); err != nil {
+		return false, err
+	}
+	return c.next.Exists(ctx, key)
+}
+
+func (c *Cacher) TTL(ctx context.Context, key string) (time.Duration, error) {
+	if _, err := c.inject(ctx, "TTL"); err != nil {
+		return 0, err
+	}
+	return c.next.TTL(ctx, key)
+}
+
+func (c *Cacher) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	if _, err := c.inject(ctx, "Expire"); err != nil {
+		return err
+	}
+	return c.next.Expire(ctx, key, ttl)
+}
+
+func (c *Cacher) Publish(ctx context.Context, channel string, value interface{}) error {
+	if _, err := c.inject(ctx, "Publish"); err != nil {
+		return err
+	}
+	return c.next.Publish(ctx, channel, value)
+}
+
+func (c *Cacher) Subscribe(ctx context.Context, channels ...string) (redis.Subscription, error) {
+	if _, err := c.inject(ctx, "Subscribe"); err != nil {
+		return nil, err
+	}
+	return c.next.Subscribe(ctx, channels...)
+}
+
+func (c *Cacher) PSubscribe(ctx context.Context, patterns ...string) (redis.Subscription, error) {
+	next, ok := c.next.(cache.PatternSubscriber)
+	if !ok {
+		return nil, cache.ErrUnsupported
+	}
+	if _, err := c.inject(ctx, "PSubscribe"); err != nil {
+		return nil, err
+	}
+	return next.PSubscribe(ctx, patterns...)
+}
+
+func (c *Cacher) Ping(ctx context.Context) error {
+	next, ok := c.next.(cache.Pinger)
+	if !ok {
+		return cache.ErrUnsupported
+	}
+	if _, err := c.inject(ctx, "Ping"); err != nil {
+		return err
+	}
+	return next.Ping(ctx)
+}
+
+func (c *Cacher) LLen(ctx context.Context, key string) (int64, error) {
+	next, ok := c.next.(cache.Lister)
+	if !ok {
+		return 0, cache.ErrUnsupported
+	}
+	if _, err := c.inject(ctx, "LLen"); err != nil {
+		return 0, err
+	}
+	return next.LLen(ctx, key)
+}
+
+func (c *Cacher) SMembers(ctx context.Context, key string) ([]string, error) {
+	next, ok := c.next.(cache.Tagger)
+	if !ok {
+		return nil, cache.ErrUnsupported
+	}
+	if _, err := c.inject(ctx, "SMembers"); err != nil {
+		return nil, err
+	}
+	return next.SMembers(ctx, key)
+}
+
+func (c *Cacher) SAdd(ctx context.Context, key string, ttl time.Duration, members ...string) error {
+	next, ok := c.next.(cache.Tagger)
+	if !ok {
+		return cache.ErrUnsupported
+	}
+	if _, err := c.inject(ctx, "SAdd"); err != nil {
+		return err
+	}
+	return next.SAdd(ctx, key, ttl, members...)
+}
+
+func (c *Cacher) Scan(ctx context.Context, pattern string, fn func(key string) error) error {
+	next, ok := c.next.(cache.Scanner)
+	if !ok {
+		return cache.ErrUnsupported
+	}
+	if _, err := c.inject(ctx, "Scan"); err != nil {
+		return err
+	}
+	return next.Scan(ctx, pattern, fn)
+}
+
+func (c *Cacher) PushCapped(ctx context.Context, key string, value interface{}, max int64) error {
+	next, ok := c.next.(cache.Lister)
+	if !ok {
+		return cache.ErrUnsupported
+	}
+	if _, err := c.inject(ctx, "PushCapped"); err != nil {
+		return err
+	}
+	return next.PushCapped(ctx, key, value, max)
+}
+
+// Close is passed through, it is not faulted
+func (c *Cacher) Close() error {
+	if next, ok := c.next.(io.Closer); ok {
+		return next.Close()
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Package lazyhttptest provides fault injection to check how a lazyhttp.Client falls back:
+// an upstream server and a Cacher whose calls can be delayed, failed or cut short,
+// a virtual clock, and a Harness wiring them to a client with assertion helpers.
+// Timeouts of the client run on the real time, so latency faults really wait.
+package lazyhttptest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrInjected is a ready-made error for Fault.Err
+var ErrInjected = errors.New("lazyhttptest: injected fault")
+
+// Fault describes how the next calls misbehave, the zero Fault lets them through
+type Fault struct {
+	// Latency delays the call. The delay ends early when the caller gives up.
+	Latency time.Duration
+	// Err fails the call: an upstream drops the connection without answering, a Cacher returns Err.
+	// Note net/http retries an idempotent request once when a reused connection drops.
+	Err error
+	// Status replaces the status an upstream answers with, the body is kept. A Cacher ignores it.
+	Status int
+	// PartialBody cuts the value in half: an upstream announces the full length and closes the
+	// connection halfway, a Cacher returns the first half of the values it reads
+	PartialBody bool
+	// Times limits the fault to the next Times calls, 0 is every call until it is cleared
+	Times int
+}
+
+// faults holds the fault of each target and counts the calls
+type faults struct {
+	mu     sync.Mutex
+	faults map[string]*Fault
+	calls  map[string]int
+}
+
+func newFaults() *faults {
+	return &faults{faults: make(map[string]*Fault), calls: make(map[string]int)}
+}
+
+func (f *faults) set(target string, fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults[target] = &fault
+}
+
+func (f *faults) clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = make(map[string]*Fault)
+}
+
+// take counts a call to target and returns the fault it gets, the one of target first,
+// then the one of every target ""
+func (f *faults) take(target string) Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[target]++
+	f.calls[""]++
+	for _, t := range []string{target, ""} {
+		fault, ok := f.faults[t]
+		if !ok {
+			continue
+		}
+		if fault.Times > 0 {
+			if fault.Times--; fault.Times == 0 {
+				delete(f.faults, t)
+			}
+		}
+		return *fault
+	}
+	return Fault{}
+}
+
+func (f *faults) count(target string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[target]
+}
+
+func (f *faults) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = make(map[string]int)
+}
+
+// wait sleeps for the latency of fault, or until ctx is done
+func (fault Fault) wait(ctx context.Context) error {
+	if fault.Latency <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(fault.Latency)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,204 @@
+package lazyhttptest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dendhi31/lazyhttp/cache"
+	"github.com/dendhi31/lazyhttp/memory"
+)
+
+func TestFaultTimes(t *testing.T) {
+	f := newFaults()
+	f.set("", Fault{Status: http.StatusBadGateway, Times: 2})
+
+	for i, want := range []int{http.StatusBadGateway, http.StatusBadGateway, 0, 0} {
+		if got := f.take("/a").Status; got != want {
+			t.Errorf("call %d: status %d, want %d", i+1, got, want)
+		}
+	}
+	if got := f.count("/a"); got != 4 {
+		t.Errorf("calls of /a = %d, want 4", got)
+	}
+	if got := f.count(""); got != 4 {
+		t.Errorf("calls = %d, want 4", got)
+	}
+}
+
+func TestFaultWithoutTimesStays(t *testing.T) {
+	f := newFaults()
+	f.set("", Fault{Err: ErrInjected})
+	for i := 0; i < 5; i++ {
+		if got := f.take("Get").Err; got != ErrInjected {
+			t.Fatalf("call %d: error %v, want %v", i+1, got, ErrInjected)
+		}
+	}
+	f.clear()
+	if got := f.take("Get"); got != (Fault{}) {
+		t.Errorf("fault after clear = %+v, want none", got)
+	}
+}
+
+func TestFaultTargetBeforeGlobal(t *testing.T) {
+	f := newFaults()
+	f.set("", Fault{Status: http.StatusBadGateway, Times: 1})
+	f.set("/a", Fault{Status: http.StatusServiceUnavailable, Times: 1})
+
+	if got := f.take("/a").Status; got != http.StatusServiceUnavailable {
+		t.Errorf("first /a: status %d, want %d", got, http.StatusServiceUnavailable)
+	}
+	// the target fault was used, the global one was not consumed by it
+	if got := f.take("/a").Status; got != http.StatusBadGateway {
+		t.Errorf("second /a: status %d, want %d", got, http.StatusBadGateway)
+	}
+	if got := f.take("/b").Status; got != 0 {
+		t.Errorf("/b: status %d, want none", got)
+	}
+}
+
+func TestUpstreamPathFault(t *testing.T) {
+	u := NewUpstream(nil)
+	defer u.Close()
+	u.SetFault(Fault{Status: http.StatusBadGateway})
+	u.SetPathFault("/a", Fault{Status: http.StatusServiceUnavailable, Times: 1})
+
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/a", http.StatusServiceUnavailable},
+		{"/a", http.StatusBadGateway},
+		{"/b", http.StatusBadGateway},
+	} {
+		resp, err := http.Get(u.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.path, resp.StatusCode, tc.want)
+		}
+		// the status is replaced, the body is kept
+		if string(body) != tc.path {
+			t.Errorf("%s: body %q, want %q", tc.path, body, tc.path)
+		}
+	}
+	if got := u.PathCalls("/a"); got != 2 {
+		t.Errorf("calls of /a = %d, want 2", got)
+	}
+	if got := u.Calls(); got != 3 {
+		t.Errorf("calls = %d, want 3", got)
+	}
+}
+
+func TestUpstreamPartialBody(t *testing.T) {
+	u := NewUpstream(nil)
+	defer u.Close()
+	u.SetFault(Fault{PartialBody: true, Times: 1})
+
+	resp, err := http.Get(u.URL + "/partial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength != int64(len("/partial")) {
+		t.Errorf("content length %d, want %d", resp.ContentLength, len("/partial"))
+	}
+	body, err := io.ReadAll(resp.Body)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("read error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if string(body) != "/par" {
+		t.Errorf("body %q, want %q", body, "/par")
+	}
+}
+
+func TestUpstreamLatencyEndsWithCaller(t *testing.T) {
+	u := NewUpstream(nil)
+	defer u.Close()
+	u.SetFault(Fault{Latency: 5 * time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u.URL+"/slow", nil)
+	start := time.Now()
+	_, err := http.DefaultClient.Do(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %s, the latency should end with the caller", elapsed)
+	}
+}
+
+func TestCacherFaults(t *testing.T) {
+	ctx := context.Background()
+	c := NewCacher(memory.New(memory.Options{}))
+	if err := c.Set(ctx, "k", "value", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetFault(Fault{Err: ErrInjected})
+	c.SetOpFault("Get", Fault{PartialBody: true, Times: 1})
+	if got, err := c.Get(ctx, "k"); err != nil || got != "va" {
+		t.Errorf("Get = %q, %v, want %q", got, err, "va")
+	}
+	if _, err := c.Get(ctx, "k"); err != ErrInjected {
+		t.Errorf("second Get error %v, want %v", err, ErrInjected)
+	}
+	if _, err := c.Exists(ctx, "k"); err != ErrInjected {
+		t.Errorf("Exists error %v, want %v", err, ErrInjected)
+	}
+	c.ClearFaults()
+	if got, err := c.Get(ctx, "k"); err != nil || got != "value" {
+		t.Errorf("Get after clear = %q, %v, want %q", got, err, "value")
+	}
+	if got := c.Calls("Get"); got != 3 {
+		t.Errorf("Get calls = %d, want 3", got)
+	}
+	if got := c.Calls(""); got != 5 {
+		t.Errorf("calls = %d, want 5", got)
+	}
+}
+
+func TestCacherUnsupported(t *testing.T) {
+	c := NewCacher(memory.New(memory.Options{}))
+	if err := c.Ping(context.Background()); err != nil {
+		t.Errorf("Ping error %v, the memory cache has one", err)
+	}
+	c = NewCacher(bareCacher{c})
+	if err := c.Ping(context.Background()); err != cache.ErrUnsupported {
+		t.Errorf("Ping error %v, want %v", err, cache.ErrUnsupported)
+	}
+	if got := c.Calls("Ping"); got != 0 {
+		t.Errorf("Ping calls = %d, an unsupported call is not counted", got)
+	}
+}
+
+// bareCacher hides the optional operations of its ContextCacher
+type bareCacher struct {
+	cache.ContextCacher
+}
+
+func TestClockExpiry(t *testing.T) {
+	ctx := context.Background()
+	clock := NewClock(time.Time{})
+	c := memory.New(memory.Options{Now: clock.Now})
+	if err := c.Set(ctx, "k", "value", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(59 * time.Second)
+	if _, err := c.Get(ctx, "k"); err != nil {
+		t.Errorf("Get before the ttl: %v", err)
+	}
+	clock.Advance(time.Second)
+	if _, err := c.Get(ctx, "k"); err != cache.ErrNotFound {
+		t.Errorf("Get at the ttl: error %v, want %v", err, cache.ErrNotFound)
+	}
+}
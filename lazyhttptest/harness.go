@@ -0,0 +1,180 @@
+package lazyhttptest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dendhi31/lazyhttp"
+	"github.com/dendhi31/lazyhttp/logger"
+	"github.com/dendhi31/lazyhttp/memory"
+)
+
+// Harness is a lazyhttp.Client wired to an Upstream, a Cacher over an in-memory cache
+// and an in-memory queue for the refresh jobs, all on a virtual Clock
+type Harness struct {
+	Upstream *Upstream
+	Cacher   *Cacher
+	Queue    *memory.Queue
+	Clock    *Clock
+	Client   *lazyhttp.Client
+
+	t testing.TB
+}
+
+// New starts a harness and closes it when the test ends. Zero timeouts of config get short
+// test defaults, and opts are applied after the harness components so they can replace them.
+// The upstream answers with the request path, h.Upstream.SetHandler replaces it.
+func New(t testing.TB, config lazyhttp.Config, opts ...lazyhttp.Option) *Harness {
+	t.Helper()
+	if config.WaitHttp == 0 {
+		config.WaitHttp = 200
+	}
+	if config.WaitRedis == 0 {
+		config.WaitRedis = 50
+	}
+	if config.MainTimeout == 0 {
+		config.MainTimeout = 500
+	}
+	if config.HTTPRequestTimeout == 0 {
+		config.HTTPRequestTimeout = 200
+	}
+	if config.ExpiryTime == 0 {
+		config.ExpiryTime = 60000
+	}
+
+	h := &Harness{
+		Upstream: NewUpstream(nil),
+		Clock:    NewClock(time.Time{}),
+		t:        t,
+	}
+	h.Cacher = NewCacher(memory.New(memory.Options{Now: h.Clock.Now}))
+	h.Queue = memory.NewQueue(memory.Options{Now: h.Clock.Now})
+	t.Cleanup(h.Upstream.Close)
+
+	opts = append([]lazyhttp.Option{
+		lazyhttp.WithCacher(h.Cacher),
+		lazyhttp.WithPublisher(h.Queue),
+		lazyhttp.WithClock(h.Clock.Now),
+		lazyhttp.WithLogger(logger.Nop()),
+	}, opts...)
+	client, err := lazyhttp.New(config, opts...)
+	if err != nil {
+		t.Fatalf("lazyhttptest: create client: %v", err)
+	}
+	h.Client = client
+	t.Cleanup(func() { client.Close() })
+	return h
+}
+
+// Request returns a GET of path on the upstream, cached under path
+func (h *Harness) Request(path string, useCache bool) *lazyhttp.Request {
+	return &lazyhttp.Request{
+		URL:      h.Upstream.URL + path,
+		Method:   "GET",
+		Key:      path,
+		UseCache: useCache,
+	}
+}
+
+// WaitStored waits until key is in the cache, a response is stored after it was returned.
+// It fails the test when key is not stored within HTTPRequestTimeout, which bounds the write,
+// and a second of margin.
+func (h *Harness) WaitStored(key string) {
+	h.t.Helper()
+	deadline := time.Now().Add(h.Client.HTTPRequestTimeout*time.Millisecond + time.Second)
+	for {
+		if ok, _ := h.Cacher.Next().Exists(context.Background(), key); ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatalf("lazyhttptest: %s was not stored", key)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// AssertServedFromCache fails the test unless resp came from the cache, as a hit or a fallback
+func (h *Harness) AssertServedFromCache(resp *lazyhttp.Response) {
+	h.t.Helper()
+	if resp == nil {
+		h.t.Errorf("lazyhttptest: got no response, want one served from the cache")
+		return
+	}
+	if resp.Outcome != lazyhttp.OutcomeCacheHit && resp.Outcome != lazyhttp.OutcomeFallbackHit {
+		h.t.Errorf("lazyhttptest: response outcome is %s, want %s or %s", resp.Outcome, lazyhttp.OutcomeCacheHit, lazyhttp.OutcomeFallbackHit)
+	}
+}
+
+// AssertLive fails the test unless resp came from the upstream
+func (h *Harness) AssertLive(resp *lazyhttp.Response) {
+	h.t.Helper()
+	if resp == nil {
+		h.t.Errorf("lazyhttptest: got no response, want a live one")
+		return
+	}
+	if resp.Outcome != lazyhttp.OutcomeLive {
+		h.t.Errorf("lazyhttptest: response outcome is %s, want %s", resp.Outcome, lazyhttp.OutcomeLive)
+	}
+}
+
+// AssertRefreshPublished fails the test unless a refresh job for key was published
+func (h *Harness) AssertRefreshPublished(key string) {
+	h.t.Helper()
+	if !h.refreshPublished(key) {
+		h.t.Errorf("lazyhttptest: no refresh job published for %s", key)
+	}
+}
+
+// AssertNoRefreshPublished fails the test when a refresh job for key was published
+func (h *Harness) AssertNoRefreshPublished(key string) {
+	h.t.Helper()
+	if h.refreshPublished(key) {
+		h.t.Errorf("lazyhttptest: a refresh job was published for %s", key)
+	}
+}
+
+func (h *Harness) refreshPublished(key string) bool {
+	h.t.Helper()
+	jobs, err := h.Queue.Jobs(h.channel())
+	if err != nil {
+		h.t.Fatalf("lazyhttptest: read refresh jobs: %v", err)
+	}
+	for _, job := range jobs {
+		if job.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Harness) channel() string {
+	if h.Client.Channel == "" {
+		return lazyhttp.DefaultChannel
+	}
+	return h.Client.Channel
+}
+
+// AssertUpstreamCalls fails the test unless the upstream received n requests
+func (h *Harness) AssertUpstreamCalls(n int) {
+	h.t.Helper()
+	if got := h.Upstream.Calls(); got != n {
+		h.t.Errorf("lazyhttptest: upstream called %d times, want %d", got, n)
+	}
+}
+
+// AssertPathCalls fails the test unless the upstream received n requests for path
+func (h *Harness) AssertPathCalls(path string, n int) {
+	h.t.Helper()
+	if got := h.Upstream.PathCalls(path); got != n {
+		h.t.Errorf("lazyhttptest: upstream called %d times for %s, want %d", got, path, n)
+	}
+}
+
+// AssertCacherCalls fails the test unless op was called n times on the Cacher
+func (h *Harness) AssertCacherCalls(op string, n int) {
+	h.t.Helper()
+	if got := h.Cacher.Calls(op); got != n {
+		h.t.Errorf("lazyhttptest: cacher %s called %d times, want %d", op, got, n)
+	}
+}
@@ -0,0 +1,146 @@
+package lazyhttptest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dendhi31/lazyhttp"
+)
+
+func TestHarnessLive(t *testing.T) {
+	h := New(t, lazyhttp.Config{})
+
+	resp, err := h.Client.Do(context.Background(), h.Request("/live", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AssertLive(resp)
+	if string(resp.Body) != "/live" {
+		t.Errorf("body %q, want %q", resp.Body, "/live")
+	}
+	h.AssertUpstreamCalls(1)
+	h.AssertNoRefreshPublished("/live")
+	h.WaitStored("/live")
+}
+
+func TestHarnessFallbackHit(t *testing.T) {
+	h := New(t, lazyhttp.Config{StoreEnvelope: true})
+	ctx := context.Background()
+
+	if _, err := h.Client.Do(ctx, h.Request("/hit", false)); err != nil {
+		t.Fatal(err)
+	}
+	h.WaitStored("/hit")
+
+	h.Clock.Advance(30 * time.Second)
+	h.Upstream.SetFault(Fault{Status: http.StatusServiceUnavailable})
+	resp, err := h.Client.Do(ctx, h.Request("/hit", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AssertServedFromCache(resp)
+	if resp.Outcome != lazyhttp.OutcomeFallbackHit {
+		t.Errorf("outcome %s, want %s", resp.Outcome, lazyhttp.OutcomeFallbackHit)
+	}
+	if resp.StatusCode != http.StatusOK || string(resp.Body) != "/hit" {
+		t.Errorf("response %d %q, want the stored 200 %q", resp.StatusCode, resp.Body, "/hit")
+	}
+	if resp.Age != 30*time.Second {
+		t.Errorf("age %s, want 30s on the virtual clock", resp.Age)
+	}
+	h.AssertUpstreamCalls(2)
+}
+
+func TestHarnessFallbackMissPublishesRefresh(t *testing.T) {
+	h := New(t, lazyhttp.Config{})
+	h.Upstream.SetFault(Fault{Status: http.StatusInternalServerError})
+
+	resp, err := h.Client.Do(context.Background(), h.Request("/miss", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Outcome != lazyhttp.OutcomeFallbackMiss {
+		t.Errorf("outcome %s, want %s", resp.Outcome, lazyhttp.OutcomeFallbackMiss)
+	}
+	// the upstream error response is passed through
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+	h.AssertRefreshPublished("/miss")
+	h.AssertNoRefreshPublished("/other")
+	h.AssertPathCalls("/miss", 1)
+}
+
+func TestHarnessExpiredEntryIsFetched(t *testing.T) {
+	h := New(t, lazyhttp.Config{ExpiryTime: 60000})
+	ctx := context.Background()
+
+	if _, err := h.Client.Do(ctx, h.Request("/expire", true)); err != nil {
+		t.Fatal(err)
+	}
+	h.WaitStored("/expire")
+	resp, err := h.Client.Do(ctx, h.Request("/expire", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AssertServedFromCache(resp)
+	h.AssertUpstreamCalls(1)
+
+	h.Clock.Advance(time.Minute)
+	resp, err = h.Client.Do(ctx, h.Request("/expire", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AssertLive(resp)
+	h.AssertUpstreamCalls(2)
+}
+
+func TestHarnessSlowCacher(t *testing.T) {
+	h := New(t, lazyhttp.Config{WaitRedis: 50})
+	h.Cacher.SetOpFault("Get", Fault{Latency: 2 * time.Second})
+
+	start := time.Now()
+	resp, err := h.Client.Do(context.Background(), h.Request("/slow", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AssertLive(resp)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %s, the cache read should be given up after WaitRedis", elapsed)
+	}
+	h.AssertCacherCalls("Get", 1)
+	h.AssertUpstreamCalls(1)
+}
+
+func TestHarnessSlowCacherPessimistic(t *testing.T) {
+	h := New(t, lazyhttp.Config{})
+	h.Cacher.SetOpFault("Get", Fault{Latency: 2 * time.Second})
+
+	start := time.Now()
+	resp, err := h.Client.Do(context.Background(), h.Request("/slow", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AssertLive(resp)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %s, a live response does not wait for the cache", elapsed)
+	}
+}
+
+func TestHarnessSlowCacheWrite(t *testing.T) {
+	h := New(t, lazyhttp.Config{WaitHttp: 200, HTTPRequestTimeout: 1000})
+	h.Cacher.SetOpFault("Set", Fault{Latency: 300 * time.Millisecond})
+
+	start := time.Now()
+	resp, err := h.Client.Do(context.Background(), h.Request("/write", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AssertLive(resp)
+	if elapsed := time.Since(start); elapsed >= 300*time.Millisecond {
+		t.Errorf("request took %s, the response should not wait for the cache write", elapsed)
+	}
+	h.WaitStored("/write")
+}
@@ -0,0 +1,115 @@
+package lazyhttptest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+)
+
+// Upstream is an httptest.Server whose answers can be faulted, and which counts its calls
+type Upstream struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	handler http.Handler
+	faults  *faults
+}
+
+// NewUpstream starts an upstream serving handler. A nil handler answers 200 with the request path.
+func NewUpstream(handler http.Handler) *Upstream {
+	if handler == nil {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, r.URL.Path)
+		})
+	}
+	u := &Upstream{handler: handler, faults: newFaults()}
+	u.Server = httptest.NewServer(http.HandlerFunc(u.serve))
+	return u
+}
+
+// SetHandler replaces the handler answering the requests
+func (u *Upstream) SetHandler(handler http.Handler) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.handler = handler
+}
+
+// SetFault applies fault to every request
+func (u *Upstream) SetFault(fault Fault) {
+	u.faults.set("", fault)
+}
+
+// SetPathFault applies fault to the requests for path, before the fault of SetFault
+func (u *Upstream) SetPathFault(path string, fault Fault) {
+	u.faults.set(path, fault)
+}
+
+// ClearFaults lets every request through again
+func (u *Upstream) ClearFaults() {
+	u.faults.clear()
+}
+
+// Calls returns the number of requests received
+func (u *Upstream) Calls() int {
+	return u.faults.count("")
+}
+
+// PathCalls returns the number of requests received for path
+func (u *Upstream) PathCalls(path string) int {
+	return u.faults.count(path)
+}
+
+// ResetCalls sets the counts back to 0
+func (u *Upstream) ResetCalls() {
+	u.faults.reset()
+}
+
+func (u *Upstream) serve(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	handler := u.handler
+	u.mu.Unlock()
+	fault := u.faults.take(r.URL.Path)
+	if err := fault.wait(r.Context()); err != nil {
+		return
+	}
+	if fault.Err != nil {
+		hangUp(w)
+		return
+	}
+	if fault.Status == 0 && !fault.PartialBody {
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	status := rec.Code
+	if fault.Status != 0 {
+		status = fault.Status
+	}
+	for name, values := range rec.Header() {
+		w.Header()[name] = values
+	}
+	body := rec.Body.Bytes()
+	if !fault.PartialBody {
+		w.WriteHeader(status)
+		w.Write(body)
+		return
+	}
+	// the full length is announced and half the body sent, the client reads an unexpected EOF
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body[:len(body)/2])
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	hangUp(w)
+}
+
+// hangUp closes the connection of w, what was flushed already is all the client gets
+func hangUp(w http.ResponseWriter) {
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,93 @@
+package lazyhttp
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// localCache is a size bounded in-process LRU of encoded envelopes.
+// Entries live for a short ttl, so a missed invalidation only serves a stale copy for that long.
+type localCache struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type localEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+func newLocalCache(ttl time.Duration, size int, now func() time.Time) *localCache {
+	return &localCache{
+		now:     now,
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *localCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(*localEntry)
+	if c.now().After(entry.expires) {
+		c.remove(elem)
+		return "", false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (c *localCache) set(key, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.now().Add(c.ttl)
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*localEntry)
+		entry.value = value
+		entry.expires = expires
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&localEntry{key: key, value: value, expires: expires})
+	for c.size > 0 && c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *localCache) delete(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if elem, ok := c.entries[key]; ok {
+			c.remove(elem)
+		}
+	}
+}
+
+func (c *localCache) deletePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, elem := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(elem)
+		}
+	}
+}
+
+func (c *localCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*localEntry).key)
+}
@@ -1,23 +1,76 @@
 package logger
 
-import "log"
+import (
+	"io"
+	"log/slog"
+	"os"
+)
 
+// Field keys shared by every lazyhttp component, so log lines coming from the
+// client, the consumer and the adapters can be correlated by the same names
+const (
+	KeyRequestID = "request_id"
+	KeyCacheKey  = "cache_key"
+	KeyHost      = "host"
+	KeyOutcome   = "outcome"
+	KeyError     = "error"
+)
+
+// Logger is a leveled, structured logger.
+// keyvals are alternating key-value pairs, e.g. Info("done", "host", h, "outcome", o)
 type Logger interface {
-	Debugln(args ...interface{})
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+
+	// With returns a Logger that always adds keyvals to its entries
+	With(keyvals ...interface{}) Logger
 }
 
+// Config is a configuration for the default logger
 type Config struct {
+	// Debug enables debug level entries, otherwise only info and above are written
 	Debug bool
+	// Output is where entries are written, default is os.Stdout
+	Output io.Writer
+	// JSON writes entries as JSON instead of logfmt-like text
+	JSON bool
 }
 
+// New creates the default logger backed by log/slog.
+// It never touches the global log or slog state.
 func New(config Config) Logger {
-	return &Config{
-		Debug: config.Debug,
+	out := config.Output
+	if out == nil {
+		out = os.Stdout
 	}
-}
 
-func (logs *Config) Debugln(args ...interface{}) {
-	if logs.Debug {
-		log.Println(args...)
+	level := slog.LevelInfo
+	if config.Debug {
+		level = slog.LevelDebug
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if config.JSON {
+		handler = slog.NewJSONHandler(out, opts)
+	} else {
+		handler = slog.NewTextHandler(out, opts)
 	}
+
+	return NewSlog(slog.New(handler))
+}
+
+// Nop returns a Logger that discards everything
+func Nop() Logger {
+	return nop{}
 }
+
+type nop struct{}
+
+func (nop) Debug(msg string, keyvals ...interface{}) {}
+func (nop) Info(msg string, keyvals ...interface{})  {}
+func (nop) Warn(msg string, keyvals ...interface{})  {}
+func (nop) Error(msg string, keyvals ...interface{}) {}
+func (n nop) With(keyvals ...interface{}) Logger     { return n }
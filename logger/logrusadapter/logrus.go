@@ -0,0 +1,63 @@
+// Package logrusadapter adapts a logrus logger to logger.Logger
+package logrusadapter
+
+import (
+	"fmt"
+
+	"github.com/dendhi31/lazyhttp/logger"
+	"github.com/sirupsen/logrus"
+)
+
+type adapter struct {
+	entry logrus.FieldLogger
+}
+
+// New adapts l (a *logrus.Logger or *logrus.Entry) to logger.Logger
+func New(l logrus.FieldLogger) logger.Logger {
+	if l == nil {
+		l = logrus.StandardLogger()
+	}
+	return &adapter{entry: l}
+}
+
+func (a *adapter) Debug(msg string, keyvals ...interface{}) {
+	a.entry.WithFields(fields(keyvals)).Debug(msg)
+}
+
+func (a *adapter) Info(msg string, keyvals ...interface{}) {
+	a.entry.WithFields(fields(keyvals)).Info(msg)
+}
+
+func (a *adapter) Warn(msg string, keyvals ...interface{}) {
+	a.entry.WithFields(fields(keyvals)).Warn(msg)
+}
+
+func (a *adapter) Error(msg string, keyvals ...interface{}) {
+	a.entry.WithFields(fields(keyvals)).Error(msg)
+}
+
+func (a *adapter) With(keyvals ...interface{}) logger.Logger {
+	return &adapter{entry: a.entry.WithFields(fields(keyvals))}
+}
+
+// fields converts alternating key-values to logrus.Fields,
+// a dangling value is kept under "!BADKEY" like log/slog does
+func fields(keyvals []interface{}) logrus.Fields {
+	f := make(logrus.Fields, (len(keyvals)+1)/2)
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 == len(keyvals) {
+			f["!BADKEY"] = keyvals[i]
+			break
+		}
+		key, ok := keyvals[i].(string)
+		if !ok {
+			key = fmt.Sprint(keyvals[i])
+		}
+		value := keyvals[i+1]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		f[key] = value
+	}
+	return f
+}
@@ -0,0 +1,38 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+)
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlog adapts a *slog.Logger to Logger
+func NewSlog(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return &slogLogger{logger: l}
+}
+
+func (s *slogLogger) Debug(msg string, keyvals ...interface{}) {
+	s.logger.Log(context.Background(), slog.LevelDebug, msg, keyvals...)
+}
+
+func (s *slogLogger) Info(msg string, keyvals ...interface{}) {
+	s.logger.Log(context.Background(), slog.LevelInfo, msg, keyvals...)
+}
+
+func (s *slogLogger) Warn(msg string, keyvals ...interface{}) {
+	s.logger.Log(context.Background(), slog.LevelWarn, msg, keyvals...)
+}
+
+func (s *slogLogger) Error(msg string, keyvals ...interface{}) {
+	s.logger.Log(context.Background(), slog.LevelError, msg, keyvals...)
+}
+
+func (s *slogLogger) With(keyvals ...interface{}) Logger {
+	return &slogLogger{logger: s.logger.With(keyvals...)}
+}
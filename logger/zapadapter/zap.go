@@ -0,0 +1,39 @@
+// Package zapadapter adapts a zap logger to logger.Logger
+package zapadapter
+
+import (
+	"github.com/dendhi31/lazyhttp/logger"
+	"go.uber.org/zap"
+)
+
+type adapter struct {
+	sugar *zap.SugaredLogger
+}
+
+// New adapts l to logger.Logger
+func New(l *zap.Logger) logger.Logger {
+	if l == nil {
+		l = zap.NewNop()
+	}
+	return &adapter{sugar: l.WithOptions(zap.AddCallerSkip(1)).Sugar()}
+}
+
+func (a *adapter) Debug(msg string, keyvals ...interface{}) {
+	a.sugar.Debugw(msg, keyvals...)
+}
+
+func (a *adapter) Info(msg string, keyvals ...interface{}) {
+	a.sugar.Infow(msg, keyvals...)
+}
+
+func (a *adapter) Warn(msg string, keyvals ...interface{}) {
+	a.sugar.Warnw(msg, keyvals...)
+}
+
+func (a *adapter) Error(msg string, keyvals ...interface{}) {
+	a.sugar.Errorw(msg, keyvals...)
+}
+
+func (a *adapter) With(keyvals ...interface{}) logger.Logger {
+	return &adapter{sugar: a.sugar.With(keyvals...)}
+}
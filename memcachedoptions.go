@@ -0,0 +1,30 @@
+package lazyhttp
+
+import (
+	"time"
+
+	"github.com/dendhi31/lazyhttp/cache/memcached"
+)
+
+// MemcachedOptions stores the responses in memcached instead of redis, see the cache/memcached package
+type MemcachedOptions struct {
+	// Servers enables the memcached storage, StorageHostServer and StorageRedis are ignored then.
+	// Memcached has no pub/sub, so RedisHost is still needed for the refresh jobs.
+	Servers []string
+	// DialTimeout in milliseconds, default is 1 second
+	DialTimeout time.Duration
+	// Timeout bounds a memcached command in milliseconds, default is 1 second
+	Timeout time.Duration
+	// MaxIdleConns is the number of idle connections kept per server, default is 8
+	MaxIdleConns int
+}
+
+// Options returns the memcached package options
+func (o MemcachedOptions) Options() memcached.Options {
+	return memcached.Options{
+		Servers:      o.Servers,
+		DialTimeout:  o.DialTimeout * time.Millisecond,
+		Timeout:      o.Timeout * time.Millisecond,
+		MaxIdleConns: o.MaxIdleConns,
+	}
+}
@@ -0,0 +1,430 @@
+// Package memory is a cache.ContextCacher and a refresh job queue kept in the process memory,
+// for tests and single-process deployments that run without redis. Nothing is persisted and
+// pub/sub only reaches the subscribers of the same Cache.
+package memory
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dendhi31/lazyhttp/cache"
+	"github.com/dendhi31/lazyhttp/redis"
+)
+
+var (
+	// ErrWrongType is returned when a key holds another kind of value than the operation expects
+	ErrWrongType = errors.New("memory: operation against a key holding the wrong kind of value")
+	// ErrClosed is returned by the operations of a closed cache
+	ErrClosed = errors.New("memory: cache is closed")
+)
+
+// kinds of stored values
+const (
+	kindString byte = iota
+	kindList
+	kindSet
+)
+
+// Options configures a Cache, zero values keep the defaults
+type Options struct {
+	// Now is the clock the ttls are read against, default is time.Now.
+	// A test can move it forward to expire entries without sleeping.
+	Now func() time.Time
+	// MaxPublished is the number of messages a Queue keeps per channel, the oldest are dropped
+	// past it. Default is DefaultMaxPublished, a negative value keeps none.
+	MaxPublished int
+}
+
+// Cache is a thread-safe cache.ContextCacher kept in memory
+type Cache struct {
+	now    func() time.Time
+	broker *cache.Broker
+	prefix string
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	// writes counts the writes since the last sweep of the expired entries
+	writes int
+	closed bool
+}
+
+type entry struct {
+	kind   byte
+	value  string
+	list   []string
+	expiry time.Time
+}
+
+var (
+	_ cache.ContextCacher     = (*Cache)(nil)
+	_ cache.Pinger            = (*Cache)(nil)
+	_ cache.Lister            = (*Cache)(nil)
+	_ cache.Tagger            = (*Cache)(nil)
+	_ cache.Scanner           = (*Cache)(nil)
+	_ cache.PatternSubscriber = (*Cache)(nil)
+)
+
+// New returns an empty Cache
+func New(options Options) *Cache {
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+	return &Cache{
+		now:     options.Now,
+		broker:  cache.NewBroker(),
+		entries: make(map[string]*entry),
+	}
+}
+
+// SetPrefix will append a prefix to the keys of this cache
+func (c *Cache) SetPrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prefix = prefix
+}
+
+// Set stores value under key, a ttl of 0 does not expire
+func (c *Cache) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return c.update(ctx, func() error {
+		c.put(key, &entry{kind: kindString, value: cache.FormatValue(value), expiry: c.expiryOf(ttl)})
+		return nil
+	})
+}
+
+// Get returns the value of key, ErrNotFound when it does not exist
+func (c *Cache) Get(ctx context.Context, key string) (string, error) {
+	var value string
+	err := c.update(ctx, func() error {
+		e := c.get(key)
+		if e == nil {
+			return cache.ErrNotFound
+		}
+		if e.kind != kindString {
+			return ErrWrongType
+		}
+		value = e.value
+		return nil
+	})
+	return value, err
+}
+
+// MGet returns the values of the keys that exist
+func (c *Cache) MGet(ctx context.Context, keys ...string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	err := c.update(ctx, func() error {
+		for _, key := range keys {
+			if e := c.get(key); e != nil && e.kind == kindString {
+				values[key] = e.value
+			}
+		}
+		return nil
+	})
+	return values, err
+}
+
+// MSet stores every key-value pair of values with the same ttl, atomically
+func (c *Cache) MSet(ctx context.Context, values map[string]interface{}, ttl time.Duration) error {
+	return c.update(ctx, func() error {
+		expiry := c.expiryOf(ttl)
+		for key, value := range values {
+			c.put(key, &entry{kind: kindString, value: cache.FormatValue(value), expiry: expiry})
+		}
+		return nil
+	})
+}
+
+// Remove deletes key, a missing key is not an error
+func (c *Cache) Remove(ctx context.Context, key string) error {
+	return c.update(ctx, func() error {
+		delete(c.entries, c.prefix+key)
+		return nil
+	})
+}
+
+// Exists reports whether key exists
+func (c *Cache) Exists(ctx context.Context, key string) (bool, error) {
+	var exists bool
+	err := c.update(ctx, func() error {
+		exists = c.get(key) != nil
+		return nil
+	})
+	return exists, err
+}
+
+// TTL returns the remaining time to live of key, 0 when it does not expire
+func (c *Cache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	var ttl time.Duration
+	err := c.update(ctx, func() error {
+		e := c.get(key)
+		if e == nil {
+			return cache.ErrNotFound
+		}
+		if !e.expiry.IsZero() {
+			ttl = e.expiry.Sub(c.now())
+		}
+		return nil
+	})
+	return ttl, err
+}
+
+// Expire sets the time to live of key, ErrNotFound when it does not exist.
+// A ttl of 0 or less removes the key, like redis does.
+func (c *Cache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return c.update(ctx, func() error {
+		e := c.get(key)
+		if e == nil {
+			return cache.ErrNotFound
+		}
+		if ttl <= 0 {
+			delete(c.entries, c.prefix+key)
+			return nil
+		}
+		e.expiry = c.expiryOf(ttl)
+		return nil
+	})
+}
+
+// Publish sends value to the subscribers of channel
+func (c *Cache) Publish(ctx context.Context, channel string, value interface{}) error {
+	if err := c.check(ctx); err != nil {
+		return err
+	}
+	c.broker.Publish(channel, value)
+	return nil
+}
+
+// Subscribe subscribes to channels, channels are not prefixed
+func (c *Cache) Subscribe(ctx context.Context, channels ...string) (redis.Subscription, error) {
+	if err := c.check(ctx); err != nil {
+		return nil, err
+	}
+	return c.broker.Subscribe(channels...), nil
+}
+
+// PSubscribe subscribes to the channels matching patterns, channels are not prefixed
+func (c *Cache) PSubscribe(ctx context.Context, patterns ...string) (redis.Subscription, error) {
+	if err := c.check(ctx); err != nil {
+		return nil, err
+	}
+	return c.broker.PSubscribe(patterns...), nil
+}
+
+// Ping reports whether the cache is open
+func (c *Cache) Ping(ctx context.Context) error {
+	return c.check(ctx)
+}
+
+// LLen returns the length of the list stored at key
+func (c *Cache) LLen(ctx context.Context, key string) (int64, error) {
+	var n int64
+	err := c.update(ctx, func() error {
+		list, err := c.list(key, kindList)
+		n = int64(len(list))
+		return err
+	})
+	return n, err
+}
+
+// PushCapped appends value to the list stored at key, keeping its last max entries when max is above 0
+func (c *Cache) PushCapped(ctx context.Context, key string, value interface{}, max int64) error {
+	return c.update(ctx, func() error {
+		list, err := c.list(key, kindList)
+		if err != nil {
+			return err
+		}
+		list = append(list, cache.FormatValue(value))
+		if max > 0 && int64(len(list)) > max {
+			list = list[int64(len(list))-max:]
+		}
+		var expiry time.Time
+		if e := c.get(key); e != nil {
+			expiry = e.expiry
+		}
+		c.put(key, &entry{kind: kindList, list: list, expiry: expiry})
+		return nil
+	})
+}
+
+// SMembers returns the members of the set stored at key
+func (c *Cache) SMembers(ctx context.Context, key string) ([]string, error) {
+	var members []string
+	err := c.update(ctx, func() (err error) {
+		members, err = c.list(key, kindSet)
+		return err
+	})
+	return members, err
+}
+
+// SAdd adds members to the set stored at key, and sets its ttl when it is not 0
+func (c *Cache) SAdd(ctx context.Context, key string, ttl time.Duration, members ...string) error {
+	return c.update(ctx, func() error {
+		set, err := c.list(key, kindSet)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			if i := sort.SearchStrings(set, member); i == len(set) || set[i] != member {
+				set = append(set, "")
+				copy(set[i+1:], set[i:])
+				set[i] = member
+			}
+		}
+		expiry := c.expiryOf(ttl)
+		if e := c.get(key); ttl <= 0 && e != nil {
+			expiry = e.expiry
+		}
+		c.put(key, &entry{kind: kindSet, list: set, expiry: expiry})
+		return nil
+	})
+}
+
+// Scan calls fn with every key matching the glob pattern, in lexical order.
+// The prefix is added to pattern and stripped from the keys given to fn.
+func (c *Cache) Scan(ctx context.Context, pattern string, fn func(key string) error) error {
+	var keys []string
+	err := c.update(ctx, func() error {
+		pattern = cache.EscapeGlob(c.prefix) + pattern
+		now := c.now()
+		for k, e := range c.entries {
+			if e.expired(now) || !strings.HasPrefix(k, c.prefix) {
+				continue
+			}
+			if cache.MatchGlob(pattern, k) {
+				keys = append(keys, strings.TrimPrefix(k, c.prefix))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+	// fn runs without the lock, so it may write
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of keys that have not expired, whatever their prefix
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	var n int
+	for _, e := range c.entries {
+		if !e.expired(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// Flush removes every key, the subscriptions are kept
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*entry)
+	c.writes = 0
+}
+
+// Close closes the subscriptions and drops the entries. It can be called more than once.
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.entries = nil
+	c.broker.Close()
+	return nil
+}
+
+func (c *Cache) check(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// update runs fn holding the lock, reads go through it as well since they drop expired entries
+func (c *Cache) update(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return fn()
+}
+
+// get returns the entry of key, nil when it is missing or expired. The lock must be held.
+func (c *Cache) get(key string) *entry {
+	k := c.prefix + key
+	e, ok := c.entries[k]
+	if !ok {
+		return nil
+	}
+	if e.expired(c.now()) {
+		delete(c.entries, k)
+		return nil
+	}
+	return e
+}
+
+// put stores e under key. Every so many writes the expired entries are swept,
+// so keys that are never read again do not pile up. The lock must be held.
+func (c *Cache) put(key string, e *entry) {
+	c.entries[c.prefix+key] = e
+	c.writes++
+	if c.writes < 1000 || c.writes < len(c.entries) {
+		return
+	}
+	c.writes = 0
+	now := c.now()
+	for k, e := range c.entries {
+		if e.expired(now) {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// list returns a copy of the list or set stored at key. The lock must be held.
+func (c *Cache) list(key string, kind byte) ([]string, error) {
+	e := c.get(key)
+	if e == nil {
+		return nil, nil
+	}
+	if e.kind != kind {
+		return nil, ErrWrongType
+	}
+	return append([]string(nil), e.list...), nil
+}
+
+func (c *Cache) expiryOf(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return c.now().Add(ttl)
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expiry.IsZero() && !now.Before(e.expiry)
+}
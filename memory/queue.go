@@ -0,0 +1,83 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/dendhi31/lazyhttp/cache"
+	"github.com/dendhi31/lazyhttp/redismaint"
+)
+
+// DefaultMaxPublished is the number of messages a Queue keeps per channel when Options.MaxPublished is 0
+const DefaultMaxPublished = 1000
+
+// Queue is the in-memory transport of the refresh jobs, dead letters and invalidations, it is meant
+// for Client.PubsubClient. It is a Cache that also keeps the last Options.MaxPublished messages of
+// each channel, so a test can read the jobs a client published without running a consumer.
+type Queue struct {
+	*Cache
+
+	mu           sync.Mutex
+	published    map[string][]string
+	maxPublished int
+}
+
+// NewQueue returns an empty Queue
+func NewQueue(options Options) *Queue {
+	if options.MaxPublished == 0 {
+		options.MaxPublished = DefaultMaxPublished
+	}
+	return &Queue{
+		Cache:        New(options),
+		published:    make(map[string][]string),
+		maxPublished: options.MaxPublished,
+	}
+}
+
+// Publish keeps value, dropping the oldest message of channel past MaxPublished,
+// and sends it to the subscribers of channel
+func (q *Queue) Publish(ctx context.Context, channel string, value interface{}) error {
+	if err := q.Cache.Publish(ctx, channel, value); err != nil {
+		return err
+	}
+	if q.maxPublished < 0 {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	messages := append(q.published[channel], cache.FormatValue(value))
+	if len(messages) > q.maxPublished {
+		// the dropped messages are released when append moves the slice to a new array
+		messages = messages[len(messages)-q.maxPublished:]
+	}
+	q.published[channel] = messages
+	return nil
+}
+
+// Published returns the messages kept for channel, oldest first
+func (q *Queue) Published(channel string) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]string(nil), q.published[channel]...)
+}
+
+// Jobs returns the refresh jobs published to channel, oldest first
+func (q *Queue) Jobs(channel string) ([]redismaint.RequestRequirement, error) {
+	var jobs []redismaint.RequestRequirement
+	for _, message := range q.Published(channel) {
+		var job redismaint.RequestRequirement
+		if err := json.Unmarshal([]byte(message), &job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// Reset forgets the published messages, the stored keys and the subscriptions are kept
+func (q *Queue) Reset() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.published = make(map[string][]string)
+}
@@ -0,0 +1,315 @@
+// Package metrics exposes lazyhttp client and consumer metrics as a prometheus.Collector.
+//
+// Nothing is registered globally, register the collector on your own registry:
+//
+//	m := metrics.New(metrics.Options{Namespace: "myservice"})
+//	registry.MustRegister(m)
+//
+// Every method is safe to call on a nil *Metrics, so instrumented code does not
+// need to check whether metrics are enabled.
+package metrics
+
+import (
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Cache lookup results
+const (
+	LookupHit   = "hit"
+	LookupMiss  = "miss"
+	LookupError = "error"
+)
+
+// Job outcomes
+const (
+	JobSuccess = "success"
+	JobFailure = "failure"
+)
+
+// Options is a configuration for New
+type Options struct {
+	// Namespace is prepended to every metric name, default is "lazyhttp"
+	Namespace string
+	// ConstLabels are added to every metric
+	ConstLabels prometheus.Labels
+	// Route maps a request URL to the route label, default is an empty label.
+	// Paths often carry IDs, map them to a bounded set of routes to keep the label cardinality low.
+	Route func(u *url.URL) string
+	// Buckets are the latency histogram buckets in seconds, default is prometheus.DefBuckets
+	Buckets []float64
+	// AgeBuckets are the served entry age buckets in seconds
+	AgeBuckets []float64
+}
+
+// Metrics holds every lazyhttp metric
+type Metrics struct {
+	route func(u *url.URL) string
+
+	requests        *prometheus.CounterVec
+	httpDuration    *prometheus.HistogramVec
+	redisDuration   *prometheus.HistogramVec
+	cacheLookups    *prometheus.CounterVec
+	hitRatio        prometheus.GaugeFunc
+	entryAge        prometheus.Histogram
+	publishFailures prometheus.Counter
+	queueLag        prometheus.Histogram
+	jobDuration     *prometheus.HistogramVec
+	deadLetters     prometheus.Counter
+	rawBytes        *prometheus.CounterVec
+	storedBytes     *prometheus.CounterVec
+	compression     prometheus.GaugeFunc
+
+	hits   int64
+	misses int64
+	// raw and stored are the body bytes of every codec, for CompressionRatio
+	raw    int64
+	stored int64
+}
+
+// New creates unregistered metrics
+func New(opts Options) *Metrics {
+	if opts.Namespace == "" {
+		opts.Namespace = "lazyhttp"
+	}
+	if opts.Route == nil {
+		opts.Route = func(u *url.URL) string { return "" }
+	}
+	if opts.Buckets == nil {
+		opts.Buckets = prometheus.DefBuckets
+	}
+	if opts.AgeBuckets == nil {
+		opts.AgeBuckets = []float64{1, 10, 60, 300, 900, 3600, 4 * 3600, 24 * 3600}
+	}
+
+	m := &Metrics{route: opts.Route}
+	m.requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Name:        "requests_total",
+		Help:        "Requests sent through the client by outcome.",
+		ConstLabels: opts.ConstLabels,
+	}, []string{"host", "route", "method", "outcome"})
+	m.httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   opts.Namespace,
+		Name:        "http_request_duration_seconds",
+		Help:        "Duration of the upstream HTTP leg.",
+		ConstLabels: opts.ConstLabels,
+		Buckets:     opts.Buckets,
+	}, []string{"host", "method"})
+	m.redisDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   opts.Namespace,
+		Name:        "redis_duration_seconds",
+		Help:        "Duration of redis operations.",
+		ConstLabels: opts.ConstLabels,
+		Buckets:     opts.Buckets,
+	}, []string{"op"})
+	m.cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Name:        "cache_lookups_total",
+		Help:        "Cache lookups by result.",
+		ConstLabels: opts.ConstLabels,
+	}, []string{"result"})
+	m.hitRatio = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   opts.Namespace,
+		Name:        "cache_hit_ratio",
+		Help:        "Ratio of cache lookups that found an entry since start.",
+		ConstLabels: opts.ConstLabels,
+	}, m.HitRatio)
+	m.entryAge = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace:   opts.Namespace,
+		Name:        "served_entry_age_seconds",
+		Help:        "Age of cache entries served instead of a live response.",
+		ConstLabels: opts.ConstLabels,
+		Buckets:     opts.AgeBuckets,
+	})
+	m.publishFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Name:        "publish_failures_total",
+		Help:        "Refresh jobs that could not be published.",
+		ConstLabels: opts.ConstLabels,
+	})
+	m.queueLag = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace:   opts.Namespace,
+		Name:        "consumer_queue_lag_seconds",
+		Help:        "Time between publishing a refresh job and the consumer picking it up.",
+		ConstLabels: opts.ConstLabels,
+		Buckets:     opts.Buckets,
+	})
+	m.jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   opts.Namespace,
+		Name:        "consumer_job_duration_seconds",
+		Help:        "Duration of refresh jobs processed by the consumer.",
+		ConstLabels: opts.ConstLabels,
+		Buckets:     opts.Buckets,
+	}, []string{"outcome"})
+	m.deadLetters = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Name:        "consumer_dead_letters_total",
+		Help:        "Failed refresh jobs moved to the dead-letter list to be retried.",
+		ConstLabels: opts.ConstLabels,
+	})
+	m.rawBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Name:        "compression_raw_bytes_total",
+		Help:        "Bytes of the response bodies stored with compression enabled, before compression.",
+		ConstLabels: opts.ConstLabels,
+	}, []string{"codec"})
+	m.storedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Name:        "compression_stored_bytes_total",
+		Help:        "Bytes of the response bodies stored with compression enabled, as stored.",
+		ConstLabels: opts.ConstLabels,
+	}, []string{"codec"})
+	m.compression = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   opts.Namespace,
+		Name:        "compression_ratio",
+		Help:        "Raw body bytes divided by stored body bytes since start, 0 before any compressed write.",
+		ConstLabels: opts.ConstLabels,
+	}, m.CompressionRatio)
+	return m
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.requests, m.httpDuration, m.redisDuration, m.cacheLookups, m.hitRatio,
+		m.entryAge, m.publishFailures, m.queueLag, m.jobDuration, m.deadLetters,
+		m.rawBytes, m.storedBytes, m.compression,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// ObserveRequest counts a finished request
+func (m *Metrics) ObserveRequest(u *url.URL, method string, outcome string) {
+	if m == nil {
+		return
+	}
+	var host, route string
+	if u != nil {
+		host = u.Host
+		route = m.route(u)
+	}
+	m.requests.WithLabelValues(host, route, method, outcome).Inc()
+}
+
+// ObserveHTTP records the duration of an upstream HTTP call
+func (m *Metrics) ObserveHTTP(host, method string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.httpDuration.WithLabelValues(host, method).Observe(d.Seconds())
+}
+
+// ObserveRedis records the duration of a redis operation
+func (m *Metrics) ObserveRedis(op string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.redisDuration.WithLabelValues(op).Observe(d.Seconds())
+}
+
+// CacheLookup counts a cache lookup, result is one of LookupHit, LookupMiss or LookupError
+func (m *Metrics) CacheLookup(result string) {
+	if m == nil {
+		return
+	}
+	switch result {
+	case LookupHit:
+		atomic.AddInt64(&m.hits, 1)
+	case LookupMiss:
+		atomic.AddInt64(&m.misses, 1)
+	}
+	m.cacheLookups.WithLabelValues(result).Inc()
+}
+
+// HitRatio returns hits / (hits + misses) since the metrics were created
+func (m *Metrics) HitRatio() float64 {
+	if m == nil {
+		return 0
+	}
+	hits := atomic.LoadInt64(&m.hits)
+	total := hits + atomic.LoadInt64(&m.misses)
+	if total == 0 {
+		return 0
+	}
+	return float64(hits) / float64(total)
+}
+
+// ObserveEntryAge records the age of a cache entry served to a caller
+func (m *Metrics) ObserveEntryAge(age time.Duration) {
+	if m == nil || age < 0 {
+		return
+	}
+	m.entryAge.Observe(age.Seconds())
+}
+
+// PublishFailed counts a refresh job that could not be published
+func (m *Metrics) PublishFailed() {
+	if m == nil {
+		return
+	}
+	m.publishFailures.Inc()
+}
+
+// ObserveQueueLag records the time a refresh job spent between publisher and consumer
+func (m *Metrics) ObserveQueueLag(lag time.Duration) {
+	if m == nil || lag < 0 {
+		return
+	}
+	m.queueLag.Observe(lag.Seconds())
+}
+
+// ObserveJob records a processed refresh job, outcome is JobSuccess or JobFailure
+func (m *Metrics) ObserveJob(outcome string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.jobDuration.WithLabelValues(outcome).Observe(d.Seconds())
+}
+
+// JobDeadLettered counts a failed refresh job kept in the dead-letter list for a retry
+func (m *Metrics) JobDeadLettered() {
+	if m == nil {
+		return
+	}
+	m.deadLetters.Inc()
+}
+
+// ObserveCompression records a body of raw bytes stored as stored bytes by codec
+func (m *Metrics) ObserveCompression(codec string, raw, stored int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.raw, int64(raw))
+	atomic.AddInt64(&m.stored, int64(stored))
+	m.rawBytes.WithLabelValues(codec).Add(float64(raw))
+	m.storedBytes.WithLabelValues(codec).Add(float64(stored))
+}
+
+// CompressionRatio returns raw / stored body bytes since the metrics were created, 2 means half the
+// memory. It is 0 before any body is stored with compression enabled.
+func (m *Metrics) CompressionRatio() float64 {
+	if m == nil {
+		return 0
+	}
+	stored := atomic.LoadInt64(&m.stored)
+	if stored == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&m.raw)) / float64(stored)
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gather returns the value of every counter and the sample count of every histogram of m, by name
+func gather(t *testing.T, m *Metrics) map[string]float64 {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			switch {
+			case metric.GetCounter() != nil:
+				values[family.GetName()] += metric.GetCounter().GetValue()
+			case metric.GetHistogram() != nil:
+				values[family.GetName()] += float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return values
+}
+
+func TestConsumerMetrics(t *testing.T) {
+	m := New(Options{})
+	m.ObserveJob(JobSuccess, time.Millisecond)
+	m.ObserveJob(JobFailure, time.Millisecond)
+	m.JobDeadLettered()
+	m.ObserveQueueLag(time.Second)
+
+	values := gather(t, m)
+	for name, want := range map[string]float64{
+		"lazyhttp_consumer_job_duration_seconds": 2,
+		"lazyhttp_consumer_dead_letters_total":   1,
+		"lazyhttp_consumer_queue_lag_seconds":    1,
+	} {
+		if values[name] != want {
+			t.Errorf("%s = %g, want %g", name, values[name], want)
+		}
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	m.ObserveJob(JobSuccess, time.Millisecond)
+	m.JobDeadLettered()
+	m.PublishFailed()
+}
@@ -0,0 +1,66 @@
+package lazyhttp
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/dendhi31/lazyhttp/cache"
+	"github.com/dendhi31/lazyhttp/logger"
+	"github.com/dendhi31/lazyhttp/metrics"
+)
+
+// Option replaces a component New would otherwise build from Config
+type Option func(*options)
+
+type options struct {
+	httpClient *http.Client
+	storage    cache.ContextCacher
+	pubsub     cache.ContextCacher
+	logger     logger.Logger
+	clock      func() time.Time
+	metrics    *metrics.Metrics
+}
+
+// WithHTTPClient sends the upstream requests through client, the transport settings of Config are ignored
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = client
+	}
+}
+
+// WithCacher stores the responses in cacher, New does not connect to the storage of Config.
+// Without WithPublisher and RedisHost, cacher carries the refresh jobs as well.
+func WithCacher(cacher cache.ContextCacher) Option {
+	return func(o *options) {
+		o.storage = cacher
+	}
+}
+
+// WithPublisher carries the refresh jobs, dead letters and invalidations through publisher,
+// New does not connect to RedisHost
+func WithPublisher(publisher cache.ContextCacher) Option {
+	return func(o *options) {
+		o.pubsub = publisher
+	}
+}
+
+// WithLogger overrides Config.Logger
+func WithLogger(log logger.Logger) Option {
+	return func(o *options) {
+		o.logger = log
+	}
+}
+
+// WithClock sets Client.Clock
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		o.clock = now
+	}
+}
+
+// WithMetrics overrides Config.Metrics
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
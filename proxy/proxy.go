@@ -0,0 +1,138 @@
+// Package proxy provides a caching reverse proxy built on lazyhttp.Client.
+//
+// It forwards to a single upstream like httputil.ReverseProxy does, and serves
+// the cached copy of cacheable routes when the upstream times out or errors:
+//
+//	handler := proxy.New(client, target,
+//		proxy.Route{Prefix: "/products/", Cacheable: true},
+//		proxy.Route{Prefix: "/", Cacheable: false},
+//	)
+//	http.ListenAndServe(":8080", handler)
+//
+// Cached responses are keyed by method and request URI only, so only mark routes
+// cacheable when their responses do not depend on the caller. Redirects of the upstream
+// are passed through to the client, and the request Host is kept as httputil does.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/dendhi31/lazyhttp"
+	"github.com/dendhi31/lazyhttp/logger"
+)
+
+// Route selects how requests under a path prefix are forwarded
+type Route struct {
+	// Prefix matches the request path, the longest matching prefix wins
+	Prefix string
+	// Methods are the cacheable methods of the route, default is GET and HEAD
+	Methods []string
+	// Cacheable routes go through the lazyhttp cache, others are only proxied
+	Cacheable bool
+	// Strategy default is lazyhttp.StrategyPessimistic
+	Strategy lazyhttp.Strategy
+	// Key derives the cache key, default is the method and the request URI
+	Key func(r *http.Request) string
+	// Tags derives the tags of the cached response, for lazyhttp.Client.InvalidateTags
+	Tags func(r *http.Request) []string
+}
+
+func (route *Route) allows(method string) bool {
+	if len(route.Methods) == 0 {
+		return method == http.MethodGet || method == http.MethodHead
+	}
+	for _, m := range route.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Proxy is an http.Handler forwarding to an upstream through a lazyhttp.Client
+type Proxy struct {
+	routes  []Route
+	reverse *httputil.ReverseProxy
+	log     logger.Logger
+}
+
+// New creates a proxy forwarding to target through client.
+// Requests matching no route are proxied without caching.
+func New(client *lazyhttp.Client, target *url.URL, routes ...Route) *Proxy {
+	var inner http.RoundTripper
+	if client.HTTPClient != nil {
+		inner = client.HTTPClient.Transport
+	}
+
+	p := &Proxy{
+		routes: routes,
+		log:    client.Logger,
+	}
+	if p.log == nil {
+		p.log = logger.Nop()
+	}
+	p.reverse = httputil.NewSingleHostReverseProxy(target)
+	p.reverse.Transport = lazyhttp.Transport(client, inner)
+	p.reverse.ErrorHandler = p.errorHandler
+	return p
+}
+
+// ServeHTTP implements http.Handler
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// callers must not pick keys or strategies on our behalf, a handler must not modify
+	// the request it is given, so the headers are removed from a copy
+	r = r.Clone(r.Context())
+	r.Header.Del(lazyhttp.CacheKeyHeader)
+	r.Header.Del(lazyhttp.StrategyHeader)
+	r.Header.Del(lazyhttp.TagsHeader)
+
+	if route := p.match(r.URL.Path); route != nil && route.Cacheable && route.allows(r.Method) {
+		strategy := route.Strategy
+		if strategy == "" {
+			strategy = lazyhttp.StrategyPessimistic
+		}
+		var key string
+		if route.Key != nil {
+			key = route.Key(r)
+		} else {
+			key = r.Method + " " + r.URL.RequestURI()
+		}
+		ctx := lazyhttp.WithStrategy(r.Context(), strategy)
+		ctx = lazyhttp.WithCacheKey(ctx, key)
+		if route.Tags != nil {
+			ctx = lazyhttp.WithTags(ctx, route.Tags(r)...)
+		}
+		r = r.WithContext(ctx)
+	}
+	p.reverse.ServeHTTP(w, r)
+}
+
+// match returns the route with the longest prefix of path
+func (p *Proxy) match(path string) *Route {
+	var best *Route
+	for i := range p.routes {
+		route := &p.routes[i]
+		if !strings.HasPrefix(path, route.Prefix) {
+			continue
+		}
+		if best == nil || len(route.Prefix) > len(best.Prefix) {
+			best = route
+		}
+	}
+	return best
+}
+
+func (p *Proxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	p.log.Warn("proxy request failed", "method", r.Method, "path", r.URL.Path, logger.KeyError, err)
+	w.Header().Set(lazyhttp.CacheStatusHeader, lazyhttp.CacheStatusMiss)
+	if errors.Is(err, context.DeadlineExceeded) {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
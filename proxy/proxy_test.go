@@ -0,0 +1,46 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/dendhi31/lazyhttp"
+	"github.com/dendhi31/lazyhttp/lazyhttptest"
+	"github.com/dendhi31/lazyhttp/proxy"
+)
+
+func TestProxyPassesRedirectsThrough(t *testing.T) {
+	h := lazyhttptest.New(t, lazyhttp.Config{})
+	h.Upstream.SetHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/products/old" {
+			http.Redirect(w, r, "/products/new", http.StatusFound)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	target, _ := url.Parse(h.Upstream.URL)
+	server := httptest.NewServer(proxy.New(h.Client, target, proxy.Route{Prefix: "/products/", Cacheable: true}))
+	defer server.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	resp, err := client.Get(server.URL + "/products/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("status %d, want the %d of the upstream", resp.StatusCode, http.StatusFound)
+	}
+	if got := resp.Header.Get("Location"); got != "/products/new" {
+		t.Errorf("Location %q, want %q", got, "/products/new")
+	}
+	if got := resp.Header.Get(lazyhttp.CacheStatusHeader); got != lazyhttp.CacheStatusMiss {
+		t.Errorf("%s %q, want %q", lazyhttp.CacheStatusHeader, got, lazyhttp.CacheStatusMiss)
+	}
+	h.AssertPathCalls("/products/old", 1)
+	h.AssertPathCalls("/products/new", 0)
+}
@@ -1,25 +1,50 @@
 package lazyhttp
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/dendhi31/lazyhttp/cache"
+	"github.com/dendhi31/lazyhttp/logger"
 	"github.com/dendhi31/lazyhttp/redismaint"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// DefaultChannel is the refresh channel used when Config.Channel is empty
+const DefaultChannel = "first"
+
+func (httprequest *Client) channel() string {
+	if httprequest.Channel == "" {
+		return DefaultChannel
+	}
+	return httprequest.Channel
+}
+
+// Consumer runs the refresh job consumer until SIGINT or SIGTERM
 func (httprequest *Client) Consumer() error {
 	config := redismaint.Configuration{
-		RedisURL:   httprequest.PubSubServer,
-		ContexName: "first",
-		Logger:     httprequest.Logger,
-		Handler:    httprequest.optimisticReq,
+		RedisURL:       httprequest.PubSubServer,
+		ContexName:     httprequest.channel(),
+		Logger:         httprequest.Logger,
+		Metrics:        httprequest.Metrics,
+		TracerProvider: httprequest.TracerProvider,
+		Propagator:     httprequest.propagator(),
+		Handler:        httprequest.optimisticReq,
+		DeadLetterKey:  httprequest.DeadLetterKey,
+		DeadLetterMax:  httprequest.DeadLetterMax,
+	}
+	if r, ok := httprequest.PubsubClient.(redismaint.Redis); ok {
+		config.Redis = r
+	} else if httprequest.PubsubClient != nil {
+		return fmt.Errorf("error create consumer: %T cannot subscribe to patterns", httprequest.PubsubClient)
 	}
 
 	rmaint, err := redismaint.New(config)
@@ -30,102 +55,253 @@ func (httprequest *Client) Consumer() error {
 	term := make(chan os.Signal, 1)
 	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
 
+	httprequest.consumer.Store(rmaint)
+	defer httprequest.consumer.Store(nil)
 	go func(r *redismaint.Consumer) {
-		httprequest.Logger.Debugln("lazyhttp consumer started")
+		httprequest.Logger.Info("lazyhttp consumer started")
 		r.Run()
 	}(rmaint)
 	//send sample schedule
 	select {
-	case <-rmaint.Err():
+	case err := <-rmaint.Err():
 		return err
 	case <-term:
-		httprequest.Logger.Debugln("lazyhttp consumer stopped")
+		httprequest.Logger.Info("lazyhttp consumer stopped")
 		rmaint.Stop()
 		return nil
 	}
 }
 
+// optimisticReq is the consumer handler, it fetches key from the upstream and stores the response.
+// It does not publish again on failure, dead letters are up to the consumer.
 func (httprequest *Client) optimisticReq(ctx context.Context, url string, action string, payload []byte, header map[string]string, key string) (int, []byte, error) {
-	var responseBody []byte
+	req := &Request{
+		URL:      url,
+		Method:   action,
+		Body:     payload,
+		Header:   header,
+		Key:      key,
+		UseCache: true,
+	}
+	if job, ok := redismaint.JobFromContext(ctx); ok {
+		req.Tags = job.Tags
+	}
+	return httprequest.fetch(ctx, req)
+}
+
+// fetch sends req to the upstream, bypassing the cache read, and stores a 200 response.
+// Other statuses are returned with a *StatusError.
+func (httprequest *Client) fetch(ctx context.Context, req *Request) (int, []byte, error) {
+	log := httprequest.requestLogger(ctx, req.URL, req.Header, req.Key)
+	httpRequest, err := newHTTPRequest(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	httpChan := make(chan httpChannel, 1)
+	httprequest.doRequest(ctx, log, newRequestEvent(ctx, req), httpRequest, req.Key, httpChan)
+	httpResult := <-httpChan
+	if httpResult.ErrorChan != nil {
+		return 0, nil, httpResult.ErrorChan
+	}
+	if httpResult.StatusCode != http.StatusOK {
+		return httpResult.StatusCode, httpResult.ResultChan, &StatusError{StatusCode: httpResult.StatusCode}
+	}
+	return httpResult.StatusCode, httpResult.ResultChan, nil
+}
+
+// optimistic serves from redis when it answers within WaitRedis, otherwise it asks the upstream.
+// When the upstream fails too, a refresh job is published for the consumer.
+func (httprequest *Client) optimistic(ctx context.Context, req *Request) (*Response, error) {
 	var err error
-	var code int
+	log := httprequest.requestLogger(ctx, req.URL, req.Header, req.Key)
+	event := requestEventFrom(ctx, req)
 
-	mCtx, cancel := context.WithTimeout(context.Background(), httprequest.WaitHttp*time.Millisecond)
+	mCtx, cancel := httprequest.waitContext(ctx)
 	defer cancel()
 
-	redisCtx, cancelRedis := context.WithTimeout(context.Background(), httprequest.WaitRedis*time.Millisecond)
+	redisCtx, cancelRedis := context.WithTimeout(context.WithoutCancel(ctx), httprequest.WaitRedis*time.Millisecond)
 	defer cancelRedis()
 
 	redisChan := make(chan redisChannel, 1)
 	httpChan := make(chan httpChannel, 1)
 
 	go func(ctx context.Context, client *Client, key string, channel chan redisChannel) {
-		client.getFromRedis(ctx, key, channel)
-	}(redisCtx, httprequest, key, redisChan)
+		client.getFromRedis(ctx, log, key, channel)
+	}(redisCtx, httprequest, req.Key, redisChan)
 
 	var redisResult redisChannel
 	var httpResult httpChannel
 	select {
 	case <-redisCtx.Done():
-		httprequest.Logger.Debugln("Redis wait got timeout", int(httprequest.WaitRedis))
+		log.Warn("redis wait got timeout", "wait_ms", int(httprequest.WaitRedis))
 		err = errors.New("context timeout redis")
 		redisResult.ErrorChan = err
 		break
-	case redisTempResult := <-redisChan:
-		if (redisChannel{}) != redisTempResult {
-			redisResult = redisTempResult
-		}
+	case redisResult = <-redisChan:
 		break
 	}
 
 	if (redisResult.ErrorChan == nil) && (redisResult.ResultChan != "") {
-		return http.StatusOK, []byte(redisResult.ResultChan), nil
+		log.Debug("request done", logger.KeyOutcome, OutcomeCacheHit)
+		age := httprequest.entryAge(redisResult.StoredAt)
+		httprequest.Metrics.ObserveRequest(requestURL(req.URL), req.Method, string(OutcomeCacheHit))
+		httprequest.Metrics.ObserveEntryAge(age)
+		recordOutcome(ctx, OutcomeCacheHit, age)
+		httprequest.hooks().StaleServed(ctx, &StaleEvent{
+			Request:  event,
+			Outcome:  OutcomeCacheHit,
+			StoredAt: redisResult.StoredAt,
+			Age:      age,
+		})
+		resp := cachedResponse(redisResult, age)
+		resp.Outcome = OutcomeCacheHit
+		return resp, nil
 	}
 
-	body := bytes.NewBuffer(payload)
-	httpRequest, err := http.NewRequest(action, url, body)
+	httpRequest, err := newHTTPRequest(req)
 	if err != nil {
-		return 0, responseBody, err
-	}
-	for k, v := range header {
-		httpRequest.Header.Set(k, v)
+		httprequest.Metrics.ObserveRequest(nil, req.Method, string(OutcomeError))
+		recordOutcome(ctx, OutcomeError, -1)
+		return nil, err
 	}
 	go func(ctx context.Context, http *http.Request, key string, channel chan httpChannel) {
-		httprequest.doRequest(ctx, http, key, channel)
-	}(mCtx, httpRequest, key, httpChan)
+		httprequest.doRequest(ctx, log, event, http, key, channel)
+	}(mCtx, httpRequest, req.Key, httpChan)
 exit:
 	for {
 		select {
 		case <-mCtx.Done():
-			httprequest.Logger.Debugln("HTTP wait got timeout", int(httprequest.WaitHttp))
-			err = errors.New("context timeout HTTP")
+			log.Debug("http wait got timeout", "wait_ms", int(httprequest.WaitHttp))
+			httpResult.ErrorChan = errors.New("context timeout HTTP")
 			break exit
 		case httpResult = <-httpChan:
-			responseBody = httpResult.ResultChan
-			code = http.StatusOK
-			err = httpResult.ErrorChan
 			break exit
 		}
 	}
-	if err != nil {
+	if upstreamFailed(req, httpResult) || httpResult.StatusCode != http.StatusOK {
+		httprequest.hooks().UpstreamFailed(ctx, &UpstreamFailureEvent{
+			Request:    event,
+			StatusCode: httpResult.StatusCode,
+			Err:        httpResult.ErrorChan,
+			Duration:   time.Since(event.StartedAt),
+		})
+	}
+	if httpResult.unmatched() {
+		// no refresh either, the consumer would find no fixture
+		httprequest.Metrics.ObserveRequest(httpRequest.URL, req.Method, string(OutcomeError))
+		recordOutcome(ctx, OutcomeError, -1)
+		log.Error("request failed", logger.KeyOutcome, OutcomeError, logger.KeyError, httpResult.ErrorChan)
+		return nil, httpResult.ErrorChan
+	}
+	if upstreamFailed(req, httpResult) {
 		//publish to redis
-		reqRequirement := redismaint.RequestRequirement{
-			Url:     url,
-			Action:  action,
-			Payload: payload,
-			Header:  header,
-			Key:     key,
+		reqRequirement := refreshJob(req)
+		log.Error("request failed", logger.KeyOutcome, OutcomeFallbackMiss, logger.KeyError, httpResult.upstreamErr())
+		httprequest.Metrics.ObserveRequest(httpRequest.URL, req.Method, string(OutcomeFallbackMiss))
+		recordOutcome(ctx, OutcomeFallbackMiss, -1)
+		// publish failures are logged and counted by publishRefresh, the caller gets the request error
+		_ = httprequest.publishRefresh(ctx, log, event, reqRequirement)
+		if httpResult.ErrorChan != nil {
+			return nil, httpResult.ErrorChan
 		}
-		reqJson, err := json.Marshal(reqRequirement)
-		if err != nil {
-			httprequest.Logger.Debugln("Error encode json: ", err.Error())
-			return 0, responseBody, err
-		}
-		err2 := httprequest.PubsubClient.Publish(httprequest.Channel, reqJson)
-		if err2 != nil {
-			httprequest.Logger.Debugln("Error publish message: ", err2.Error())
-		}
-		return 0, responseBody, err
+		// the upstream did answer, pass its error response through
+		return &Response{
+			StatusCode: httpResult.StatusCode,
+			Header:     httpResult.Header,
+			Body:       httpResult.ResultChan,
+			Outcome:    OutcomeFallbackMiss,
+			Age:        -1,
+		}, nil
+	}
+	log.Debug("request done", logger.KeyOutcome, OutcomeLive)
+	httprequest.Metrics.ObserveRequest(httpRequest.URL, req.Method, string(OutcomeLive))
+	recordOutcome(ctx, OutcomeLive, -1)
+	return &Response{
+		StatusCode: httpResult.StatusCode,
+		Header:     httpResult.Header,
+		Body:       httpResult.ResultChan,
+		Outcome:    OutcomeLive,
+		Age:        -1,
+	}, nil
+}
+
+// Refresh publishes a refresh job for req, the consumer fetches it and stores the response
+func (httprequest *Client) Refresh(ctx context.Context, req *Request) error {
+	log := httprequest.requestLogger(ctx, req.URL, req.Header, req.Key)
+	return httprequest.publishRefresh(ctx, log, newRequestEvent(ctx, req), refreshJob(req))
+}
+
+// refreshJob converts req to the job published to the consumer
+func refreshJob(req *Request) redismaint.RequestRequirement {
+	return redismaint.RequestRequirement{
+		Url:         req.URL,
+		Action:      req.Method,
+		Payload:     req.Body,
+		Header:      req.Header,
+		Key:         req.Key,
+		Tags:        req.Tags,
+		PublishedAt: time.Now(),
+	}
+}
+
+// publishRefresh publishes a refresh job for the consumer, carrying the trace context of ctx
+func (httprequest *Client) publishRefresh(ctx context.Context, log logger.Logger, event *RequestEvent, reqRequirement redismaint.RequestRequirement) error {
+	ctx, span := httprequest.tracer().Start(ctx, "lazyhttp.publish", trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attrChannel.String(httprequest.channel()), attrCacheKey.String(reqRequirement.Key)))
+
+	carrier := propagation.MapCarrier{}
+	httprequest.propagator().Inject(ctx, carrier)
+	if len(carrier) > 0 {
+		reqRequirement.TraceContext = carrier
+	}
+
+	reqJson, err := json.Marshal(reqRequirement)
+	if err != nil {
+		log.Error("unable to encode refresh job", logger.KeyError, err)
+		endSpan(span, err)
+		return err
+	}
+	// the job is published even when the caller is gone, it is what refreshes the entry
+	err = httprequest.PubsubClient.Publish(context.WithoutCancel(ctx), httprequest.channel(), reqJson)
+	endSpan(span, err)
+	httprequest.hooks().RefreshPublished(ctx, &RefreshEvent{
+		Request: event,
+		Channel: httprequest.channel(),
+		Err:     err,
+	})
+	if err != nil {
+		log.Error("unable to publish refresh job", "channel", httprequest.channel(), logger.KeyError, err)
+		httprequest.Metrics.PublishFailed()
+		return err
+	}
+	log.Debug("refresh job published", "channel", httprequest.channel())
+	return nil
+}
+
+// ConsumerRunning reports whether Consumer is running in this process
+func (httprequest *Client) ConsumerRunning() bool {
+	return httprequest.consumer.Load() != nil
+}
+
+// PendingRefreshes returns the refresh jobs the consumer of this process received and did not
+// process yet, false when no consumer runs in this process. Pub/sub keeps no backlog on the server,
+// so this is the whole refresh queue of the process.
+func (httprequest *Client) PendingRefreshes() (int, bool) {
+	consumer := httprequest.consumer.Load()
+	if consumer == nil {
+		return 0, false
+	}
+	return consumer.Pending(), true
+}
+
+// DeadLetters returns the number of jobs in the dead-letter list, 0 when DeadLetterKey is empty
+func (httprequest *Client) DeadLetters() (int64, error) {
+	if httprequest.DeadLetterKey == "" {
+		return 0, nil
+	}
+	lister, ok := httprequest.PubsubClient.(cache.Lister)
+	if !ok {
+		return 0, cache.ErrUnsupported
 	}
-	return code, responseBody, err
+	return lister.LLen(context.Background(), httprequest.DeadLetterKey)
 }
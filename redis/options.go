@@ -0,0 +1,168 @@
+package redis
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Topology selects the kind of redis deployment a client connects to
+type Topology string
+
+const (
+	// TopologyStandalone is a single redis server
+	TopologyStandalone Topology = "standalone"
+	// TopologyCluster is a redis cluster, Addrs are seed nodes
+	TopologyCluster Topology = "cluster"
+	// TopologySentinel is a master found through sentinels, Addrs are the sentinels
+	TopologySentinel Topology = "sentinel"
+	// TopologyRing shards keys by consistent hashing over independent servers
+	TopologyRing Topology = "ring"
+)
+
+// Options configures a client, zero values keep the go-redis defaults
+type Options struct {
+	// Topology default is standalone for one address and cluster for more
+	Topology Topology
+	// Addrs are the server, seed, sentinel or shard addresses depending on Topology.
+	// Ring shards may be named as name=host:port, they are named after their address otherwise.
+	Addrs []string
+	// MasterName is the sentinel master name
+	MasterName string
+	// DB is ignored by clusters
+	DB int
+
+	// Username is the ACL user, Password alone uses the legacy AUTH
+	Username string
+	Password string
+	// TLSConfig enables TLS
+	TLSConfig *tls.Config
+
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	PoolSize     int
+	MinIdleConns int
+	MaxRetries   int
+}
+
+// ResolvedTopology returns Topology, or the default for the number of Addrs when it is empty
+func (o Options) ResolvedTopology() Topology {
+	if o.Topology != "" {
+		return o.Topology
+	}
+	if len(o.Addrs) > 1 {
+		return TopologyCluster
+	}
+	return TopologyStandalone
+}
+
+// ringAddrs names the ring shards, the name decides which keys a shard owns
+func (o Options) ringAddrs() map[string]string {
+	addrs := make(map[string]string, len(o.Addrs))
+	for _, addr := range o.Addrs {
+		if name, host, ok := strings.Cut(addr, "="); ok {
+			addrs[name] = host
+		} else {
+			addrs[addr] = addr
+		}
+	}
+	return addrs
+}
+
+// createClient is function to create new redis client for the topology of options.
+// If no address is given, it returns an error.
+// Command deadlines follow the context, bounded by the read and write timeouts.
+func createClient(options Options) (redis.UniversalClient, error) {
+	var client redis.UniversalClient
+
+	if len(options.Addrs) == 0 {
+		return nil, errors.New("no host(s) found")
+	}
+
+	switch options.ResolvedTopology() {
+	case TopologyStandalone:
+		client = redis.NewClient(&redis.Options{
+			Addr:                  options.Addrs[0],
+			DB:                    options.DB,
+			Username:              options.Username,
+			Password:              options.Password,
+			TLSConfig:             options.TLSConfig,
+			DialTimeout:           options.DialTimeout,
+			ReadTimeout:           options.ReadTimeout,
+			WriteTimeout:          options.WriteTimeout,
+			ContextTimeoutEnabled: true,
+			PoolSize:              options.PoolSize,
+			MinIdleConns:          options.MinIdleConns,
+			MaxRetries:            options.MaxRetries,
+		})
+	case TopologyCluster:
+		client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:                 options.Addrs,
+			Username:              options.Username,
+			Password:              options.Password,
+			TLSConfig:             options.TLSConfig,
+			DialTimeout:           options.DialTimeout,
+			ReadTimeout:           options.ReadTimeout,
+			WriteTimeout:          options.WriteTimeout,
+			ContextTimeoutEnabled: true,
+			PoolSize:              options.PoolSize,
+			MinIdleConns:          options.MinIdleConns,
+			MaxRetries:            options.MaxRetries,
+		})
+	case TopologySentinel:
+		if options.MasterName == "" {
+			return nil, errors.New("sentinel topology needs a master name")
+		}
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:            options.MasterName,
+			SentinelAddrs:         options.Addrs,
+			DB:                    options.DB,
+			Username:              options.Username,
+			Password:              options.Password,
+			TLSConfig:             options.TLSConfig,
+			DialTimeout:           options.DialTimeout,
+			ReadTimeout:           options.ReadTimeout,
+			WriteTimeout:          options.WriteTimeout,
+			ContextTimeoutEnabled: true,
+			PoolSize:              options.PoolSize,
+			MinIdleConns:          options.MinIdleConns,
+			MaxRetries:            options.MaxRetries,
+		})
+	case TopologyRing:
+		client = redis.NewRing(&redis.RingOptions{
+			Addrs:                 options.ringAddrs(),
+			DB:                    options.DB,
+			Username:              options.Username,
+			Password:              options.Password,
+			TLSConfig:             options.TLSConfig,
+			DialTimeout:           options.DialTimeout,
+			ReadTimeout:           options.ReadTimeout,
+			WriteTimeout:          options.WriteTimeout,
+			ContextTimeoutEnabled: true,
+			PoolSize:              options.PoolSize,
+			MinIdleConns:          options.MinIdleConns,
+			MaxRetries:            options.MaxRetries,
+		})
+	default:
+		return nil, fmt.Errorf("unknown topology %q", options.Topology)
+	}
+
+	ctx := context.Background()
+	if options.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.DialTimeout)
+		defer cancel()
+	}
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
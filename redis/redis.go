@@ -1,117 +1,161 @@
 package redis
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"time"
 
-	"github.com/go-redis/redis"
-	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
 )
 
-// Clienter is an interface implementation for redis Client()
+var (
+	// ErrNotFound is returned when a key does not exist
+	ErrNotFound = errors.New("redis: key not found")
+	// ErrClosed is returned by the commands of a closed client
+	ErrClosed = errors.New("redis: client is closed")
+)
+
+// Clienter is an interface implementation for redis Client().
+// Every command gives up when ctx is done, the connection it used is discarded then.
 type Clienter interface {
-	Get(key string) (string, error)
-	Set(key string, value interface{}, ttl time.Duration) error
-	Remove(key string) error
-	Publish(channel string, value interface{}) error
-	Subscribe(channels ...string) *redis.PubSub
+	Get(ctx context.Context, key string) (string, error)
+	MGet(ctx context.Context, keys ...string) (map[string]string, error)
+	Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error
+	MSet(ctx context.Context, values map[string]interface{}, ttl time.Duration) error
+	Remove(ctx context.Context, key string) error
+	Exists(ctx context.Context, key string) (bool, error)
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+	Publish(ctx context.Context, channel string, value interface{}) error
+	Subscribe(ctx context.Context, channels ...string) (Subscription, error)
+	PSubscribe(ctx context.Context, patterns ...string) (Subscription, error)
+	Scan(ctx context.Context, pattern string, fn func(key string) error) error
+	Ping(ctx context.Context) error
+	LLen(ctx context.Context, key string) (int64, error)
+	SMembers(ctx context.Context, key string) ([]string, error)
+	SAdd(ctx context.Context, key string, ttl time.Duration, members ...string) error
+	PushCapped(ctx context.Context, key string, value interface{}, max int64) error
+	Close() error
 }
 
 // Client is struct representative for redis Client
 type Client struct {
-	clientMu sync.Mutex
-	client   redis.Cmdable
-	sentinel redis.SentinelClient
+	clientMu sync.RWMutex
+	client   redis.UniversalClient
+	closed   bool
+	// shared clients belong to the caller, Close leaves them open
+	shared bool
 
-	hosts       []string
-	dbName      int
-	readTimeout time.Duration
+	options Options
 }
 
 // Client is used to get existing redis client
 // if client is nil. then create new client
-func (c *Client) Client() (redis.Cmdable, error) {
-	if c.client == nil {
-		c.clientMu.Lock()
-		defer c.clientMu.Unlock()
-
-		var err error
-		c.client, err = createClient(c.hosts, c.dbName, c.readTimeout)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	return c.client, nil
+func (c *Client) Client() (redis.UniversalClient, error) {
+	return c.checkConnection()
 }
 
 // NewClient is an initialize redis client function
-// this will create new client and store into a pointer
+// this will create new client and store into a pointer.
+// One host is a single instance, more hosts are a cluster, see NewClientWithOptions for the other topologies.
 func NewClient(hosts []string, dbName int, readTimeout time.Duration) (*Client, error) {
-	client, err := createClient(hosts, dbName, readTimeout)
+	return NewClientWithOptions(Options{
+		Addrs:       hosts,
+		DB:          dbName,
+		ReadTimeout: readTimeout,
+	})
+}
+
+// NewClientWithOptions creates a client for the topology, auth, TLS and pool settings of options
+func NewClientWithOptions(options Options) (*Client, error) {
+	client, err := createClient(options)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Client{
-		client:      client,
-		hosts:       hosts,
-		dbName:      dbName,
-		readTimeout: readTimeout,
+		client:  client,
+		options: options,
 	}, nil
 }
 
-// createClient is function to create new redis client
-// if hosts is 1 , then create client for single instance redis
-// if hosts is more then 1 , create new redis cluster client
-// if hosts is 0, then return error
-func createClient(hosts []string, dbName int, readTimeout time.Duration) (redis.Cmdable, error) {
-	var client redis.Cmdable
-
-	if len(hosts) == 1 {
-		h := hosts[0]
-		client = redis.NewClient(&redis.Options{
-			Addr:        h,
-			DB:          dbName,
-			ReadTimeout: readTimeout,
-		})
-	} else if len(hosts) > 1 {
-		client = redis.NewClusterClient(&redis.ClusterOptions{
-			Addrs:       hosts,
-			ReadTimeout: readTimeout,
-		})
-	} else {
-		return nil, errors.New("no host(s) found")
+// Wrap uses an existing go-redis client, so a service can share its connections.
+// Close leaves client open, it is closed by its owner.
+func Wrap(client redis.UniversalClient) *Client {
+	return &Client{
+		client: client,
+		shared: true,
 	}
+}
 
-	_, err := client.Ping().Result()
-	if err != nil {
-		return nil, err
+// checkConnection returns the client, creating it when it is missing. Commands use the returned
+// client, c.client is only read under clientMu. Broken connections are redialed by the driver pool,
+// so a live client is not pinged: a ping per command would double the round trips.
+func (c *Client) checkConnection() (redis.UniversalClient, error) {
+	c.clientMu.RLock()
+	client, closed := c.client, c.closed
+	c.clientMu.RUnlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	if client != nil {
+		return client, nil
 	}
 
-	return client, nil
-}
-
-func (c *Client) checkConnection() error {
+	c.clientMu.Lock()
+	defer c.clientMu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
 	if c.client == nil {
-		c.clientMu.Lock()
-		newClient, err := createClient(c.hosts, c.dbName, c.readTimeout)
+		newClient, err := createClient(c.options)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		c.client = newClient
-		c.clientMu.Unlock()
-	} else {
-		if _, err := c.client.Ping().Result(); err != nil {
-			c.clientMu.Lock()
-			newClient, err := createClient(c.hosts, c.dbName, c.readTimeout)
-			if err != nil {
-				return err
-			}
-			c.client = newClient
-			c.clientMu.Unlock()
-		}
+	}
+	return c.client, nil
+}
+
+// Scan calls fn with every key matching pattern.
+// On a cluster every master is scanned and on a ring every shard, so each key is visited once.
+func (c *Client) Scan(ctx context.Context, pattern string, fn func(key string) error) error {
+	client, err := c.checkConnection()
+	if err != nil {
+		return err
 	}
 
-	return nil
+	if cluster, ok := client.(*redis.ClusterClient); ok {
+		// masters are scanned concurrently, fn is not
+		var mu sync.Mutex
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return scan(ctx, node, pattern, func(key string) error {
+				mu.Lock()
+				defer mu.Unlock()
+				return fn(key)
+			})
+		})
+	}
+	if ring, ok := client.(*redis.Ring); ok {
+		var mu sync.Mutex
+		return ring.ForEachShard(ctx, func(ctx context.Context, shard *redis.Client) error {
+			return scan(ctx, shard, pattern, func(key string) error {
+				mu.Lock()
+				defer mu.Unlock()
+				return fn(key)
+			})
+		})
+	}
+	return scan(ctx, client, pattern, fn)
+}
+
+func scan(ctx context.Context, client redis.Cmdable, pattern string, fn func(key string) error) error {
+	iter := client.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		if err := fn(iter.Val()); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
 }
@@ -1,60 +1,261 @@
 package redis
 
 import (
+	"context"
 	"time"
 
-	"github.com/go-redis/redis"
+	"github.com/redis/go-redis/v9"
 )
 
-// Get will return a certain value based on Key
-func (c *Client) Get(key string) (string, error) {
-	err := c.checkConnection()
+// Get will return a certain value based on Key, ErrNotFound when the key does not exist
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	client, err := c.checkConnection()
 	if err != nil {
 		return "", err
 	}
 
-	result, err := c.client.Get(key).Result()
-
+	result, err := client.Get(ctx, key).Result()
 	if err == redis.Nil {
-		err = nil
+		return "", ErrNotFound
 	}
 
 	return result, err
 }
 
+// MGet returns the values of the keys that exist, in a single round trip.
+// A cluster gets one MGET per hash slot and a ring one GET per key, all in the same pipeline.
+func (c *Client) MGet(ctx context.Context, keys ...string) (map[string]string, error) {
+	client, err := c.checkConnection()
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(keys))
+	if len(keys) == 0 {
+		return values, nil
+	}
+
+	var groups [][]string
+	switch client.(type) {
+	case *redis.ClusterClient:
+		groups = groupBySlot(keys)
+	case *redis.Ring:
+		groups = make([][]string, len(keys))
+		for i, key := range keys {
+			groups[i] = []string{key}
+		}
+	default:
+		groups = [][]string{keys}
+	}
+
+	pipe := client.Pipeline()
+	cmds := make([]*redis.SliceCmd, len(groups))
+	for i, group := range groups {
+		cmds[i] = pipe.MGet(ctx, group...)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		for j, value := range cmd.Val() {
+			if s, ok := value.(string); ok {
+				values[groups[i][j]] = s
+			}
+		}
+	}
+	return values, nil
+}
+
 // Set will store a key-value pair to Cache
-func (c *Client) Set(key string, value interface{}, ttl time.Duration) error {
-	err := c.checkConnection()
+func (c *Client) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	client, err := c.checkConnection()
+	if err != nil {
+		return err
+	}
+
+	return client.Set(ctx, key, value, ttl).Err()
+}
+
+// MSet stores every key-value pair of values with the same ttl, in a single round trip
+func (c *Client) MSet(ctx context.Context, values map[string]interface{}, ttl time.Duration) error {
+	client, err := c.checkConnection()
 	if err != nil {
 		return err
 	}
+	if len(values) == 0 {
+		return nil
+	}
 
-	return c.client.Set(key, value, ttl).Err()
+	// MSET has no ttl, one SET per key also lets a cluster route them to their slot
+	pipe := client.Pipeline()
+	for key, value := range values {
+		pipe.Set(ctx, key, value, ttl)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
 }
 
 // Remove will remove a value from Cache based on desired key
-func (c *Client) Remove(key string) error {
-	err := c.checkConnection()
+func (c *Client) Remove(ctx context.Context, key string) error {
+	client, err := c.checkConnection()
 	if err != nil {
 		return err
 	}
 
-	return c.client.Del(key).Err()
+	return client.Del(ctx, key).Err()
 }
 
-func (c *Client) Publish(channel string, value interface{}) error {
-	err := c.checkConnection()
+// Exists reports whether key exists
+func (c *Client) Exists(ctx context.Context, key string) (bool, error) {
+	client, err := c.checkConnection()
+	if err != nil {
+		return false, err
+	}
+
+	n, err := client.Exists(ctx, key).Result()
+	return n > 0, err
+}
+
+// TTL returns the remaining time to live of key, 0 when it does not expire
+// and ErrNotFound when it does not exist
+func (c *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	client, err := c.checkConnection()
+	if err != nil {
+		return 0, err
+	}
+
+	ttl, err := client.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	// the driver returns the -1 and -2 replies as is
+	switch {
+	case ttl == -2:
+		return 0, ErrNotFound
+	case ttl < 0:
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+// Expire sets the time to live of key, ErrNotFound when it does not exist
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	client, err := c.checkConnection()
 	if err != nil {
 		return err
 	}
 
-	return c.client.Publish(channel, value).Err()
+	ok, err := client.PExpire(ctx, key, ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotFound
+	}
+	return nil
 }
 
-func (c *Client) Subscribe(channels ...string) *redis.PubSub {
-	err := c.checkConnection()
+func (c *Client) Publish(ctx context.Context, channel string, value interface{}) error {
+	client, err := c.checkConnection()
 	if err != nil {
-		return nil
+		return err
+	}
+
+	return client.Publish(ctx, channel, value).Err()
+}
+
+// Subscribe subscribes to channels
+func (c *Client) Subscribe(ctx context.Context, channels ...string) (Subscription, error) {
+	client, err := c.checkConnection()
+	if err != nil {
+		return nil, err
+	}
+	return newSubscription(ctx, client.Subscribe(ctx, channels...))
+}
+
+// PSubscribe subscribes to the channels matching patterns
+func (c *Client) PSubscribe(ctx context.Context, patterns ...string) (Subscription, error) {
+	client, err := c.checkConnection()
+	if err != nil {
+		return nil, err
+	}
+	return newSubscription(ctx, client.PSubscribe(ctx, patterns...))
+}
+
+// Ping checks the server answers
+func (c *Client) Ping(ctx context.Context) error {
+	client, err := c.checkConnection()
+	if err != nil {
+		return err
+	}
+
+	return client.Ping(ctx).Err()
+}
+
+// LLen returns the length of the list stored at key
+func (c *Client) LLen(ctx context.Context, key string) (int64, error) {
+	client, err := c.checkConnection()
+	if err != nil {
+		return 0, err
+	}
+
+	return client.LLen(ctx, key).Result()
+}
+
+// SMembers returns the members of the set stored at key
+func (c *Client) SMembers(ctx context.Context, key string) ([]string, error) {
+	client, err := c.checkConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.SMembers(ctx, key).Result()
+}
+
+// SAdd adds members to the set stored at key, and sets its ttl when it is not 0
+func (c *Client) SAdd(ctx context.Context, key string, ttl time.Duration, members ...string) error {
+	client, err := c.checkConnection()
+	if err != nil {
+		return err
+	}
+
+	values := make([]interface{}, len(members))
+	for i, member := range members {
+		values[i] = member
+	}
+	// both commands are on the same key, so the pipeline is sent to a single node on a cluster
+	pipe := client.Pipeline()
+	pipe.SAdd(ctx, key, values...)
+	if ttl > 0 {
+		pipe.PExpire(ctx, key, ttl)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Close closes the connections of the client
+func (c *Client) Close() error {
+	c.clientMu.Lock()
+	defer c.clientMu.Unlock()
+	c.closed = true
+	if c.client != nil && !c.shared {
+		return c.client.Close()
+	}
+	return nil
+}
+
+// PushCapped appends value to the list stored at key, keeping its last max entries when max is above 0
+func (c *Client) PushCapped(ctx context.Context, key string, value interface{}, max int64) error {
+	client, err := c.checkConnection()
+	if err != nil {
+		return err
+	}
+
+	// both commands are on the same key, so the pipeline is sent to a single node on a cluster
+	pipe := client.Pipeline()
+	pipe.RPush(ctx, key, value)
+	if max > 0 {
+		pipe.LTrim(ctx, key, -max, -1)
 	}
-	return c.sentinel.Subscribe(channels...)
+	_, err = pipe.Exec(ctx)
+	return err
 }
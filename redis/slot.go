@@ -0,0 +1,49 @@
+package redis
+
+import "strings"
+
+// slots is the number of hash slots of a redis cluster
+const slots = 16384
+
+// slot returns the cluster hash slot of key, only the {hash tag} is hashed when there is one
+func slot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % slots)
+}
+
+// groupBySlot splits keys in groups sharing a hash slot, in the order the slots are first seen
+func groupBySlot(keys []string) [][]string {
+	index := make(map[int]int)
+	var groups [][]string
+	for _, key := range keys {
+		s := slot(key)
+		i, ok := index[s]
+		if !ok {
+			i = len(groups)
+			index[s] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], key)
+	}
+	return groups
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum redis cluster hashes keys with
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
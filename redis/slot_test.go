@@ -0,0 +1,49 @@
+package redis
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSlot(t *testing.T) {
+	for key, want := range map[string]int{
+		// the examples of the redis cluster specification
+		"123456789": 12739,
+		"foo":       12182,
+		// only the first {hash tag} is hashed, an empty one is not a tag
+		"{123456789}.a": 12739,
+		"a{foo}{bar}":   12182,
+	} {
+		if got := slot(key); got != want {
+			t.Errorf("slot(%q) = %d, want %d", key, got, want)
+		}
+	}
+	if slot("{}foo") == slot("foo") {
+		t.Error("an empty hash tag hashed only the rest of the key")
+	}
+}
+
+func TestGroupBySlot(t *testing.T) {
+	keys := []string{
+		"{user:1}/profile",
+		"{user:2}/profile",
+		// a chunked entry: the manifest and the chunks of a tagged key share its slot
+		"{user:1}/feed",
+		"{user:1}/feed:chunk:v1:0",
+		"{user:1}/feed:chunk:v1:1",
+		"{user:2}/feed",
+	}
+	want := [][]string{
+		{"{user:1}/profile", "{user:1}/feed", "{user:1}/feed:chunk:v1:0", "{user:1}/feed:chunk:v1:1"},
+		{"{user:2}/profile", "{user:2}/feed"},
+	}
+	if got := groupBySlot(keys); !reflect.DeepEqual(got, want) {
+		t.Errorf("groupBySlot = %q, want %q", got, want)
+	}
+
+	// the chunks of an untagged key are in other slots than their manifest
+	groups := groupBySlot([]string{"a", "a:chunk:v1:0", "a"})
+	if len(groups) != 2 || !reflect.DeepEqual(groups[0], []string{"a", "a"}) {
+		t.Errorf("groupBySlot = %q, want a, then its chunk apart", groups)
+	}
+}
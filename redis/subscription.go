@@ -0,0 +1,64 @@
+package redis
+
+import (
+	"context"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Message is a message received on a subscription
+type Message struct {
+	Channel string
+	// Pattern is the pattern the channel matched, empty for plain subscriptions
+	Pattern string
+	Payload string
+}
+
+// Subscription delivers the messages of subscribed channels. The driver reconnects on its own,
+// messages published while it is disconnected are lost.
+type Subscription interface {
+	// Channel is closed once the subscription is closed
+	Channel() <-chan *Message
+	Close() error
+}
+
+type subscription struct {
+	pubsub    *redis.PubSub
+	ch        chan *Message
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSubscription(ctx context.Context, pubsub *redis.PubSub) (*subscription, error) {
+	// the first reply confirms the subscription, so a failure is reported here and not lost
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	s := &subscription{pubsub: pubsub, ch: make(chan *Message, 100), done: make(chan struct{})}
+	go func() {
+		defer close(s.ch)
+		for msg := range pubsub.Channel() {
+			// a reader gone after Close must not keep the goroutine blocked
+			select {
+			case s.ch <- &Message{Channel: msg.Channel, Pattern: msg.Pattern, Payload: msg.Payload}:
+			case <-s.done:
+				// the driver stops once it sees the closed connection, until then it waits for a reader
+				for range pubsub.Channel() {
+				}
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (s *subscription) Channel() <-chan *Message {
+	return s.ch
+}
+
+func (s *subscription) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return s.pubsub.Close()
+}
@@ -0,0 +1,41 @@
+package redismaint
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/dendhi31/lazyhttp/logger"
+)
+
+// DeadLetter is a job that failed, kept for inspection and replay
+type DeadLetter struct {
+	Job      RequestRequirement `json:"job"`
+	Error    string             `json:"error"`
+	FailedAt time.Time          `json:"failed_at"`
+}
+
+// deadLetter appends a failed job to the dead-letter list, trimmed to deadLetterMax entries
+func (m *Consumer) deadLetter(ctx context.Context, log logger.Logger, req RequestRequirement, cause error) {
+	if m.deadLetterKey == "" {
+		return
+	}
+	// the trace of the failed attempt is over, a replay starts a new one
+	req.TraceContext = nil
+	entry, err := json.Marshal(DeadLetter{
+		Job:      req,
+		Error:    cause.Error(),
+		FailedAt: time.Now(),
+	})
+	if err != nil {
+		log.Error("unable to encode dead letter", logger.KeyError, err)
+		return
+	}
+
+	if err := m.rclt.(DeadLetterStore).PushCapped(ctx, m.deadLetterKey, entry, m.deadLetterMax); err != nil {
+		log.Error("unable to store dead letter", "dead_letter_key", m.deadLetterKey, logger.KeyError, err)
+		return
+	}
+	m.Metrics.JobDeadLettered()
+	log.Debug("job moved to dead letters", "dead_letter_key", m.deadLetterKey)
+}
@@ -3,19 +3,27 @@ package redismaint
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dendhi31/lazyhttp/logger"
+	"github.com/dendhi31/lazyhttp/metrics"
+	"github.com/dendhi31/lazyhttp/redis"
 
-	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type (
 	SendRequestWithPubSub func(ctx context.Context, url string, action string, payload []byte, header map[string]string, key string) (int, []byte, error)
 )
 
-//EventMessage as a message
+// EventMessage as a message
 type EventMessage struct {
 	ID string `json:"id"`
 }
@@ -26,101 +34,210 @@ type RequestRequirement struct {
 	Payload []byte            `json:"payload"`
 	Header  map[string]string `json:"header"`
 	Key     string            `json:"key"`
+	// Tags are attached to the refreshed response
+	Tags []string `json:"tags,omitempty"`
+	// PublishedAt is used to measure the queue lag, it is empty for jobs from older publishers
+	PublishedAt time.Time `json:"published_at,omitempty"`
+	// TraceContext carries the publisher trace, so processing continues the same trace
+	TraceContext map[string]string `json:"trace_context,omitempty"`
 }
 
-//Consumer structure
+type jobKey struct{}
+
+// JobFromContext returns the job a handler is called for, it carries the fields
+// the handler arguments do not have
+func JobFromContext(ctx context.Context) (RequestRequirement, bool) {
+	job, ok := ctx.Value(jobKey{}).(RequestRequirement)
+	return job, ok
+}
+
+// Redis is what the consumer needs from redis, it is implemented by redis.Client and cache.Client
+type Redis interface {
+	PSubscribe(ctx context.Context, patterns ...string) (redis.Subscription, error)
+}
+
+// DeadLetterStore keeps the dead letters, a Redis implementing it is required by DeadLetterKey
+type DeadLetterStore interface {
+	PushCapped(ctx context.Context, key string, value interface{}, max int64) error
+}
+
+// Consumer structure
 type Consumer struct {
-	rclt    *redisc
+	rclt    Redis
+	closer  func() error
 	hkey    string
 	echan   chan error
 	schan   chan bool
 	Logger  logger.Logger
+	Metrics *metrics.Metrics
 	handler SendRequestWithPubSub
 
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+
 	sleepDuration time.Duration
+	deadLetterKey string
+	deadLetterMax int64
+
+	mu         sync.Mutex
+	messages   <-chan *redis.Message
+	processing atomic.Bool
 }
 
-//Configuration as consumer preferences
+// Configuration as consumer preferences
 type Configuration struct {
+	// Redis is the connection jobs are consumed from, it is dialed from RedisURL when nil
+	Redis         Redis
 	RedisURL      string
 	ContexName    string
 	SleepDuration time.Duration
 	Handler       SendRequestWithPubSub
 	Logger        logger.Logger
+	Metrics       *metrics.Metrics
+	// TracerProvider and Propagator default to the otel globals
+	TracerProvider trace.TracerProvider
+	Propagator     propagation.TextMapPropagator
+	// DeadLetterKey is the redis list failed jobs are appended to, empty disables it
+	DeadLetterKey string
+	// DeadLetterMax caps the dead-letter list, oldest entries are dropped, 0 is unbounded
+	DeadLetterMax int64
 }
 
-//New creates new redis maintenance
+// New creates new redis maintenance
 func New(config Configuration) (*Consumer, error) {
-	rclt, err := dial(config.RedisURL)
-	if err != nil {
-		return nil, err
+	rclt := config.Redis
+	var closer func() error
+	if rclt == nil {
+		if config.RedisURL == "" {
+			return nil, errors.New("empty string url")
+		}
+		client, err := redis.NewClient([]string{config.RedisURL}, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		rclt, closer = client, client.Close
+	}
+	if _, ok := rclt.(DeadLetterStore); config.DeadLetterKey != "" && !ok {
+		return nil, errors.New("redis connection cannot keep dead letters")
+	}
+	if config.Logger == nil {
+		config.Logger = logger.Nop()
+	}
+	if config.TracerProvider == nil {
+		config.TracerProvider = otel.GetTracerProvider()
+	}
+	if config.Propagator == nil {
+		config.Propagator = otel.GetTextMapPropagator()
 	}
 	return &Consumer{
 		rclt:          rclt,
+		closer:        closer,
 		hkey:          config.ContexName,
 		echan:         make(chan error, 1),
 		schan:         make(chan bool, 1),
 		Logger:        config.Logger,
 		sleepDuration: config.SleepDuration,
 		handler:       config.Handler,
+		Metrics:       config.Metrics,
+		deadLetterKey: config.DeadLetterKey,
+		deadLetterMax: config.DeadLetterMax,
+		tracer:        config.TracerProvider.Tracer("github.com/dendhi31/lazyhttp/redismaint"),
+		propagator:    config.Propagator,
 	}, nil
 }
 
-//Run runs the consumer
+// Run runs the consumer until Stop is called, a failure is sent on Err
 func (m *Consumer) Run() {
-	rc := m.rclt.gconn()
-	psc := redis.PubSubConn{
-		Conn: rc,
-	}
-	key := fmt.Sprintf("%s", m.hkey)
-	if err := psc.PSubscribe(key); err != nil {
+	sub, err := m.rclt.PSubscribe(context.Background(), m.hkey)
+	if err != nil {
 		m.echan <- err
 		return
 	}
+	messages := sub.Channel()
+	m.mu.Lock()
+	m.messages = messages
+	m.mu.Unlock()
 	for {
 		select {
 		case <-m.schan:
-			err := rc.Close()
+			err := sub.Close()
 			if err != nil {
-				m.Logger.Debugln("err", err)
+				m.Logger.Warn("unable to close pubsub connection", logger.KeyError, err)
 			}
-			err = psc.Close()
-			if err != nil {
-				m.Logger.Debugln("err", err)
+			if m.closer != nil {
+				if cerr := m.closer(); cerr != nil {
+					m.Logger.Warn("unable to close redis connection", logger.KeyError, cerr)
+				}
 			}
 			m.echan <- err
 			return
-		default:
-			switch msg := psc.Receive().(type) {
-			case redis.Message:
-				m.process(msg.Data)
+		case msg, ok := <-messages:
+			if !ok {
+				m.echan <- errors.New("subscription closed")
+				return
 			}
+			m.processing.Store(true)
+			m.process([]byte(msg.Payload))
+			m.processing.Store(false)
 		}
 	}
 }
 
-//Err returns error channel
+// Pending returns the number of jobs received and not processed yet, the one in progress included.
+// Jobs still buffered by the redis driver are not counted.
+func (m *Consumer) Pending() int {
+	m.mu.Lock()
+	n := len(m.messages)
+	m.mu.Unlock()
+	if m.processing.Load() {
+		n++
+	}
+	return n
+}
+
+// Err returns error channel
 func (m *Consumer) Err() <-chan error {
 	return m.echan
 }
 
-//Stop set stop flag
+// Stop set stop flag
 func (m *Consumer) Stop() {
 	m.schan <- true
 }
 
 func (m *Consumer) process(bytes []byte) {
 	var req RequestRequirement
-	m.Logger.Debugln("incoming message: ", string(bytes))
+	m.Logger.Debug("incoming message", "size", len(bytes))
 	err := json.Unmarshal(bytes, &req)
 	if err != nil {
-		m.Logger.Debugln("err", err)
+		m.Logger.Error("unable to decode message", logger.KeyError, err)
 		return
 	}
-	_, _, err = m.handler(context.Background(), req.Url, req.Action, req.Payload, req.Header, req.Key)
+	log := m.Logger.With(logger.KeyCacheKey, req.Key)
+	if !req.PublishedAt.IsZero() {
+		m.Metrics.ObserveQueueLag(time.Since(req.PublishedAt))
+	}
+
+	ctx := m.propagator.Extract(context.Background(), propagation.MapCarrier(req.TraceContext))
+	ctx, span := m.tracer.Start(ctx, "lazyhttp.consume", trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.destination.name", m.hkey),
+			attribute.String("lazyhttp.cache.key", req.Key),
+		))
+	defer span.End()
+	ctx = context.WithValue(ctx, jobKey{}, req)
+
+	start := time.Now()
+	_, _, err = m.handler(ctx, req.Url, req.Action, req.Payload, req.Header, req.Key)
 	if err != nil {
-		m.Logger.Debugln("err", err)
+		m.Metrics.ObserveJob(metrics.JobFailure, time.Since(start))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		log.Error("refresh failed", logger.KeyError, err)
+		m.deadLetter(ctx, log, req, err)
 		return
 	}
+	m.Metrics.ObserveJob(metrics.JobSuccess, time.Since(start))
+	log.Debug("refresh done")
 	return
 }
@@ -0,0 +1,102 @@
+package lazyhttp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dendhi31/lazyhttp/redis"
+)
+
+// RedisOptions configures the connections to a redis deployment, durations are in milliseconds.
+// Zero values keep the driver defaults.
+type RedisOptions struct {
+	// Topology is standalone, cluster, sentinel or ring, default is standalone
+	// for one address and cluster for more
+	Topology string
+	// MasterName is the sentinel master name, the addresses are the sentinels then
+	MasterName string
+
+	// Username is the ACL user, leave it empty to AUTH with Password only
+	Username string
+	Password string
+
+	// TLS enables TLS with the system roots, it is implied by the other TLS fields
+	TLS bool
+	// TLSCAFile is a PEM bundle of the CAs trusted for the server certificate
+	TLSCAFile string
+	// TLSCertFile and TLSKeyFile are the PEM client certificate and key
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSServerName overrides the name checked in the server certificate
+	TLSServerName string
+	// TLSInsecureSkipVerify disables the server certificate check, only use it for testing
+	TLSInsecureSkipVerify bool
+	// TLSConfig is used as is when set, the other TLS fields are ignored
+	TLSConfig *tls.Config `json:"-"`
+
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	PoolSize     int
+	MinIdleConns int
+	MaxRetries   int
+}
+
+// Options returns the redis package options of a connection to addrs
+func (o RedisOptions) Options(addrs []string, db int) (redis.Options, error) {
+	tlsConfig, err := o.tlsConfig()
+	if err != nil {
+		return redis.Options{}, err
+	}
+	return redis.Options{
+		Topology:     redis.Topology(o.Topology),
+		Addrs:        addrs,
+		MasterName:   o.MasterName,
+		DB:           db,
+		Username:     o.Username,
+		Password:     o.Password,
+		TLSConfig:    tlsConfig,
+		DialTimeout:  o.DialTimeout * time.Millisecond,
+		ReadTimeout:  o.ReadTimeout * time.Millisecond,
+		WriteTimeout: o.WriteTimeout * time.Millisecond,
+		PoolSize:     o.PoolSize,
+		MinIdleConns: o.MinIdleConns,
+		MaxRetries:   o.MaxRetries,
+	}, nil
+}
+
+func (o RedisOptions) tlsConfig() (*tls.Config, error) {
+	if o.TLSConfig != nil {
+		return o.TLSConfig, nil
+	}
+	if !o.TLS && o.TLSCAFile == "" && o.TLSCertFile == "" && o.TLSKeyFile == "" && o.TLSServerName == "" && !o.TLSInsecureSkipVerify {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName:         o.TLSServerName,
+		InsecureSkipVerify: o.TLSInsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if o.TLSCAFile != "" {
+		pem, err := os.ReadFile(o.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error read redis CA bundle: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", o.TLSCAFile)
+		}
+	}
+	if o.TLSCertFile != "" || o.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.TLSCertFile, o.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error load redis client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
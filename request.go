@@ -6,14 +6,21 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
-	"os"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dendhi31/lazyhttp/cache"
+	"github.com/dendhi31/lazyhttp/cache/disk"
+	"github.com/dendhi31/lazyhttp/cache/memcached"
 	"github.com/dendhi31/lazyhttp/logger"
+	"github.com/dendhi31/lazyhttp/metrics"
+	"github.com/dendhi31/lazyhttp/redismaint"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Config is a configuration that will be used when constructing a new instance of Requestor
@@ -34,6 +41,11 @@ type Config struct {
 	HTTPRequestTimeout time.Duration
 
 	RedisHost string
+	// PubSubHosts are the pubsub addresses for a topology with several, like cluster nodes or sentinels.
+	// RedisHost is used when it is empty.
+	PubSubHosts []string
+	// PubSubRedis configures the pubsub connections: refresh jobs, dead letters and invalidations
+	PubSubRedis RedisOptions
 
 	StorageHostServer    []string
 	StorageDB            int
@@ -41,8 +53,60 @@ type Config struct {
 	ExpiryTime           time.Duration
 	StorageTimeout       time.Duration
 	Channel              string
+	// StorageRedis configures the StorageHostServer connections
+	StorageRedis RedisOptions
+	// StorageDisk stores the responses in a local file when its Path is set
+	StorageDisk DiskOptions
+	// StorageMemcached stores the responses in memcached when its Servers are set
+	StorageMemcached MemcachedOptions
+
+	// DeadLetterKey is the redis list, on RedisHost, failed refresh jobs are kept in.
+	// Empty disables dead letters.
+	DeadLetterKey string
+	// DeadLetterMax caps the dead-letter list, 0 is unbounded
+	DeadLetterMax int64
+
+	// LocalCacheTTL enables an in-process copy of the cached responses, kept for this long in milliseconds.
+	// Instances keep their copies in sync through InvalidationChannel, the ttl bounds the staleness
+	// when a message is missed, so keep it short.
+	LocalCacheTTL time.Duration
+	// LocalCacheSize caps the number of local entries, default is 10000
+	LocalCacheSize int
+	// InvalidationChannel is the control channel, on RedisHost, default is DefaultInvalidationChannel
+	InvalidationChannel string
+
+	// BatchConcurrency caps the upstream requests in flight for one DoBatch call, default is 8
+	BatchConcurrency int
+
+	// Fixtures records the upstream responses to files, or replays them instead of calling the upstream
+	Fixtures FixtureOptions
+
+	// StoreEnvelope stores the responses with their status, headers and storage time, so cached responses
+	// carry their headers and age. Otherwise the raw body is stored. Entries of both formats are read
+	// whatever it is, but versions predating envelopes serve an envelope as the body: enable it once every
+	// instance reading the cache runs this version.
+	StoreEnvelope bool
+	// Compression compresses the stored bodies of at least MinSize bytes, entries are readable whatever it is.
+	// It requires StoreEnvelope.
+	Compression cache.Compression
+
+	// MaxBodySize caps the upstream response bodies in bytes, a larger body fails like an upstream error
+	// and falls back to the cache. 0 is unbounded.
+	MaxBodySize int64
+	// Chunking stores the bodies above its Threshold as several keys and a manifest, it requires StoreEnvelope.
+	// Its Grace is a time.Duration, not milliseconds.
+	Chunking cache.Chunking
 
 	Debug bool
+	// Logger overrides the default logger, Debug is ignored when it is set
+	Logger logger.Logger
+	// Metrics is optional, when set the client and its consumer record into it
+	Metrics *metrics.Metrics
+	// TracerProvider and Propagator default to the otel globals
+	TracerProvider trace.TracerProvider
+	Propagator     propagation.TextMapPropagator
+	// Hooks receives the client lifecycle events
+	Hooks Hooks
 }
 
 //type Requestor interface {
@@ -52,8 +116,8 @@ type Config struct {
 // Client will handle http request response by extending go http.Client package
 type Client struct {
 	HTTPClient         *http.Client
-	CacheClient        cache.Cacher
-	PubsubClient       cache.Cacher
+	CacheClient        cache.ContextCacher
+	PubsubClient       cache.ContextCacher
 	ExpiryTime         time.Duration
 	MainTimeOut        time.Duration
 	WaitHttp           time.Duration
@@ -61,64 +125,203 @@ type Client struct {
 	HTTPRequestTimeout time.Duration
 	Channel            string
 	PubSubServer       string
-	Logger             logger.Logger
+	DeadLetterKey      string
+	DeadLetterMax      int64
+	LocalCacheTTL      time.Duration
+	// InvalidationChannel is only used when LocalCacheTTL is set
+	InvalidationChannel string
+	BatchConcurrency    int
+	Logger              logger.Logger
+	Metrics             *metrics.Metrics
+	TracerProvider      trace.TracerProvider
+	Propagator          propagation.TextMapPropagator
+	Hooks               Hooks
+	// Fixtures is nil unless record or replay is enabled
+	Fixtures *Fixtures
+	// StoreEnvelope stores the responses in envelopes, otherwise raw
+	StoreEnvelope bool
+	// Compression applies to the responses stored from now on, when StoreEnvelope is set
+	Compression cache.Compression
+	// MaxBodySize caps the upstream response bodies in bytes, 0 is unbounded
+	MaxBodySize int64
+	// Chunking applies to the responses stored from now on, chunked entries are readable whatever it is
+	Chunking cache.Chunking
+	// Clock stamps the stored responses and ages them, and expires the local copies. Default is time.Now.
+	// Timeouts and latencies always use the real time.
+	Clock func() time.Time
+
+	// consumer is the consumer running in this process, nil when none runs
+	consumer atomic.Pointer[redismaint.Consumer]
+
+	local      *localCache
+	instanceID string
+	busStop    chan struct{}
+	busDone    chan struct{}
+	closeOnce  sync.Once
 }
 
 type httpChannel struct {
 	ResultChan []byte
+	StatusCode int
+	Header     http.Header
+	Duration   time.Duration
 	ErrorChan  error
 }
 
 type redisChannel struct {
 	ResultChan string
+	StatusCode int
+	Header     http.Header
+	StoredAt   time.Time
 	ErrorChan  error
 }
 
+// Request is a request sent through Client.Do
+type Request struct {
+	URL    string
+	Method string
+	Body   []byte
+	// Header of the upstream request, a Host header replaces the host of URL in the request sent
+	Header map[string]string
+	// Key is the cache key the response is stored under
+	Key string
+	// UseCache selects the optimistic strategy: serve from the cache first and only
+	// ask the upstream on a miss. Otherwise the upstream is asked first and the
+	// cache is the fallback when it fails.
+	UseCache bool
+	// Tags are attached to the stored response, so InvalidateTags can remove it
+	Tags []string
+
+	// sendRequest keeps the SendRequest semantics: only transport errors and timeouts are
+	// upstream failures, server errors are responses
+	sendRequest bool
+}
+
+// Response is a response returned by Client.Do
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Outcome    Outcome
+	// StoredAt is when a response served from the cache was stored, zero for live responses
+	StoredAt time.Time
+	// Age is the age of a response served from the cache, -1 for live responses
+	// and entries stored without a timestamp
+	Age time.Duration
+}
+
+// StatusError describes an upstream answering with a non 200 status, it is passed to the hooks,
+// returned by Do when nothing is cached and returned by the consumer handler
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d", e.StatusCode)
+}
+
+// Outcome describes how a request was served, it is used as log field and metric label
+type Outcome string
+
+const (
+	// OutcomeLive is a response served by the upstream
+	OutcomeLive Outcome = "live"
+	// OutcomeCacheHit is a response served from redis before asking the upstream
+	OutcomeCacheHit Outcome = "cache-hit"
+	// OutcomeFallbackHit is a response served from redis because the upstream failed
+	OutcomeFallbackHit Outcome = "fallback-hit"
+	// OutcomeFallbackMiss is an upstream failure with nothing in redis to fall back to
+	OutcomeFallbackMiss Outcome = "fallback-miss"
+	// OutcomeError is any other failure
+	OutcomeError Outcome = "error"
+)
+
 type HTTPResponse struct {
 	//StatusCode int    `json:"status_code"`
 	Body string `json:"body"`
 }
 
-// New will construct a customized http client
-func New(config Config) (*Client, error) {
-	transport := &http.Transport{
-		MaxIdleConns:    config.MaxIdleConnection,
-		IdleConnTimeout: config.IdleConnTimeout * time.Millisecond,
-		//MaxConnsPerHost: config.MaxConnectionPerHost,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: config.InsecureSkipVerify,
-			Renegotiation:      tls.RenegotiateFreelyAsClient,
-		},
+// New will construct a customized http client. The components opts do not replace are built from config.
+func New(config Config, opts ...Option) (*Client, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
 	}
-	if config.Certificate != nil {
-		transport.TLSClientConfig.Certificates = []tls.Certificate{*config.Certificate}
+	if o.logger != nil {
+		config.Logger = o.logger
 	}
-	httpClient := &http.Client{
-		Transport: transport,
-		Timeout:   config.HTTPRequestTimeout * time.Millisecond,
+	if o.metrics != nil {
+		config.Metrics = o.metrics
 	}
 
-	client := &Client{}
-	client.HTTPClient = httpClient
+	if err := config.Compression.Validate(); err != nil {
+		return nil, fmt.Errorf("error create client: %v", err)
+	}
+	if err := config.Chunking.Validate(); err != nil {
+		return nil, fmt.Errorf("error create client: %v", err)
+	}
+	if !config.StoreEnvelope && (config.Compression.Codec != cache.CodecNone || config.Chunking.Enabled()) {
+		return nil, errors.New("error create client: Compression and Chunking require StoreEnvelope")
+	}
+	if config.MaxBodySize < 0 {
+		return nil, errors.New("error create client: MaxBodySize must not be negative")
+	}
 
-	// initialize cache client and set prefix if not empty
-	cacher, err := cache.NewCacheClient(config.StorageHostServer, config.StorageDB)
-	if err != nil {
-		return nil, fmt.Errorf("error create cacher: %v", err)
+	pubSubAddrs := config.PubSubAddrs()
+	if o.pubsub == nil && o.storage == nil && pubSubAddrs == nil && len(config.StorageMemcached.Servers) > 0 {
+		return nil, errors.New("error create pubsub client: memcached has no pub/sub, RedisHost is required")
 	}
-	if config.TempStorageKeyPrefix != "" {
-		cacher.SetPrefix(config.TempStorageKeyPrefix)
+
+	// initialize cache client
+	cacher := o.storage
+	if cacher == nil {
+		var err error
+		if cacher, err = newStorage(config); err != nil {
+			return nil, fmt.Errorf("error create cacher: %v", err)
+		}
 	}
 
-	pubServer, err := cache.NewCacheClient([]string{config.RedisHost}, config.StorageDB)
-	if err != nil {
-		return nil, fmt.Errorf("error create cacher: %v", err)
+	pubServer := o.pubsub
+	if pubServer == nil {
+		pubServer = cacher
+		if pubSubAddrs != nil || (o.storage == nil && config.StorageDisk.Path == "") {
+			if pubSubAddrs == nil {
+				// the redis storage goes with a pubsub on the driver default address
+				pubSubAddrs = []string{config.RedisHost}
+			}
+			pubSubOptions, err := config.PubSubRedis.Options(pubSubAddrs, config.StorageDB)
+			if err != nil {
+				return nil, fmt.Errorf("error create pubsub client: %v", err)
+			}
+			pubServer, err = cache.NewClient(pubSubOptions)
+			if err != nil {
+				return nil, fmt.Errorf("error create cacher: %v", err)
+			}
+		}
 	}
 	if config.TempStorageKeyPrefix != "" {
 		cacher.SetPrefix(config.TempStorageKeyPrefix)
 	}
+
+	httpClient := o.httpClient
+	if httpClient == nil {
+		httpClient = newHTTPClient(config)
+	}
+
+	client := &Client{}
+	client.HTTPClient = httpClient
 	client.CacheClient = cacher
 	client.PubsubClient = pubServer
+	client.Clock = o.clock
+	fixtures, err := NewFixtures(config.Fixtures)
+	if err != nil {
+		return nil, fmt.Errorf("error create fixtures: %v", err)
+	}
+	client.Fixtures = fixtures
+	client.StoreEnvelope = config.StoreEnvelope
+	client.Compression = config.Compression
+	client.MaxBodySize = config.MaxBodySize
+	client.Chunking = config.Chunking
 
 	client.ExpiryTime = config.ExpiryTime
 	client.MainTimeOut = config.MainTimeout
@@ -129,148 +332,617 @@ func New(config Config) (*Client, error) {
 	client.WaitRedis = config.WaitRedis
 	client.HTTPRequestTimeout = config.HTTPRequestTimeout
 	client.Channel = config.Channel
+	client.DeadLetterKey = config.DeadLetterKey
+	client.DeadLetterMax = config.DeadLetterMax
 	client.PubSubServer = config.RedisHost
-	client.Logger = logger.New(logger.Config{Debug: config.Debug})
-	log.SetOutput(os.Stdout)
+	client.BatchConcurrency = config.BatchConcurrency
+	if client.BatchConcurrency < 1 {
+		client.BatchConcurrency = 8
+	}
+	client.Logger = config.Logger
+	if client.Logger == nil {
+		client.Logger = logger.New(logger.Config{Debug: config.Debug})
+	}
+	client.Metrics = config.Metrics
+	client.TracerProvider = config.TracerProvider
+	client.Propagator = config.Propagator
+	client.Hooks = config.Hooks
+
+	if config.LocalCacheTTL > 0 {
+		if config.LocalCacheSize < 1 {
+			config.LocalCacheSize = 10000
+		}
+		client.InvalidationChannel = config.InvalidationChannel
+		if client.InvalidationChannel == "" {
+			client.InvalidationChannel = DefaultInvalidationChannel
+		}
+		client.LocalCacheTTL = config.LocalCacheTTL
+		client.local = newLocalCache(config.LocalCacheTTL*time.Millisecond, config.LocalCacheSize, client.now)
+		if err := client.startInvalidationBus(); err != nil {
+			return nil, fmt.Errorf("error start invalidation bus: %v", err)
+		}
+	}
 	return client, nil
 }
 
+// NewWithComponents builds a client around the given components instead of connecting to the
+// servers of config. A nil httpClient is built from config and a nil pubsub uses storage, which
+// suits the memory package. It is New with WithHTTPClient, WithCacher and WithPublisher:
+//
+//	client, err := lazyhttp.NewWithComponents(config, nil, memory.New(memory.Options{}), memory.NewQueue(memory.Options{}))
+func NewWithComponents(config Config, httpClient *http.Client, storage, pubsub cache.ContextCacher) (*Client, error) {
+	if storage == nil {
+		return nil, errors.New("error create cacher: storage is required")
+	}
+	if pubsub == nil {
+		pubsub = storage
+	}
+	return New(config, WithHTTPClient(httpClient), WithCacher(storage), WithPublisher(pubsub))
+}
+
+// newHTTPClient builds the upstream client from the transport settings of config
+func newHTTPClient(config Config) *http.Client {
+	transport := &http.Transport{
+		MaxIdleConns:    config.MaxIdleConnection,
+		IdleConnTimeout: config.IdleConnTimeout * time.Millisecond,
+		//MaxConnsPerHost: config.MaxConnectionPerHost,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: config.InsecureSkipVerify,
+			Renegotiation:      tls.RenegotiateFreelyAsClient,
+		},
+	}
+	if config.Certificate != nil {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{*config.Certificate}
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   config.HTTPRequestTimeout * time.Millisecond,
+	}
+}
+
+// PubSubAddrs returns the addresses of the pubsub connections, PubSubHosts or else RedisHost,
+// nil when neither is set
+func (config Config) PubSubAddrs() []string {
+	if len(config.PubSubHosts) > 0 {
+		return config.PubSubHosts
+	}
+	if config.RedisHost != "" {
+		return []string{config.RedisHost}
+	}
+	return nil
+}
+
+// newStorage opens the disk or memcached storage when one is configured, and connects to the redis storage otherwise
+func newStorage(config Config) (cache.ContextCacher, error) {
+	if config.StorageDisk.Path != "" {
+		return disk.Open(config.StorageDisk.Path, config.StorageDisk.Options())
+	}
+	if len(config.StorageMemcached.Servers) > 0 {
+		return memcached.New(config.StorageMemcached.Options())
+	}
+	options, err := config.StorageRedis.Options(config.StorageHostServer, config.StorageDB)
+	if err != nil {
+		return nil, err
+	}
+	return cache.NewClient(options)
+}
+
+// requestLogger returns a logger carrying the fields identifying a single request
+func (httprequest *Client) requestLogger(ctx context.Context, rawURL string, header map[string]string, key string) logger.Logger {
+	keyvals := []interface{}{logger.KeyCacheKey, key}
+	if u, err := url.Parse(rawURL); err == nil {
+		keyvals = append(keyvals, logger.KeyHost, u.Host)
+	}
+	if id := requestID(ctx, header); id != "" {
+		keyvals = append(keyvals, logger.KeyRequestID, id)
+	}
+	return httprequest.Logger.With(keyvals...)
+}
+
 // getFromRedis Get value from redis based on described Key
-func (httprequest *Client) getFromRedis(ctx context.Context, key string, redisChan chan redisChannel) {
+func (httprequest *Client) getFromRedis(ctx context.Context, log logger.Logger, key string, redisChan chan redisChannel) {
 	//GET FROM REDIS
 	var redisChanStruct redisChannel
-	httprequest.Logger.Debugln("Start request via redis")
-	cacheBody, err := httprequest.CacheClient.Get(key)
-	httprequest.Logger.Debugln("Done request via redis")
+	if httprequest.local != nil {
+		if value, ok := httprequest.local.get(key); ok {
+			log.Debug("served from local cache")
+			httprequest.Metrics.CacheLookup(metrics.LookupHit)
+			redisChan <- envelopeResult(value)
+			close(redisChan)
+			return
+		}
+	}
+	var cacheBody string
+	var err error
+	if b := batchFrom(ctx); b != nil {
+		// DoBatch looked every key up already
+		cacheBody, err = b.lookup(key)
+	} else {
+		cacheBody, err = httprequest.getCached(ctx, log, key)
+	}
 	if err != nil {
+		log.Warn("request via redis failed", logger.KeyError, err)
+		httprequest.Metrics.CacheLookup(metrics.LookupError)
 		redisChanStruct = redisChannel{
 			ErrorChan:  err,
 			ResultChan: "",
 		}
 	} else {
-		httprequest.Logger.Debugln("Response via Redis", cacheBody)
-		redisChanStruct = redisChannel{
-			ErrorChan:  nil,
-			ResultChan: cacheBody,
+		log.Debug("done request via redis", "size", len(cacheBody))
+		if cache.IsManifest(cacheBody) {
+			redisChanStruct, cacheBody = httprequest.chunkedResult(ctx, key, cacheBody)
+		} else {
+			redisChanStruct = envelopeResult(cacheBody)
+		}
+		switch {
+		case redisChanStruct.ErrorChan != nil:
+			log.Warn("unable to decode cached response", logger.KeyError, redisChanStruct.ErrorChan)
+			httprequest.Metrics.CacheLookup(metrics.LookupError)
+		case cacheBody == "":
+			httprequest.Metrics.CacheLookup(metrics.LookupMiss)
+		default:
+			httprequest.Metrics.CacheLookup(metrics.LookupHit)
+			// chunked entries are too large to keep a local copy of
+			if httprequest.local != nil && !cache.IsManifest(cacheBody) {
+				httprequest.local.set(key, cacheBody)
+			}
 		}
 	}
 	redisChan <- redisChanStruct
-	httprequest.Logger.Debugln("Done set redis channel value, ", redisChanStruct)
 	close(redisChan)
 }
 
+// getCached reads key from redis, a missing key is an empty value.
+// ctx bounds the call, so a stalled redis does not keep the caller goroutine past its wait.
+func (httprequest *Client) getCached(ctx context.Context, log logger.Logger, key string) (string, error) {
+	log.Debug("start request via redis")
+	_, span := httprequest.tracer().Start(ctx, "lazyhttp.redis.get", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrDBSystem.String("redis"), attrCacheKey.String(key)))
+	start := time.Now()
+	cacheBody, err := httprequest.CacheClient.Get(ctx, key)
+	httprequest.Metrics.ObserveRedis("get", time.Since(start))
+	if errors.Is(err, cache.ErrNotFound) {
+		err = nil
+	}
+	if err == nil && cacheBody == "" {
+		span.SetAttributes(attrCacheResult.String(metrics.LookupMiss))
+	} else if err == nil {
+		span.SetAttributes(attrCacheResult.String(metrics.LookupHit))
+	}
+	endSpan(span, err)
+	return cacheBody, err
+}
+
+// envelopeResult decodes a stored value to the redis leg result, a body that cannot be
+// decompressed is an error so it is never served
+func envelopeResult(value string) redisChannel {
+	envelope, err := cache.ParseEnvelope(value)
+	if err != nil {
+		return redisChannel{ErrorChan: err}
+	}
+	return redisChannel{
+		ResultChan: string(envelope.Body),
+		StatusCode: envelope.StatusCode,
+		Header:     envelope.Header,
+		StoredAt:   envelope.StoredAt,
+	}
+}
+
 // doRequest Do HTTP Request to get response from server
-func (httprequest *Client) doRequest(ctx context.Context, httpRequest *http.Request, key string, httpChan chan httpChannel) {
-	ctx, cancelHttp := context.WithTimeout(context.Background(), httprequest.HTTPRequestTimeout*time.Millisecond)
+func (httprequest *Client) doRequest(ctx context.Context, log logger.Logger, event *RequestEvent, httpRequest *http.Request, key string, httpChan chan httpChannel) {
+	if b := batchFrom(ctx); b != nil {
+		// a request still queued when the batch wait is over is not sent
+		if err := b.acquire(ctx); err != nil {
+			httpChan <- httpChannel{ErrorChan: err}
+			close(httpChan)
+			return
+		}
+		defer b.release()
+	}
+	// the request outlives the caller wait on purpose, so the response still lands in redis
+	ctx, cancelHttp := context.WithTimeout(context.WithoutCancel(ctx), httprequest.HTTPRequestTimeout*time.Millisecond)
 	defer cancelHttp()
 
 	var httpChanStruct httpChannel
 
-	response, err := httprequest.HTTPClient.Do(httpRequest.WithContext(ctx))
-	httprequest.Logger.Debugln("Done request via HTTP: ", response)
+	ctx, span := httprequest.tracer().Start(ctx, "lazyhttp.http", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrMethod.String(httpRequest.Method), attrURL.String(httpRequest.URL.String())))
+	defer span.End()
+	httprequest.propagator().Inject(ctx, propagation.HeaderCarrier(httpRequest.Header))
+	ctx = httptrace.WithClientTrace(ctx, clientTrace(span))
+
+	log.Debug("start request via http", "method", httpRequest.Method, "url", httpRequest.URL.String())
+	start := time.Now()
+	response, err := httprequest.send(ctx, key, httpRequest.WithContext(ctx))
 	if err != nil {
-		httprequest.Logger.Debugln("Error request via HTTP: ", err.Error())
+		endSpan(span, err)
+		httpChanStruct.Duration = time.Since(start)
+		httprequest.Metrics.ObserveHTTP(httpRequest.URL.Host, httpRequest.Method, httpChanStruct.Duration)
+		log.Warn("request via http failed", logger.KeyError, err)
 		httpChanStruct.ErrorChan = err
 		httpChan <- httpChanStruct
 		close(httpChan)
 		return
 	}
-	responseBody, _ := ioutil.ReadAll(response.Body)
-	httprequest.Logger.Debugln("Response via HTTP", string(responseBody))
-	if response.StatusCode == http.StatusOK {
-		_ = httprequest.CacheClient.Set(key, string(responseBody), httprequest.ExpiryTime*time.Millisecond)
-		httpChanStruct.ResultChan = responseBody
+	defer response.Body.Close()
+	responseBody, err := readBody(response, httprequest.MaxBodySize)
+	httpChanStruct.Duration = time.Since(start)
+	if err != nil {
+		endSpan(span, err)
+		httprequest.Metrics.ObserveHTTP(httpRequest.URL.Host, httpRequest.Method, httpChanStruct.Duration)
+		log.Warn("unable to read response body", "status", response.StatusCode, logger.KeyError, err)
+		httpChanStruct.ErrorChan = err
+		httpChan <- httpChanStruct
+		close(httpChan)
+		return
 	}
+	httpChanStruct.StatusCode = response.StatusCode
+	httpChanStruct.Header = response.Header
+	httpChanStruct.ResultChan = responseBody
+	httprequest.Metrics.ObserveHTTP(httpRequest.URL.Host, httpRequest.Method, httpChanStruct.Duration)
+	span.SetAttributes(attrStatusCode.Int(response.StatusCode))
+	log.Debug("done request via http", "status", response.StatusCode, "size", len(responseBody))
+	// the response goes out first, a slow cache must not make a healthy upstream miss WaitHttp
 	httpChan <- httpChanStruct
-	httprequest.Logger.Debugln("done set http channel value")
 	close(httpChan)
+	if response.StatusCode == http.StatusOK {
+		// the write gets its own HTTPRequestTimeout, a stalled cache does not keep this goroutine
+		storeCtx, cancelStore := context.WithTimeout(context.WithoutCancel(ctx), httprequest.HTTPRequestTimeout*time.Millisecond)
+		defer cancelStore()
+		// the caller owns the header it was handed
+		httprequest.store(storeCtx, log, event, key, response.Header.Clone(), responseBody)
+	}
 }
 
-func (httprequest *Client) SendRequest(ctx context.Context, url string, action string, payload []byte, header map[string]string, key string, useCache bool) (code int, body []byte, err error) {
-	if useCache {
-		return httprequest.optimisticReq(ctx, url, action, payload, header, key)
+// store writes a 200 response to the cache. Failures are logged and passed to the hooks,
+// the response is served whatever happens to its copy.
+func (httprequest *Client) store(ctx context.Context, log logger.Logger, event *RequestEvent, key string, header http.Header, body []byte) {
+	_, setSpan := httprequest.tracer().Start(ctx, "lazyhttp.redis.set", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrDBSystem.String("redis"), attrCacheKey.String(key)))
+	ttl := httprequest.ExpiryTime * time.Millisecond
+	start := time.Now()
+	var value string
+	size := len(body)
+	// the tags go first, so no entry is stored that InvalidateTags would miss
+	err := httprequest.tag(ctx, key, event.Tags)
+	switch {
+	case err != nil:
+		err = fmt.Errorf("error tag response: %v", err)
+	case httprequest.StoreEnvelope:
+		envelope := cache.NewEnvelope(httprequest.now(), http.StatusOK, header, body)
+		codec, stored, encodeErr := envelope.Compress(httprequest.Compression)
+		if encodeErr != nil {
+			log.Warn("unable to compress response, stored raw", logger.KeyError, encodeErr)
+			codec, stored = cache.CodecNone, body
+		}
+		if httprequest.Compression.Codec != cache.CodecNone {
+			httprequest.Metrics.ObserveCompression(string(httprequest.Compression.Codec), len(body), len(stored))
+		}
+		size = len(stored)
+		value, err = cache.Store(ctx, httprequest.CacheClient, key, envelope, codec, stored, httprequest.Chunking, ttl)
+	default:
+		// the raw body is what instances predating envelopes read
+		value = string(body)
+		err = httprequest.CacheClient.Set(ctx, key, value, ttl)
+	}
+	httprequest.Metrics.ObserveRedis("set", time.Since(start))
+	endSpan(setSpan, err)
+	if err != nil {
+		log.Error("unable to store response in redis", logger.KeyError, err)
+		httprequest.hooks().CacheWriteFailed(ctx, &CacheWriteEvent{
+			Request: event,
+			Key:     key,
+			Size:    size,
+			TTL:     ttl,
+			Err:     err,
+		})
+		return
+	}
+	if httprequest.local != nil {
+		// other instances drop their copy, this one has the new response already
+		httprequest.invalidateLocal(ctx, []string{key}, nil)
+		if !cache.IsManifest(value) {
+			httprequest.local.set(key, value)
+		}
 	}
-	return httprequest.pessimisticReq(ctx, url, action, payload, header, key)
 }
 
-// SendRequest will hit a defined endpoint and return a response body in byte format
-func (httprequest *Client) pessimisticReq(ctx context.Context, url string, action string, payload []byte, header map[string]string, key string) (int, []byte, error) {
+// send sends the upstream request, or replays it from the fixtures
+func (httprequest *Client) send(ctx context.Context, key string, httpRequest *http.Request) (*http.Response, error) {
+	if httprequest.Fixtures == nil {
+		return httprequest.upstreamClient(ctx).Do(httpRequest)
+	}
+	return httprequest.Fixtures.send(httprequest.upstreamClient(ctx), key, httpRequest, httprequest.MaxBodySize)
+}
 
-	var responseBody []byte
+// newHTTPRequest builds the upstream request of req
+func newHTTPRequest(req *Request) (*http.Request, error) {
+	httpRequest, err := http.NewRequest(req.Method, req.URL, bytes.NewBuffer(req.Body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range req.Header {
+		httpRequest.Header.Set(k, v)
+	}
+	// net/http sends Request.Host, never a Host header
+	if host := httpRequest.Header.Get(hostHeader); host != "" {
+		httpRequest.Host = host
+		httpRequest.Header.Del(hostHeader)
+	}
+	return httpRequest, nil
+}
 
-	mCtx, cancel := context.WithTimeout(context.Background(), httprequest.WaitHttp*time.Millisecond)
-	defer cancel()
+// upstreamFailed tells whether a finished HTTP leg of req should be treated as a failure.
+// For Do server errors are, so they fall back to the cache like timeouts do.
+func upstreamFailed(req *Request, result httpChannel) bool {
+	if req.sendRequest {
+		return result.ErrorChan != nil
+	}
+	return result.ErrorChan != nil || result.StatusCode >= http.StatusInternalServerError
+}
+
+// Do sends req and returns the response, served by the upstream or the cache
+// depending on req.UseCache and the upstream health. Server errors fall back to the cache like timeouts do.
+// Non 200 upstream responses are returned as they are when nothing is cached, and are never cached.
+func (httprequest *Client) Do(ctx context.Context, req *Request) (resp *Response, err error) {
+	ctx, span := httprequest.tracer().Start(ctx, "lazyhttp.Do", trace.WithAttributes(
+		attrMethod.String(req.Method),
+		attrURL.String(req.URL),
+		attrCacheKey.String(req.Key),
+		attrUseCache.Bool(req.UseCache),
+	))
+	event := newRequestEvent(ctx, req)
+	ctx, state := withRequestState(ctx, event)
+	httprequest.hooks().BeforeRequest(ctx, event)
+	defer func() {
+		responseEvent := &ResponseEvent{
+			Request:  event,
+			Outcome:  state.outcome,
+			Age:      state.age,
+			Duration: time.Since(event.StartedAt),
+			Err:      err,
+		}
+		if resp != nil {
+			span.SetAttributes(attrStatusCode.Int(resp.StatusCode))
+			responseEvent.StatusCode = resp.StatusCode
+			responseEvent.Body = resp.Body
+		}
+		endSpan(span, err)
+		httprequest.hooks().AfterResponse(ctx, responseEvent)
+	}()
+
+	if req.UseCache {
+		return httprequest.optimistic(ctx, req)
+	}
+	return httprequest.pessimistic(ctx, req)
+}
 
-	body := bytes.NewBuffer(payload)
-	httpRequest, err := http.NewRequest(action, url, body)
+// SendRequest will hit a defined endpoint and return a response body in byte format.
+// Only transport errors and timeouts fall back to the cache. A non 200 upstream response has no body:
+// it is a 500 with an error without useCache, and a 200 with an empty body with useCache.
+// Do reports the upstream status, and falls back on server errors as well.
+func (httprequest *Client) SendRequest(ctx context.Context, url string, action string, payload []byte, header map[string]string, key string, useCache bool) (code int, body []byte, err error) {
+	resp, err := httprequest.Do(ctx, &Request{
+		URL:         url,
+		Method:      action,
+		Body:        payload,
+		Header:      header,
+		Key:         key,
+		UseCache:    useCache,
+		sendRequest: true,
+	})
 	if err != nil {
-		return 0, responseBody, err
+		if useCache {
+			return 0, nil, err
+		}
+		return http.StatusInternalServerError, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if useCache {
+			return http.StatusOK, nil, nil
+		}
+		return http.StatusInternalServerError, nil, errors.New("Response body is empty")
+	}
+	if len(resp.Body) == 0 && !useCache {
+		return http.StatusInternalServerError, nil, errors.New("Response body is empty")
 	}
+	return resp.StatusCode, resp.Body, nil
+}
 
-	for k, v := range header {
-		httpRequest.Header.Set(k, v)
+// waitContext bounds how long a request waits for the upstream: WaitHttp, or the deadline of its DoBatch call
+// when that is earlier. The caller cancellation is not followed, like the upstream request.
+func (httprequest *Client) waitContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline := time.Now().Add(httprequest.WaitHttp * time.Millisecond)
+	if b := batchFrom(ctx); b != nil && b.deadline.Before(deadline) {
+		deadline = b.deadline
+	}
+	return context.WithDeadline(context.WithoutCancel(ctx), deadline)
+}
+
+// pessimistic asks the upstream and redis at the same time, the upstream response wins
+// unless it fails or is slower than WaitHttp
+func (httprequest *Client) pessimistic(ctx context.Context, req *Request) (*Response, error) {
+	log := httprequest.requestLogger(ctx, req.URL, req.Header, req.Key)
+	event := requestEventFrom(ctx, req)
+
+	mCtx, cancel := httprequest.waitContext(ctx)
+	defer cancel()
+
+	httpRequest, err := newHTTPRequest(req)
+	if err != nil {
+		httprequest.Metrics.ObserveRequest(nil, req.Method, string(OutcomeError))
+		recordOutcome(ctx, OutcomeError, -1)
+		return nil, err
 	}
 
 	httpChan := make(chan httpChannel, 1)
 	redisChan := make(chan redisChannel, 1)
 
-	go func() {
-		httprequest.doRequest(mCtx, httpRequest, key, httpChan)
-	}()
+	go func(channel chan httpChannel) {
+		httprequest.doRequest(mCtx, log, event, httpRequest, req.Key, channel)
+	}(httpChan)
 
-	go func() {
-		httprequest.getFromRedis(mCtx, key, redisChan)
-	}()
+	go func(channel chan redisChannel) {
+		httprequest.getFromRedis(mCtx, log, req.Key, channel)
+	}(redisChan)
 
 	var httpResult httpChannel
 	var redisResult redisChannel
+	var redisDone bool
 exit:
 	for {
 		select {
 		case <-mCtx.Done():
-			httprequest.Logger.Debugln("HTTP wait got timeout", int(httprequest.WaitHttp))
+			log.Debug("http wait got timeout", "wait_ms", int(httprequest.WaitHttp))
 			httpResult.ErrorChan = errors.New("context timeout HTTP")
-			httprequest.Logger.Debugln("Set error http")
 			break exit
 		case httpResult = <-httpChan:
-			if httpResult.ErrorChan == nil {
+			// each channel carries a single value, stop selecting it once received
+			httpChan = nil
+			if !upstreamFailed(req, httpResult) || httpResult.unmatched() {
 				break exit
 			} else {
-				if redisResult.ErrorChan == nil {
+				// wait for redis to have something to fall back to
+				if redisDone {
 					break exit
 				}
 			}
-		case redisTempResult := <-redisChan:
-			if (redisChannel{}) != redisTempResult {
-				redisResult = redisTempResult
-			}
-			if httpResult.ErrorChan != nil {
+		case redisResult = <-redisChan:
+			redisChan = nil
+			redisDone = true
+			if upstreamFailed(req, httpResult) {
 				break exit
 			}
 
 		}
 	}
 
-	var code int
+	var resp *Response
+	var outcome Outcome
+	age := time.Duration(-1)
+
+	if upstreamFailed(req, httpResult) || httpResult.StatusCode != http.StatusOK {
+		httprequest.hooks().UpstreamFailed(ctx, &UpstreamFailureEvent{
+			Request:    event,
+			StatusCode: httpResult.StatusCode,
+			Err:        httpResult.ErrorChan,
+			Duration:   time.Since(event.StartedAt),
+		})
+	}
 
-	if httpResult.ErrorChan == nil {
-		responseBody = httpResult.ResultChan
-		if len(responseBody) == 0 {
-			err = errors.New("Response body is empty")
-			code = http.StatusInternalServerError
-		} else {
-			code = http.StatusOK
+	if httpResult.unmatched() {
+		// a missing fixture is not hidden behind a cached response
+		httprequest.Metrics.ObserveRequest(httpRequest.URL, req.Method, string(OutcomeError))
+		recordOutcome(ctx, OutcomeError, -1)
+		log.Error("request failed", logger.KeyOutcome, OutcomeError, logger.KeyError, httpResult.ErrorChan)
+		return nil, httpResult.ErrorChan
+	}
+	if !upstreamFailed(req, httpResult) {
+		resp = &Response{
+			StatusCode: httpResult.StatusCode,
+			Header:     httpResult.Header,
+			Body:       httpResult.ResultChan,
+			Age:        -1,
 		}
+		outcome = OutcomeLive
 	} else {
 		if (redisResult.ErrorChan == nil) && (redisResult.ResultChan != "") {
-			responseBody = []byte(redisResult.ResultChan)
-			err = nil
-			code = http.StatusOK
+			outcome = OutcomeFallbackHit
+			age = httprequest.entryAge(redisResult.StoredAt)
+			resp = cachedResponse(redisResult, age)
+			httprequest.Metrics.ObserveEntryAge(age)
+			httprequest.hooks().StaleServed(ctx, &StaleEvent{
+				Request:     event,
+				Outcome:     outcome,
+				StoredAt:    redisResult.StoredAt,
+				Age:         age,
+				UpstreamErr: httpResult.upstreamErr(),
+			})
 		} else {
-			err = httpResult.ErrorChan
-			code = http.StatusInternalServerError
+			err = httpResult.upstreamErr()
+			outcome = OutcomeFallbackMiss
+			if httpResult.ErrorChan == nil {
+				// the upstream did answer, pass its error response through
+				resp = &Response{
+					StatusCode: httpResult.StatusCode,
+					Header:     httpResult.Header,
+					Body:       httpResult.ResultChan,
+					Age:        -1,
+				}
+				err = nil
+			}
 		}
 	}
+	if resp != nil {
+		resp.Outcome = outcome
+	}
+
+	httprequest.Metrics.ObserveRequest(httpRequest.URL, req.Method, string(outcome))
+	recordOutcome(ctx, outcome, age)
+	switch outcome {
+	case OutcomeLive:
+		log.Debug("request done", logger.KeyOutcome, outcome)
+	case OutcomeFallbackHit:
+		log.Warn("upstream failed, serving redis copy", logger.KeyOutcome, outcome, logger.KeyError, httpResult.upstreamErr())
+	default:
+		log.Error("request failed", logger.KeyOutcome, outcome, logger.KeyError, httpResult.upstreamErr())
+	}
+	return resp, err
+}
+
+// unmatched tells whether the HTTP leg failed because replay has no fixture for the request
+func (result httpChannel) unmatched() bool {
+	var unmatched *UnmatchedError
+	return errors.As(result.ErrorChan, &unmatched)
+}
+
+// upstreamErr returns the error describing a failed HTTP leg
+func (result httpChannel) upstreamErr() error {
+	if result.ErrorChan != nil {
+		return result.ErrorChan
+	}
+	if result.StatusCode != http.StatusOK {
+		return &StatusError{StatusCode: result.StatusCode}
+	}
+	return nil
+}
 
-	return code, responseBody, err
+// cachedResponse builds the response served from a redis entry
+func cachedResponse(result redisChannel, age time.Duration) *Response {
+	code := result.StatusCode
+	if code == 0 {
+		code = http.StatusOK
+	}
+	return &Response{
+		StatusCode: code,
+		Header:     result.Header,
+		Body:       []byte(result.ResultChan),
+		StoredAt:   result.StoredAt,
+		Age:        age,
+	}
+}
+
+// requestURL parses rawURL for metric labels, it returns nil when it is invalid
+func requestURL(rawURL string) *url.URL {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// entryAge returns the age of an entry stored at storedAt, or -1 when it is unknown
+func (httprequest *Client) entryAge(storedAt time.Time) time.Duration {
+	if storedAt.IsZero() {
+		return -1
+	}
+	return httprequest.now().Sub(storedAt)
+}
+
+// now reads Clock, time.Now when it is not set
+func (httprequest *Client) now() time.Time {
+	if httprequest.Clock == nil {
+		return time.Now()
+	}
+	return httprequest.Clock()
 }
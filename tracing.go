@@ -0,0 +1,116 @@
+package lazyhttp
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/dendhi31/lazyhttp"
+
+// span attribute keys
+const (
+	attrCacheKey    = attribute.Key("lazyhttp.cache.key")
+	attrCacheResult = attribute.Key("lazyhttp.cache.result")
+	attrCacheAge    = attribute.Key("lazyhttp.cache.age_seconds")
+	attrOutcome     = attribute.Key("lazyhttp.outcome")
+	attrUseCache    = attribute.Key("lazyhttp.use_cache")
+	attrChannel     = attribute.Key("messaging.destination.name")
+	attrMethod      = attribute.Key("http.request.method")
+	attrURL         = attribute.Key("url.full")
+	attrStatusCode  = attribute.Key("http.response.status_code")
+	attrDBSystem    = attribute.Key("db.system")
+	attrBatchSize   = attribute.Key("lazyhttp.batch.size")
+	attrBatchKeys   = attribute.Key("lazyhttp.batch.keys")
+)
+
+func (httprequest *Client) tracer() trace.Tracer {
+	tp := httprequest.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+func (httprequest *Client) propagator() propagation.TextMapPropagator {
+	if httprequest.Propagator != nil {
+		return httprequest.Propagator
+	}
+	return otel.GetTextMapPropagator()
+}
+
+// endSpan marks span as failed when err is set, then ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// setOutcome records how the request was served on the span found in ctx
+func setOutcome(ctx context.Context, outcome Outcome, age time.Duration) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attrOutcome.String(string(outcome)))
+	if age >= 0 && (outcome == OutcomeCacheHit || outcome == OutcomeFallbackHit) {
+		span.SetAttributes(attrCacheAge.Float64(age.Seconds()))
+	}
+}
+
+// clientTrace adds the connection level events of the HTTP leg to span
+func clientTrace(span trace.Span) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			span.AddEvent("http.get_conn", trace.WithAttributes(attribute.String("net.host_port", hostPort)))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			span.AddEvent("http.got_conn", trace.WithAttributes(
+				attribute.Bool("http.conn.reused", info.Reused),
+				attribute.Bool("http.conn.was_idle", info.WasIdle),
+			))
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			span.AddEvent("http.dns.start", trace.WithAttributes(attribute.String("net.host.name", info.Host)))
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			attrs := []attribute.KeyValue{}
+			if info.Err != nil {
+				attrs = append(attrs, attribute.String("error", info.Err.Error()))
+			}
+			span.AddEvent("http.dns.done", trace.WithAttributes(attrs...))
+		},
+		ConnectStart: func(network, addr string) {
+			span.AddEvent("http.connect.start", trace.WithAttributes(attribute.String("net.peer.addr", addr)))
+		},
+		ConnectDone: func(network, addr string, err error) {
+			attrs := []attribute.KeyValue{attribute.String("net.peer.addr", addr)}
+			if err != nil {
+				attrs = append(attrs, attribute.String("error", err.Error()))
+			}
+			span.AddEvent("http.connect.done", trace.WithAttributes(attrs...))
+		},
+		TLSHandshakeStart: func() {
+			span.AddEvent("http.tls.start")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			attrs := []attribute.KeyValue{}
+			if err != nil {
+				attrs = append(attrs, attribute.String("error", err.Error()))
+			}
+			span.AddEvent("http.tls.done", trace.WithAttributes(attrs...))
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			span.AddEvent("http.wrote_request")
+		},
+		GotFirstResponseByte: func() {
+			span.AddEvent("http.first_response_byte")
+		},
+	}
+}
@@ -0,0 +1,215 @@
+package lazyhttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Strategy selects how a request sent through Transport uses the cache
+type Strategy string
+
+const (
+	// StrategyPessimistic asks the upstream first, the cache is the fallback when it fails
+	StrategyPessimistic Strategy = "pessimistic"
+	// StrategyOptimistic serves from the cache first, the upstream is asked on a miss
+	StrategyOptimistic Strategy = "optimistic"
+)
+
+// Request headers read by Transport when the context carries no value, they are never forwarded
+const (
+	CacheKeyHeader = "X-Lazyhttp-Key"
+	StrategyHeader = "X-Lazyhttp-Strategy"
+	// TagsHeader lists the tags of the response, comma separated
+	TagsHeader = "X-Lazyhttp-Tags"
+)
+
+// Response headers added by Transport
+const (
+	CacheStatusHeader = "X-Cache"
+	AgeHeader         = "Age"
+	WarningHeader     = "Warning"
+)
+
+// hostHeader carries the Host of a request in Request.Header
+const hostHeader = "Host"
+
+// X-Cache values
+const (
+	CacheStatusHit   = "HIT"
+	CacheStatusStale = "STALE"
+	CacheStatusMiss  = "MISS"
+)
+
+// RoundTripper is an http.RoundTripper sending requests through a Client,
+// so any *http.Client gets the cache fallback and refresh behavior
+type RoundTripper struct {
+	client   *Client
+	upstream *http.Client
+
+	// KeyFunc derives the cache key of requests which have none in their context or headers.
+	// Requests left without a key are passed to the inner transport untouched.
+	KeyFunc func(r *http.Request) string
+	// Strategy is used for requests selecting none, default is StrategyPessimistic.
+	// A request selecting an unknown strategy fails.
+	Strategy Strategy
+}
+
+// Transport wraps inner, nil means http.DefaultTransport, with the client cache logic:
+//
+//	httpClient := &http.Client{Transport: lazyhttp.Transport(client, nil)}
+//	req = req.WithContext(lazyhttp.WithCacheKey(ctx, "product:42"))
+//	resp, err := httpClient.Do(req)
+//
+// Responses served from the cache carry the X-Cache, Age and Warning headers.
+// Like any RoundTripper it returns redirects as they are and applies no cookie jar,
+// that is left to the *http.Client using it.
+func Transport(client *Client, inner http.RoundTripper) *RoundTripper {
+	if inner == nil {
+		inner = http.DefaultTransport
+	}
+	upstream := &http.Client{
+		Transport: inner,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if client.HTTPClient != nil {
+		upstream.Timeout = client.HTTPClient.Timeout
+	}
+	return &RoundTripper{
+		client:   client,
+		upstream: upstream,
+		Strategy: StrategyPessimistic,
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (rt *RoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx := r.Context()
+
+	key, _ := ctx.Value(cacheKeyKey).(string)
+	if key == "" {
+		key = r.Header.Get(CacheKeyHeader)
+	}
+	if key == "" && rt.KeyFunc != nil {
+		key = rt.KeyFunc(r)
+	}
+	strategy, _ := ctx.Value(strategyKey).(Strategy)
+	if strategy == "" {
+		strategy = Strategy(strings.ToLower(r.Header.Get(StrategyHeader)))
+	}
+	if strategy == "" {
+		strategy = rt.Strategy
+	}
+	if strategy == "" {
+		strategy = StrategyPessimistic
+	}
+
+	tags, _ := ctx.Value(tagsKey).([]string)
+	if tags == nil {
+		tags = splitTags(r.Header.Get(TagsHeader))
+	}
+
+	if r.Header.Get(CacheKeyHeader) != "" || r.Header.Get(StrategyHeader) != "" || r.Header.Get(TagsHeader) != "" {
+		// a RoundTripper must not modify the request it is given
+		r = r.Clone(ctx)
+		r.Header.Del(CacheKeyHeader)
+		r.Header.Del(StrategyHeader)
+		r.Header.Del(TagsHeader)
+	}
+	if key == "" {
+		return rt.upstream.Transport.RoundTrip(r)
+	}
+	if strategy != StrategyPessimistic && strategy != StrategyOptimistic {
+		return nil, fmt.Errorf("unknown lazyhttp strategy %q", strategy)
+	}
+
+	var payload []byte
+	if r.Body != nil {
+		var err error
+		payload, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	header := make(map[string]string, len(r.Header))
+	for k, v := range r.Header {
+		header[k] = joinHeader(k, v)
+	}
+	if r.Host != "" && r.Host != r.URL.Host {
+		header[hostHeader] = r.Host
+	}
+
+	resp, err := rt.client.Do(withUpstream(ctx, rt.upstream), &Request{
+		URL:      r.URL.String(),
+		Method:   r.Method,
+		Body:     payload,
+		Header:   header,
+		Key:      key,
+		UseCache: strategy == StrategyOptimistic,
+		Tags:     tags,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return httpResponse(r, resp), nil
+}
+
+// httpResponse converts resp to the *http.Response answering r
+func httpResponse(r *http.Request, resp *Response) *http.Response {
+	header := resp.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	switch resp.Outcome {
+	case OutcomeCacheHit:
+		header.Set(CacheStatusHeader, CacheStatusHit)
+	case OutcomeFallbackHit:
+		header.Set(CacheStatusHeader, CacheStatusStale)
+		header.Add(WarningHeader, `110 - "Response is Stale"`)
+	default:
+		header.Set(CacheStatusHeader, CacheStatusMiss)
+	}
+	if resp.Age >= 0 {
+		header.Set(AgeHeader, strconv.FormatInt(int64(resp.Age.Seconds()), 10))
+	}
+	header.Set("Content-Length", strconv.Itoa(len(resp.Body)))
+
+	return &http.Response{
+		Status:        strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode),
+		StatusCode:    resp.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(resp.Body)),
+		ContentLength: int64(len(resp.Body)),
+		Request:       r,
+	}
+}
+
+// joinHeader folds the values of a request header into one, as RFC 9110 allows for every header
+// but Cookie, whose pairs RFC 6265 separates with "; "
+func joinHeader(name string, values []string) string {
+	if http.CanonicalHeaderKey(name) == "Cookie" {
+		return strings.Join(values, "; ")
+	}
+	return strings.Join(values, ", ")
+}
+
+func splitTags(value string) []string {
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,92 @@
+package lazyhttp_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/dendhi31/lazyhttp"
+	"github.com/dendhi31/lazyhttp/lazyhttptest"
+)
+
+func newTransportHarness(t *testing.T) (*lazyhttptest.Harness, *http.Client) {
+	h := lazyhttptest.New(t, lazyhttp.Config{})
+	h.Upstream.SetHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.SetCookie(w, &http.Cookie{Name: "seen", Value: "1"})
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		}
+		w.Write([]byte(r.Host))
+	}))
+	client := &http.Client{
+		Transport: lazyhttp.Transport(h.Client, nil),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return h, client
+}
+
+func get(t *testing.T, client *http.Client, url, key string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequestWithContext(lazyhttp.WithCacheKey(context.Background(), key), http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestTransportReturnsRedirects(t *testing.T) {
+	h, client := newTransportHarness(t)
+
+	resp := get(t, client, h.Upstream.URL+"/old", "old")
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("status %d, want the %d of the upstream", resp.StatusCode, http.StatusFound)
+	}
+	if got := resp.Header.Get("Location"); got != "/new" {
+		t.Errorf("Location %q, want %q", got, "/new")
+	}
+	if got := resp.Header.Get("Set-Cookie"); !strings.HasPrefix(got, "seen=1") {
+		t.Errorf("Set-Cookie %q, the cookies are for the caller", got)
+	}
+	h.AssertPathCalls("/new", 0)
+}
+
+func TestTransportUnknownStrategy(t *testing.T) {
+	h, client := newTransportHarness(t)
+
+	req, _ := http.NewRequest(http.MethodGet, h.Upstream.URL+"/a", nil)
+	req.Header.Set(lazyhttp.CacheKeyHeader, "a")
+	req.Header.Set(lazyhttp.StrategyHeader, "optimistc")
+	if _, err := client.Do(req); err == nil || !strings.Contains(err.Error(), `unknown lazyhttp strategy "optimistc"`) {
+		t.Errorf("error %v, want the unknown strategy", err)
+	}
+	h.AssertUpstreamCalls(0)
+}
+
+func TestTransportKeepsHost(t *testing.T) {
+	h, client := newTransportHarness(t)
+
+	req, _ := http.NewRequestWithContext(lazyhttp.WithCacheKey(context.Background(), "host"), http.MethodGet, h.Upstream.URL+"/host", nil)
+	req.Host = "api.example.test"
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "api.example.test" {
+		t.Errorf("upstream got host %q, want %q", body, "api.example.test")
+	}
+}
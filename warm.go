@@ -0,0 +1,254 @@
+package lazyhttp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dendhi31/lazyhttp/logger"
+)
+
+// WarmOptions tunes Warm
+type WarmOptions struct {
+	// Concurrency is the number of requests in flight, default is 4
+	Concurrency int
+	// Rate caps the requests started per second, 0 is unlimited, the highest is one request per nanosecond
+	Rate float64
+	// Progress is called after every request, from the goroutine that sent it
+	Progress func(result WarmResult)
+}
+
+// Validate checks Rate can be turned into an interval between two requests
+func (opts WarmOptions) Validate() error {
+	if opts.Rate > float64(time.Second) {
+		return fmt.Errorf("warm rate %g is above one request per nanosecond", opts.Rate)
+	}
+	return nil
+}
+
+// WarmResult is the result of one manifest entry
+type WarmResult struct {
+	Request    *Request
+	StatusCode int
+	Duration   time.Duration
+	// Err is set when the response could not be fetched or its status is not 200
+	Err error
+}
+
+// WarmReport summarizes a Warm run
+type WarmReport struct {
+	Total     int
+	Succeeded int
+	Failed    int
+	// Failures lists the failed entries
+	Failures []WarmResult
+	Duration time.Duration
+}
+
+// Warm fetches every request of manifest from the upstream and stores the responses,
+// so the cache has something to fall back to. Requests not sent when ctx is done are
+// left out of the report and ctx.Err() is returned.
+func (httprequest *Client) Warm(ctx context.Context, manifest []*Request, opts WarmOptions) (*WarmReport, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 4
+	}
+	var tick <-chan time.Time
+	if opts.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	report := &WarmReport{}
+	start := time.Now()
+	httprequest.Logger.Info("cache warming started", "requests", len(manifest), "concurrency", opts.Concurrency)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.Concurrency)
+send:
+	for i, req := range manifest {
+		if tick != nil && i > 0 {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				break send
+			}
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break send
+		}
+		wg.Add(1)
+		go func(req *Request) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			result := WarmResult{Request: req}
+			begin := time.Now()
+			result.StatusCode, _, result.Err = httprequest.fetch(ctx, req)
+			result.Duration = time.Since(begin)
+
+			mu.Lock()
+			report.Total++
+			if result.Err != nil {
+				report.Failed++
+				report.Failures = append(report.Failures, result)
+				httprequest.Logger.Warn("cache warming request failed", logger.KeyCacheKey, req.Key, logger.KeyError, result.Err)
+			} else {
+				report.Succeeded++
+			}
+			mu.Unlock()
+			if opts.Progress != nil {
+				opts.Progress(result)
+			}
+		}(req)
+	}
+	wg.Wait()
+
+	report.Duration = time.Since(start)
+	httprequest.Logger.Info("cache warming done", "succeeded", report.Succeeded, "failed", report.Failed, "duration", report.Duration)
+	return report, ctx.Err()
+}
+
+// WarmEvery runs Warm with the manifest returned by load now and on every interval, until ctx is done.
+// A failing load is logged and retried on the next interval, interval must be positive.
+func (httprequest *Client) WarmEvery(ctx context.Context, interval time.Duration, load func() ([]*Request, error), opts WarmOptions) error {
+	if interval <= 0 {
+		return fmt.Errorf("warm interval %s is not positive", interval)
+	}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		manifest, err := load()
+		if err != nil {
+			httprequest.Logger.Error("unable to load warm manifest", logger.KeyError, err)
+		} else if _, err := httprequest.Warm(ctx, manifest, opts); err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// manifestEntry is the JSON form of a manifest line
+type manifestEntry struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Header  map[string]string `json:"header"`
+	Key     string            `json:"key"`
+	Payload []byte            `json:"payload"`
+	Tags    []string          `json:"tags"`
+}
+
+// ParseManifest reads one request per line, either as JSON
+// {"url", "method", "header", "key", "payload", "tags"} or as "[METHOD] URL [KEY]".
+// The method defaults to GET and the key to the URL, empty lines and # comments are skipped.
+func ParseManifest(r io.Reader) ([]*Request, error) {
+	var manifest []*Request
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		req, err := parseManifestEntry(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		manifest = append(manifest, req)
+	}
+	return manifest, scanner.Err()
+}
+
+// LoadManifest reads a manifest file, see ParseManifest
+func LoadManifest(path string) ([]*Request, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	manifest, err := ParseManifest(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return manifest, nil
+}
+
+// ManifestFromSet reads a manifest from a redis set on the storage, one entry per member
+// in the ParseManifest line format. The set key is prefixed like the cache keys.
+func (httprequest *Client) ManifestFromSet(key string) ([]*Request, error) {
+	tagger, err := httprequest.tagger()
+	if err != nil {
+		return nil, err
+	}
+	members, err := tagger.SMembers(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	manifest := make([]*Request, 0, len(members))
+	for _, member := range members {
+		req, err := parseManifestEntry(strings.TrimSpace(member))
+		if err != nil {
+			return nil, fmt.Errorf("set %s: %v", key, err)
+		}
+		manifest = append(manifest, req)
+	}
+	return manifest, nil
+}
+
+func parseManifestEntry(text string) (*Request, error) {
+	entry := manifestEntry{Method: "GET"}
+	if strings.HasPrefix(text, "{") {
+		if err := json.Unmarshal([]byte(text), &entry); err != nil {
+			return nil, err
+		}
+	} else {
+		fields := strings.Fields(text)
+		if len(fields) > 0 && !strings.Contains(fields[0], "://") {
+			entry.Method = fields[0]
+			fields = fields[1:]
+		}
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("expected [METHOD] URL [KEY]")
+		}
+		entry.URL = fields[0]
+		if len(fields) == 2 {
+			entry.Key = fields[1]
+		}
+	}
+	if entry.URL == "" {
+		return nil, fmt.Errorf("entry has no url")
+	}
+	if entry.Method == "" {
+		entry.Method = "GET"
+	}
+	if entry.Key == "" {
+		entry.Key = entry.URL
+	}
+	return &Request{
+		URL:      entry.URL,
+		Method:   strings.ToUpper(entry.Method),
+		Body:     entry.Payload,
+		Header:   entry.Header,
+		Key:      entry.Key,
+		UseCache: true,
+		Tags:     entry.Tags,
+	}, nil
+}